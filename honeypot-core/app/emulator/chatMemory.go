@@ -0,0 +1,113 @@
+package emulator
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultHistoryTokens is how much of the prompt the session history may use.
+const DefaultHistoryTokens = 2048
+
+// maxSummaryCommands caps how many dropped commands the summary lists.
+const maxSummaryCommands = 40
+
+// ChatTurn is one command the attacker ran and the output they were shown.
+type ChatTurn struct {
+	Command string
+	Output  string
+}
+
+// ChatMessage is a message of an Ollama /api/chat request.
+type ChatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+const shellRules = `Reply with the exact output the command prints and nothing else: no explanations, no markdown, no code fences.
+Stay consistent with the earlier commands and outputs of this session.`
+
+// shellSystemPrompt tells the LLM whose terminal it is, nil is the default
+// persona.
+func shellSystemPrompt(persona *Persona) string {
+	if persona == nil {
+		persona = DefaultPersona()
+	}
+	role := persona.Role
+	if role == "" {
+		role = "a host on an industrial control network"
+	}
+	return fmt.Sprintf("You are the Linux terminal of %s, %s running %s.\n%s",
+		persona.Hostname, role, persona.OS.PrettyName, shellRules)
+}
+
+// estimateTokens approximates tokens as four bytes each, close enough for
+// English and shell output to keep a prompt inside the model's window.
+func estimateTokens(text string) int {
+	return (len(text) + 3) / 4
+}
+
+func (t ChatTurn) tokens() int {
+	return estimateTokens(t.Command) + estimateTokens(t.Output)
+}
+
+// Remember adds a turn and trims the history to the token budget. Dropped
+// turns are folded into Summary so the model still knows what was run.
+func (session *ChatSession) Remember(command string, output string) {
+	session.History = append(session.History, ChatTurn{Command: command, Output: output})
+	budget := session.MaxHistoryTokens
+	if budget <= 0 {
+		budget = DefaultHistoryTokens
+	}
+	used := 0
+	for _, turn := range session.History {
+		used += turn.tokens()
+	}
+	dropped := 0
+	// always keep the latest turn, even when it alone is over budget
+	for used > budget && dropped < len(session.History)-1 {
+		used -= session.History[dropped].tokens()
+		session.summarized = append(session.summarized, session.History[dropped].Command)
+		dropped++
+	}
+	if dropped > 0 {
+		session.History = append([]ChatTurn(nil), session.History[dropped:]...)
+	}
+	if len(session.summarized) > maxSummaryCommands {
+		session.summarized = session.summarized[len(session.summarized)-maxSummaryCommands:]
+	}
+}
+
+// Summary describes the turns that no longer fit in the history.
+func (session *ChatSession) Summary() string {
+	if len(session.summarized) == 0 {
+		return ""
+	}
+	return "Earlier in this session the user ran: " + strings.Join(session.summarized, "; ")
+}
+
+// buildMessages lays out the chat: instructions with the retrieved context,
+// the session so far as user/assistant pairs and the new command.
+func (session *ChatSession) buildMessages(contextText string, command string) []ChatMessage {
+	var system strings.Builder
+	system.WriteString(shellSystemPrompt(session.Persona))
+	if session.Persona != nil {
+		system.WriteString("\n\n")
+		system.WriteString(session.Persona.Describe())
+	}
+	if contextText != "" {
+		system.WriteString("\n\nReference output from similar hosts:\n")
+		system.WriteString(contextText)
+	}
+	if summary := session.Summary(); summary != "" {
+		system.WriteString("\n\n")
+		system.WriteString(summary)
+	}
+	messages := []ChatMessage{{Role: "system", Content: system.String()}}
+	for _, turn := range session.History {
+		messages = append(messages,
+			ChatMessage{Role: "user", Content: turn.Command},
+			ChatMessage{Role: "assistant", Content: turn.Output},
+		)
+	}
+	return append(messages, ChatMessage{Role: "user", Content: session.ShellPrompt + command})
+}
@@ -1,24 +1,29 @@
 package emulator
 
 import (
-	"bufio"
-	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
-	"github.com/qdrant/go-client/qdrant"
+	"io"
 	"log"
-	"net/http"
-	"os"
-	"strings"
+	"time"
 )
 
 type ChatSession struct {
 	CollectionName string
-	History        []string
-	Context        []int
-	Store          *Store
-	SystemID       string
+	// History holds the latest turns of the session, older turns are
+	// summarized once MaxHistoryTokens is used up.
+	History          []ChatTurn
+	MaxHistoryTokens int
+	Store            *Store
+	Generator        Generator
+	SystemID         string
+	// ShellPrompt is the prompt the attacker sees, it tells the model the
+	// user, host and working directory the command runs in.
+	ShellPrompt string
+	// Persona is the host the model pretends to be, context documents of
+	// other personas are not used.
+	Persona    *Persona
+	summarized []string
 }
 
 type RetrievedDocs struct {
@@ -26,110 +31,110 @@ type RetrievedDocs struct {
 	Score   float64 `bson:"score,omitempty"`
 }
 
-func NewChatSession(clientID string, collectionName string, store *Store) *ChatSession {
+func NewChatSession(clientID string, collectionName string, store *Store, generator Generator) *ChatSession {
 	return &ChatSession{
-		History:        make([]string, 0),
-		Store:          store,
-		SystemID:       clientID,
-		CollectionName: collectionName,
+		Generator:        generator,
+		History:          make([]ChatTurn, 0),
+		MaxHistoryTokens: DefaultHistoryTokens,
+		Store:            store,
+		SystemID:         clientID,
+		CollectionName:   collectionName,
 	}
 }
 
-func (session *ChatSession) GetTopKVectors(queryPoint *qdrant.PointStruct, topk int) ([]*qdrant.PointGroup, error) {
-	ctx := context.Background()
-	vectors := queryPoint.Vectors.GetVector().Data
-	resp, err := session.Store.Client.QueryGroups(ctx, &qdrant.QueryPointGroups{
-		CollectionName: session.CollectionName,
-		Query:          qdrant.NewQuery(vectors...),
-		GroupBy:        "document_id",
-		GroupSize:      qdrant.PtrOf(uint64(topk)),
-	})
+// GetTopKVectors finds the topk context documents nearest to query.
+func (session *ChatSession) GetTopKVectors(query *Document, topk int) ([]SearchHit, error) {
+	if session.Store == nil || session.Store.Vectors == nil {
+		return nil, fmt.Errorf("vector store is not connected")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	hits, err := session.Store.Vectors.Search(ctx, session.CollectionName, query.Vector, topk)
 	if err != nil {
 		log.Printf("QueryPointGroups: %v", err)
 		return nil, err
 	}
 
-	return resp, nil
+	return hits, nil
 }
 
-func (session *ChatSession) GetLLMResponse(prompt string) (string, error) {
-	reqBody := map[string]interface{}{
-		"model":  os.Getenv("MODEL"),
-		"prompt": prompt,
-		"stream": false,
-	}
-	reqBytes, err := json.Marshal(reqBody)
-	if err != nil {
-		return "", err
-	}
-
-	resp, err := http.Post(os.Getenv("OLLAMA_URL")+"/api/generate", "application/json", bytes.NewBuffer(reqBytes))
-	if err != nil {
-		return "", err
+// GetLLMResponse asks the session's generator for the reply to messages.
+func (session *ChatSession) GetLLMResponse(messages []ChatMessage) (string, error) {
+	if session.Generator == nil {
+		return "", fmt.Errorf("chat session has no generator")
 	}
-	defer resp.Body.Close()
-
-	scanner := bufio.NewScanner(resp.Body)
-	var fullResponse strings.Builder
-
-	for scanner.Scan() {
-		line := scanner.Text()
-		if len(line) == 0 {
-			continue // skip empty lines
-		}
-
-		var chunk struct {
-			Response   string `json:"response"`
-			Done       bool   `json:"done"`
-			Context    []int  `json:"context"`
-			DoneReason string `json:"done_reason"`
-		}
-
-		if err := json.Unmarshal([]byte(line), &chunk); err != nil {
-			// log error but keep processing next chunks if possible
-			log.Printf("Failed to unmarshal chunk: %v, line: %s", err, line)
-			continue
-		}
-
-		// Update session context if present
-		if len(chunk.Context) > 0 {
-			session.Context = chunk.Context
-		}
-
-		// Append the partial response text
-		fullResponse.WriteString(chunk.Response)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	return session.Generator.Chat(ctx, messages)
+}
 
-		if chunk.Done {
-			break
+// streamLLMResponse is GetLLMResponse writing the reply to w as it arrives.
+// Generators that cannot stream have their whole reply written at once.
+func (session *ChatSession) streamLLMResponse(messages []ChatMessage, w io.Writer) (string, error) {
+	streamer, ok := session.Generator.(StreamGenerator)
+	if !ok {
+		response, err := session.GetLLMResponse(messages)
+		if err == nil {
+			_, err = io.WriteString(w, response)
 		}
+		return response, err
 	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	return streamer.ChatStream(ctx, messages, func(chunk string) error {
+		_, err := io.WriteString(w, chunk)
+		return err
+	})
+}
 
-	if err := scanner.Err(); err != nil {
-		return "", err
-	}
-
-	return fullResponse.String(), nil
+// forPersona reports whether doc is shared context or context of the
+// session's persona.
+func (session *ChatSession) forPersona(doc Document) bool {
+	persona, _ := doc.Payload["persona"].(string)
+	return persona == "" || session.Persona != nil && persona == session.Persona.Name
 }
 
 func (session *ChatSession) GenerateResponse(userInput string) (string, error) {
+	return session.StreamResponse(userInput, nil)
+}
+
+// StreamResponse answers like GenerateResponse and, when w is not nil,
+// writes the reply to w while it is generated.
+func (session *ChatSession) StreamResponse(userInput string, w io.Writer) (string, error) {
 	// This links the whole process to geather
+	// without an embedding the LLM still answers, only without context
 	embeddingInput, err := session.Store.EmbedDocs(userInput)
 	if err != nil {
-		log.Printf("Error creating embedding input: %v", err)
-		return "", err
-	}
-	pointGroup, err := session.GetTopKVectors(embeddingInput, 3)
-	if err != nil {
-		log.Printf("Error getting embedding input: %v", err)
+		log.Printf("Error creating embedding input, answering without context: %v", err)
+		embeddingInput = nil
 	}
 	contextText := ""
-	for _, retrievedDoc := range pointGroup {
-		contextText += retrievedDoc.Lookup.String() + "\n"
+	if embeddingInput != nil {
+		// ask for extra hits, some may belong to other personas
+		hits, err := session.GetTopKVectors(embeddingInput, 6)
+		if err != nil {
+			log.Printf("Error getting embedding input: %v", err)
+		}
+		used := 0
+		for _, hit := range hits {
+			if used == 3 || !session.forPersona(hit.Document) {
+				continue
+			}
+			contextText += hit.Content() + "\n"
+			used++
+		}
+	}
+	messages := session.buildMessages(contextText, userInput)
+	var response string
+	if w == nil {
+		response, err = session.GetLLMResponse(messages)
+	} else {
+		response, err = session.streamLLMResponse(messages, w)
 	}
-	prompt := fmt.Sprintf("Context:\n%s\n\nUser: %s\n\nAssistant: %s\n\n", contextText, userInput)
-	response, err := session.GetLLMResponse(prompt)
 	if err != nil {
 		log.Printf("Error creating prompt: %v", err)
+		return "", err
 	}
+	session.Remember(session.ShellPrompt+userInput, response)
 	return response, nil
 }
@@ -0,0 +1,189 @@
+package emulator
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ContainerConfig is where the real ICS host container is reached.
+type ContainerConfig struct {
+	Addr     string `json:"addr"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+}
+
+// ContainerBackend proxies sessions to the ics-host container.
+type ContainerBackend struct {
+	Config ContainerConfig
+}
+
+func (b *ContainerBackend) Dial() (*ssh.Client, error) {
+	config := &ssh.ClientConfig{
+		User: b.Config.User,
+		Auth: []ssh.AuthMethod{
+			ssh.Password(b.Config.Password),
+		},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	}
+	return ssh.Dial("tcp", b.Config.Addr, config)
+}
+
+// Run executes a single command in a new session on client and returns its
+// combined output and exit status.
+func (b *ContainerBackend) Run(client *ssh.Client, command string, env map[string]string) ([]byte, int, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer session.Close()
+	for name, value := range env {
+		session.Setenv(name, value)
+	}
+	var output bytes.Buffer
+	session.Stdout = &output
+	session.Stderr = &output
+	err = session.Run(command)
+	if exitErr, ok := err.(*ssh.ExitError); ok {
+		return output.Bytes(), exitErr.ExitStatus(), nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return output.Bytes(), 0, nil
+}
+
+// HandleInput proxies the attacker's session to the container,
+// opening the upstream session with the same terminal, environment and
+// command the attacker asked for.
+func (b *ContainerBackend) HandleInput(channel ssh.Channel, request *SessionRequest) error {
+	defer channel.Close()
+
+	client, err := b.Dial()
+	if err != nil {
+		log.Printf("failed to connect to container: %v", err)
+		return err
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		log.Printf("failed to create session: %v", err)
+		return err
+	}
+	defer session.Close()
+
+	// sshd only accepts variables listed in AcceptEnv, a refusal is expected
+	for name, value := range request.Env {
+		if err := session.Setenv(name, value); err != nil {
+			log.Printf("upstream refused env %s: %v", name, err)
+		}
+	}
+
+	if request.PTY {
+		modes := request.Modes
+		if len(modes) == 0 {
+			modes = ssh.TerminalModes{
+				ssh.ECHO:          1,
+				ssh.TTY_OP_ISPEED: 14400,
+				ssh.TTY_OP_OSPEED: 14400,
+			}
+		}
+		if err := session.RequestPty(request.Term, int(request.Height), int(request.Width), modes); err != nil {
+			log.Printf("failed to request PTY: %v", err)
+			return err
+		}
+	}
+
+	// Attach I/O, Wait only returns once stdout and stderr are drained
+	containerIn, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	session.Stdout = channel
+	session.Stderr = channel.Stderr()
+
+	if request.Command != "" {
+		err = session.Start(request.Command)
+	} else {
+		err = session.Shell()
+	}
+	if err != nil {
+		log.Printf("failed to start shell: %v", err)
+		return err
+	}
+
+	var input io.Reader = channel
+	if request.Command == "" {
+		input = io.TeeReader(channel, &commandTap{publish: func(line string) {
+			request.PublishCommand(line, true, nil)
+		}})
+	}
+	go func() {
+		io.Copy(containerIn, input)
+		containerIn.Close()
+	}()
+	go func() {
+		for size := range request.WindowChanges {
+			if err := session.WindowChange(int(size.Height), int(size.Width)); err != nil {
+				log.Printf("failed to forward window change: %v", err)
+			}
+		}
+	}()
+
+	var status uint32
+	if err := session.Wait(); err != nil {
+		log.Printf("session finished with error: %v", err)
+		status = 255
+		if exitErr, ok := err.(*ssh.ExitError); ok {
+			status = uint32(exitErr.ExitStatus())
+		}
+	}
+	if request.Command != "" {
+		request.PublishCommand(request.Command, false, &status)
+	}
+	SendExitStatus(channel, status)
+	return nil
+}
+
+// commandTap collects the lines typed into a proxied shell. Backspace and
+// ^U are applied, escape sequences such as arrow keys are dropped, so a line
+// edited with history or tab completion may differ from what ran.
+type commandTap struct {
+	line    []byte
+	escape  bool
+	publish func(line string)
+}
+
+func (t *commandTap) Write(p []byte) (int, error) {
+	for _, c := range p {
+		switch {
+		case t.escape:
+			// CSI and SS3 sequences end with a letter or ~
+			if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c == '~' {
+				t.escape = false
+			}
+		case c == 0x1b:
+			t.escape = true
+		case c == '\r' || c == '\n':
+			if line := strings.TrimSpace(string(t.line)); line != "" {
+				t.publish(line)
+			}
+			t.line = t.line[:0]
+		case c == 0x7f || c == 0x08:
+			if len(t.line) > 0 {
+				t.line = t.line[:len(t.line)-1]
+			}
+		case c == 0x03 || c == 0x15:
+			t.line = t.line[:0]
+		case c >= 0x20:
+			t.line = append(t.line, c)
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,215 @@
+package emulator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// EmbeddedStore is an in-process VectorStore for running on a single small
+// box or without a Qdrant container. Search is a brute-force scan, which is
+// fast enough for the few thousand context chunks of a honeypot.
+// Every collection is persisted to <Dir>/<collection>.json after each
+// upsert, an empty Dir keeps everything in memory.
+type EmbeddedStore struct {
+	Dir string
+
+	mu          sync.RWMutex
+	collections map[string]*embeddedCollection
+}
+
+type embeddedCollection struct {
+	Dimension int                 `json:"dimension"`
+	Distance  Distance            `json:"distance"`
+	Documents map[string]Document `json:"documents"`
+}
+
+func (c *embeddedCollection) schema() CollectionSchema {
+	return CollectionSchema{Dimension: c.Dimension, Distance: c.Distance}
+}
+
+// NewEmbeddedStore opens the store persisted in dir, creating dir if needed.
+func NewEmbeddedStore(dir string) (*EmbeddedStore, error) {
+	store := &EmbeddedStore{Dir: dir, collections: make(map[string]*embeddedCollection)}
+	if dir == "" {
+		return store, nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating vector store directory: %w", err)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		raw, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("reading collection: %w", err)
+		}
+		var collection embeddedCollection
+		if err := json.Unmarshal(raw, &collection); err != nil {
+			return nil, fmt.Errorf("parsing collection %s: %w", file, err)
+		}
+		if collection.Documents == nil {
+			collection.Documents = make(map[string]Document)
+		}
+		if collection.Distance == "" {
+			collection.Distance = DistanceCosine
+		}
+		name := strings.TrimSuffix(filepath.Base(file), ".json")
+		store.collections[name] = &collection
+		log.Printf("Loaded collection %s with %d documents", name, len(collection.Documents))
+	}
+	return store, nil
+}
+
+func (e *EmbeddedStore) EnsureCollection(ctx context.Context, collection string, schema CollectionSchema) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if c, ok := e.collections[collection]; ok {
+		if c.schema() != schema {
+			return fmt.Errorf("collection %s holds %s vectors, the embedder makes %s vectors", collection, c.schema(), schema)
+		}
+		return nil
+	}
+	e.collections[collection] = &embeddedCollection{Dimension: schema.Dimension, Distance: schema.Distance, Documents: make(map[string]Document)}
+	return e.save(collection)
+}
+
+func (e *EmbeddedStore) Upsert(ctx context.Context, collection string, docs []Document) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	c, ok := e.collections[collection]
+	if !ok {
+		return fmt.Errorf("collection %s does not exist", collection)
+	}
+	for _, doc := range docs {
+		if len(doc.Vector) != c.Dimension {
+			return fmt.Errorf("document %s has %d dimensions, collection %s has %d", doc.ID, len(doc.Vector), collection, c.Dimension)
+		}
+		c.Documents[doc.ID] = doc
+	}
+	return e.save(collection)
+}
+
+func (e *EmbeddedStore) Delete(ctx context.Context, collection string, ids []string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	c, ok := e.collections[collection]
+	if !ok {
+		return nil
+	}
+	for _, id := range ids {
+		delete(c.Documents, id)
+	}
+	return e.save(collection)
+}
+
+func (e *EmbeddedStore) DropCollection(ctx context.Context, collection string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.collections, collection)
+	if e.Dir == "" {
+		return nil
+	}
+	err := os.Remove(filepath.Join(e.Dir, collection+".json"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (e *EmbeddedStore) Count(ctx context.Context, collection string) (int, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	c, ok := e.collections[collection]
+	if !ok {
+		return 0, nil
+	}
+	return len(c.Documents), nil
+}
+
+func (e *EmbeddedStore) Search(ctx context.Context, collection string, vector []float32, limit int) ([]SearchHit, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	c, ok := e.collections[collection]
+	if !ok {
+		return nil, fmt.Errorf("collection %s does not exist", collection)
+	}
+	if len(vector) != c.Dimension {
+		return nil, fmt.Errorf("query has %d dimensions, collection %s has %d", len(vector), collection, c.Dimension)
+	}
+	hits := make([]SearchHit, 0, len(c.Documents))
+	for _, doc := range c.Documents {
+		score := cosine(vector, doc.Vector)
+		if c.Distance == DistanceDot {
+			score = dot(vector, doc.Vector)
+		}
+		hits = append(hits, SearchHit{Document: doc, Score: score})
+	}
+	sort.Slice(hits, func(i, j int) bool { return hits[i].Score > hits[j].Score })
+	// keep the best few hits of every document
+	perDocument := make(map[string]int)
+	kept := hits[:0]
+	for _, hit := range hits {
+		group := fmt.Sprint(hit.Document.Payload["document_id"])
+		if perDocument[group] < MaxHitsPerDocument {
+			perDocument[group]++
+			kept = append(kept, hit)
+		}
+	}
+	hits = kept
+	if len(hits) > limit {
+		hits = hits[:limit]
+	}
+	return hits, nil
+}
+
+func (e *EmbeddedStore) Close() error {
+	return nil
+}
+
+// save writes a collection to disk, e.mu must be held.
+func (e *EmbeddedStore) save(collection string) error {
+	if e.Dir == "" {
+		return nil
+	}
+	raw, err := json.Marshal(e.collections[collection])
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(e.Dir, collection+".json")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0o644); err != nil {
+		return fmt.Errorf("saving collection %s: %w", collection, err)
+	}
+	return os.Rename(tmp, path)
+}
+
+func cosine(a []float32, b []float32) float32 {
+	var dot, normA, normB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return float32(dot / (math.Sqrt(normA) * math.Sqrt(normB)))
+}
+
+func dot(a []float32, b []float32) float32 {
+	var sum float64
+	for i := range a {
+		sum += float64(a[i]) * float64(b[i])
+	}
+	return float32(sum)
+}
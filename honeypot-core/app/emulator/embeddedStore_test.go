@@ -0,0 +1,50 @@
+package emulator
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestEmbeddedSearchKeepsSeveralChunksOfADocument(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewEmbeddedStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.EnsureCollection(ctx, "test", CollectionSchema{Dimension: 2, Distance: DistanceCosine}); err != nil {
+		t.Fatal(err)
+	}
+	// five chunks of a long man page close to the query, one other file further off
+	var docs []Document
+	for i := 0; i < 5; i++ {
+		docs = append(docs, Document{
+			ID:      fmt.Sprintf("man-%d", i),
+			Vector:  []float32{1, float32(i) / 10},
+			Payload: map[string]any{"document_id": "man/ls.txt", "content": fmt.Sprint(i)},
+		})
+	}
+	docs = append(docs, Document{
+		ID:      "motd",
+		Vector:  []float32{1, 1},
+		Payload: map[string]any{"document_id": "etc/motd", "content": "motd"},
+	})
+	if err := store.Upsert(ctx, "test", docs); err != nil {
+		t.Fatal(err)
+	}
+	hits, err := store.Search(ctx, "test", []float32{1, 0}, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, hit := range hits {
+		got = append(got, hit.ID)
+	}
+	want := []string{"man-0", "man-1", "man-2", "motd"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if hits, _ := store.Search(ctx, "test", []float32{1, 0}, 2); len(hits) != 2 {
+		t.Errorf("limit 2 returned %d hits", len(hits))
+	}
+}
@@ -1,15 +1,21 @@
 package emulator
 
 import (
-	"github.com/qdrant/go-client/qdrant"
+	"context"
+	"fmt"
 	"log"
+	"sync"
 	"time"
 )
 
 type NodeContext struct {
 	CollectionName string
 	PathToContext  string
-	Store          *Store
+	// Persona tags the context chunks, empty means they fit every host.
+	Persona string
+	// ManifestPath records what of PathToContext is embedded already.
+	ManifestPath string
+	Store        *Store
 }
 
 type EmbeddedDocs struct {
@@ -21,76 +27,234 @@ type Emulator interface {
 	Init()
 }
 
-func EmbedContext(context NodeContext, store Store) error {
+// EmbedOptions tunes EmbedContext, zero fields get the defaults.
+type EmbedOptions struct {
+	// Workers is how many chunks are embedded at once, default 4.
+	Workers int
+	// BatchSize is how many vectors are upserted together, default 32.
+	BatchSize int
+	// Retries is how often a failed embedding is tried again, default 3.
+	Retries int
+	// Backoff is the wait before the first retry, doubled on every retry,
+	// default 500ms.
+	Backoff time.Duration
+}
 
-	lineChan := make(chan string, 100)
-	embeddingChan := make(chan *qdrant.PointStruct, 1000)
-	log.Printf("Starting to embed data")
-	go func() {
-		defer close(lineChan)
-		lines, err := store.ReadContextFiles(context)
-		if err != nil {
-			log.Printf("Failed to read context files: %v", err)
+func (o EmbedOptions) withDefaults() EmbedOptions {
+	if o.Workers <= 0 {
+		o.Workers = 4
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = 32
+	}
+	if o.Retries < 0 {
+		o.Retries = 0
+	} else if o.Retries == 0 {
+		o.Retries = 3
+	}
+	if o.Backoff <= 0 {
+		o.Backoff = 500 * time.Millisecond
+	}
+	return o
+}
+
+// EmbedResult sums up a run of EmbedContext.
+type EmbedResult struct {
+	// Chunks is how many distinct chunks the context has.
+	Chunks int
+	// Unchanged chunks were embedded by an earlier run.
+	Unchanged int
+	Embedded  int
+	Deleted   int
+	Failed    int
+	Duration  time.Duration
+}
+
+func (r EmbedResult) String() string {
+	return fmt.Sprintf("%d chunks: %d embedded, %d unchanged, %d deleted, %d failed in %s",
+		r.Chunks, r.Embedded, r.Unchanged, r.Deleted, r.Failed, r.Duration.Round(time.Millisecond))
+}
+
+type embedded struct {
+	doc *Document
+	err error
+}
+
+// EmbedContext brings the context collection in line with the files under
+// PathToContext. Only chunks missing from the manifest are embedded, chunks
+// gone from the files are deleted and a change of embedding model rebuilds
+// the collection. It returns when everything is stored or ctx is done, run
+// it in a goroutine to serve while it works.
+func EmbedContext(ctx context.Context, nodeContext NodeContext, store Store, options EmbedOptions) (EmbedResult, error) {
+	started := time.Now()
+	options = options.withDefaults()
+	var result EmbedResult
+	if store.Vectors == nil {
+		return result, fmt.Errorf("vector store is not connected")
+	}
+	if store.Embedder == nil {
+		return result, fmt.Errorf("store has no embedder")
+	}
+	manifest, err := LoadManifest(nodeContext.ManifestPath)
+	if err != nil {
+		return result, err
+	}
+	model := store.Embedder.Model()
+	if manifest.Model != model || manifest.Collection != nodeContext.CollectionName {
+		// the old vectors are useless to the new model
+		if manifest.Collection != "" {
+			log.Printf("Embedding model changed from %q to %q, replacing %s with %s", manifest.Model, model, manifest.Collection, nodeContext.CollectionName)
+			if err := store.Vectors.DropCollection(ctx, manifest.Collection); err != nil {
+				return result, fmt.Errorf("dropping collection %s: %w", manifest.Collection, err)
+			}
 		}
-		for _, line := range lines {
-			if len(line) == 0 {
-				continue
+		manifest.Reset(nodeContext.CollectionName, model)
+	}
+	// a collection of another shape fails here, before anything is embedded
+	if err := store.EnsureCollection(nodeContext.CollectionName); err != nil {
+		return result, err
+	}
+	// the manifest only holds when the store kept what it lists, a wiped
+	// or recreated collection or a run killed between upsert and save does not
+	count, err := store.Vectors.Count(ctx, nodeContext.CollectionName)
+	if err != nil {
+		return result, fmt.Errorf("counting %s: %w", nodeContext.CollectionName, err)
+	}
+	if count != len(manifest.Chunks) {
+		log.Printf("Collection %s holds %d chunks, the manifest lists %d, rebuilding it", nodeContext.CollectionName, count, len(manifest.Chunks))
+		if count > 0 {
+			if err := store.Vectors.DropCollection(ctx, nodeContext.CollectionName); err != nil {
+				return result, fmt.Errorf("dropping collection %s: %w", nodeContext.CollectionName, err)
 			}
-			select {
-			case lineChan <- line:
-			default:
-				log.Printf("Line channel full, waiting...")
-				time.Sleep(1 * time.Second)
-				lineChan <- line
+			if err := store.EnsureCollection(nodeContext.CollectionName); err != nil {
+				return result, err
 			}
 		}
-	}()
+		manifest.Reset(nodeContext.CollectionName, model)
+	}
+	chunks, err := store.ReadContextFiles(nodeContext)
+	if err != nil {
+		return result, err
+	}
+	added, removed := manifest.Diff(chunks)
+	// identical chunks share an ID and are stored once
+	distinct := make(map[string]bool, len(chunks))
+	for _, chunk := range chunks {
+		distinct[chunk.ID()] = true
+	}
+	result.Chunks = len(distinct)
+	result.Unchanged = len(distinct) - len(added)
+	if len(removed) > 0 {
+		if err := store.Vectors.Delete(ctx, nodeContext.CollectionName, removed); err != nil {
+			return result, fmt.Errorf("deleting stale chunks: %w", err)
+		}
+		for _, id := range removed {
+			delete(manifest.Chunks, id)
+		}
+		result.Deleted = len(removed)
+		log.Printf("Deleted %d stale chunks from %s", len(removed), nodeContext.CollectionName)
+	}
+	if err := manifest.Save(); err != nil {
+		return result, err
+	}
+	log.Printf("Starting to embed %d of %d context chunks with %d workers", len(added), len(chunks), options.Workers)
+
+	// unbuffered channels, a slow embedder or store holds the producer back
+	chunkChan := make(chan Chunk)
+	results := make(chan embedded)
 	go func() {
-		defer close(embeddingChan)
-		for line := range lineChan {
-			embedding, err := store.EmbedDocs(line)
-			if err != nil {
-				log.Printf("Failed to embed context: %v", err)
-				continue
-			}
+		defer close(chunkChan)
+		for _, chunk := range added {
 			select {
-			case embeddingChan <- embedding:
-			default:
-				log.Printf("Embedding channel full, waiting...")
-				time.Sleep(1 * time.Second)
+			case chunkChan <- chunk:
+			case <-ctx.Done():
+				return
 			}
 		}
 	}()
-	go func() {
-		batch := make([]*qdrant.PointStruct, 0, 100)
-		ticker := time.NewTicker(2 * time.Second)
-		batchSize := 20
-		defer ticker.Stop()
-		for {
-			select {
-			case embedding, ok := <-embeddingChan:
-				if !ok {
-					if len(batch) > 0 {
-						store.AddVectors("ssh_emulator", batch)
-					}
-					log.Printf("Ebedding err: %v", ok)
+	var workers sync.WaitGroup
+	for i := 0; i < options.Workers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for chunk := range chunkChan {
+				doc, err := embedWithRetry(ctx, store, chunk, options)
+				select {
+				case results <- embedded{doc: doc, err: err}:
+				case <-ctx.Done():
 					return
 				}
-				if embedding != nil {
-					batch = append(batch, embedding)
-				}
-				batch = append(batch, embedding)
-				if len(batch) > batchSize {
-					store.AddVectors("ssh_emulator", batch)
-					batch = batch[:0]
-				}
-			case <-ticker.C:
-				if len(batch) > 0 {
-					store.AddVectors("ssh_emulator", batch)
-					batch = batch[:0]
-				}
 			}
-		}
+		}()
+	}
+	go func() {
+		workers.Wait()
+		close(results)
 	}()
-	return nil
+
+	batch := make([]Document, 0, options.BatchSize)
+	// flush stores the batch and records it in the manifest
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := store.AddVectors(nodeContext.CollectionName, batch); err != nil {
+			log.Printf("Failed to add vectors: %v", err)
+			result.Failed += len(batch)
+			batch = batch[:0]
+			return
+		}
+		for _, doc := range batch {
+			index, _ := doc.Payload["chunk_index"].(int)
+			source, _ := doc.Payload["source"].(string)
+			manifest.Chunks[doc.ID] = ManifestEntry{Source: source, Index: index}
+		}
+		if err := manifest.Save(); err != nil {
+			log.Printf("Failed to save manifest: %v", err)
+		}
+		result.Embedded += len(batch)
+		log.Printf("Embedded %d of %d chunks", result.Embedded, len(added))
+		batch = batch[:0]
+	}
+	for r := range results {
+		switch {
+		case r.err != nil && ctx.Err() != nil:
+			// cut short by the cancel, not a failure
+		case r.err != nil:
+			log.Printf("Failed to embed context: %v", r.err)
+			result.Failed++
+		case r.doc == nil:
+			result.Failed++
+		default:
+			batch = append(batch, *r.doc)
+			if len(batch) >= options.BatchSize {
+				flush()
+			}
+		}
+	}
+	// what was embedded before a cancel is kept
+	flush()
+	result.Duration = time.Since(started)
+	return result, ctx.Err()
+}
+
+// embedWithRetry embeds a chunk, retrying with exponential backoff.
+func embedWithRetry(ctx context.Context, store Store, chunk Chunk, options EmbedOptions) (*Document, error) {
+	backoff := options.Backoff
+	for attempt := 0; ; attempt++ {
+		doc, err := store.EmbedChunk(ctx, chunk)
+		if err == nil || attempt == options.Retries || ctx.Err() != nil {
+			if err != nil {
+				return nil, fmt.Errorf("%s#%d: %w", chunk.Source, chunk.Index, err)
+			}
+			return doc, nil
+		}
+		log.Printf("Embedding %s#%d failed, retrying in %s: %v", chunk.Source, chunk.Index, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+	}
 }
@@ -0,0 +1,94 @@
+package emulator
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEmbedContextRebuildsAWipedCollection(t *testing.T) {
+	dir := t.TempDir()
+	contextDir := filepath.Join(dir, "context")
+	if err := os.MkdirAll(contextDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{
+		"motd.txt":   "Welcome to the pump station HMI.",
+		"uname.txt":  "Linux hmi-panel 4.19.0-18-amd64",
+		"issue.txt":  "Debian GNU/Linux 10",
+		"hosts.conf": "172.38.0.20 plc-tank",
+	} {
+		if err := os.WriteFile(filepath.Join(contextDir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	nodeContext := NodeContext{
+		CollectionName: "test",
+		PathToContext:  contextDir,
+		ManifestPath:   filepath.Join(dir, "manifest.json"),
+	}
+	embed := func(vectors VectorStore) EmbedResult {
+		t.Helper()
+		store := Store{Embedder: NewMockLLM(), Vectors: vectors}
+		result, err := EmbedContext(context.Background(), nodeContext, store, EmbedOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	vectors, _ := NewEmbeddedStore("")
+	first := embed(vectors)
+	if first.Chunks == 0 || first.Embedded != first.Chunks {
+		t.Fatalf("first run: %v", first)
+	}
+	if again := embed(vectors); again.Embedded != 0 || again.Unchanged != first.Chunks {
+		t.Errorf("second run into the same store: %v", again)
+	}
+	// the manifest survives, the store does not
+	wiped, _ := NewEmbeddedStore("")
+	if rebuilt := embed(wiped); rebuilt.Embedded != first.Chunks || rebuilt.Unchanged != 0 {
+		t.Errorf("run into a wiped store: %v", rebuilt)
+	}
+	if count, _ := wiped.Count(context.Background(), "test"); count != first.Chunks {
+		t.Errorf("wiped store holds %d chunks, want %d", count, first.Chunks)
+	}
+}
+
+func TestEmbedContextDropsTheCollectionOfTheOldModel(t *testing.T) {
+	dir := t.TempDir()
+	contextDir := filepath.Join(dir, "context")
+	if err := os.MkdirAll(contextDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(contextDir, "motd.txt"), []byte("Welcome to the pump station HMI."), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	vectors, _ := NewEmbeddedStore("")
+	embed := func(embedder *MockLLM) string {
+		t.Helper()
+		store := Store{Embedder: embedder, Vectors: vectors}
+		nodeContext := NodeContext{
+			CollectionName: store.CollectionFor("ssh_emulator"),
+			PathToContext:  contextDir,
+			ManifestPath:   filepath.Join(dir, "manifest.json"),
+		}
+		if _, err := EmbedContext(context.Background(), nodeContext, store, EmbedOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		return nodeContext.CollectionName
+	}
+	old := embed(NewMockLLM())
+	small := NewMockLLM()
+	small.Dimension = 8
+	current := embed(small)
+	if old == current {
+		t.Fatalf("both models use collection %s", old)
+	}
+	if count, _ := vectors.Count(context.Background(), old); count != 0 {
+		t.Errorf("collection %s of the old model still holds %d chunks", old, count)
+	}
+	if count, _ := vectors.Count(context.Background(), current); count == 0 {
+		t.Errorf("collection %s of the new model is empty", current)
+	}
+}
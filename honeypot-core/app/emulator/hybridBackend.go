@@ -0,0 +1,66 @@
+package emulator
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// HybridBackend runs commands in the ics-host container and falls back to the
+// LLM when a command is on the deny list, is missing in the container or the
+// container cannot be reached. The LLM's answers are shared through the
+// response cache only until the container ran a command of the session, from
+// then on the container may hold files or processes the cached answers know
+// nothing of.
+type HybridBackend struct {
+	Container *ContainerBackend
+	LLM       *LLMBackend
+	DenyList  []string
+}
+
+func (b *HybridBackend) HandleInput(channel ssh.Channel, request *SessionRequest) error {
+	defer channel.Close()
+	chat := b.LLM.newChat(request)
+
+	client, err := b.Container.Dial()
+	if err != nil {
+		log.Printf("hybrid backend could not reach container, using LLM only: %v", err)
+		client = nil
+	} else {
+		defer client.Close()
+	}
+
+	shell := NewShell(request.User, b.LLM.Persona.Hostname, request.Env)
+	// ran is set once the container ran a command, whatever its status
+	ran := false
+	shell.Fallback = func(line string, stdout io.Writer) (string, uint32) {
+		if program, denied := deniedProgram(line, b.DenyList); denied {
+			log.Printf("hybrid backend: %s is denied, asking LLM", program)
+			return b.LLM.answer(chat, shell, line, stdout, !ran)
+		}
+		if client == nil {
+			return b.LLM.answer(chat, shell, line, stdout, true)
+		}
+		// every command runs in a fresh session, so carry the cwd over
+		command := fmt.Sprintf("cd %s 2>/dev/null; %s", shellQuote(shell.Cwd), line)
+		output, status, err := b.Container.Run(client, command, request.Env)
+		// 126 and 127 are the shell's "cannot execute" and "not found"
+		if err != nil || status == 126 || status == 127 {
+			log.Printf("hybrid backend: container could not run %q (status %d, err %v), asking LLM", line, status, err)
+			return b.LLM.answer(chat, shell, line, stdout, !ran)
+		}
+		ran = true
+		return string(output), uint32(status)
+	}
+	// the container runs another OS, the persona's answers to hostname,
+	// uname and id keep the host consistent with its SSH banner
+	b.LLM.Persona.Install(shell)
+	return runShell(channel, request, shell, b.LLM.Persona.MOTD)
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,309 @@
+package emulator
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+// maxChunkBytes keeps a chunk well inside an embedding model's context.
+const maxChunkBytes = 1500
+
+// Chunk is a piece of a context file to embed on its own.
+type Chunk struct {
+	// Source is the file's path relative to the context directory, it is
+	// also the chunk's document_id.
+	Source  string
+	Index   int
+	Persona string
+	Content string
+}
+
+// chunkNamespace seeds the name based UUIDs of chunks.
+var chunkNamespace = uuid.NewSHA1(uuid.NameSpaceURL, []byte("honeypot-core/context-chunk"))
+
+// ID is derived from the source path and content, the same chunk always gets
+// the same ID and a changed chunk a new one.
+func (c Chunk) ID() string {
+	return uuid.NewSHA1(chunkNamespace, []byte(c.Source+"\x00"+c.Content)).String()
+}
+
+// Payload is what the vector store keeps next to the chunk's vector.
+func (c Chunk) Payload() map[string]any {
+	return map[string]any{
+		"content":     c.Content,
+		"source":      c.Source,
+		"chunk_index": c.Index,
+		"document_id": c.Source,
+		"persona":     c.Persona,
+	}
+}
+
+// ReadContext walks root and cuts every file into chunks by its format.
+// Files under personas/<name>/ are tagged with that persona, all others
+// with persona.
+func ReadContext(root string, persona string) ([]Chunk, error) {
+	var chunks []Chunk
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if path != root && strings.HasPrefix(entry.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf("Could not read file: %v", err)
+			return nil
+		}
+		if bytes.IndexByte(data, 0) >= 0 {
+			log.Printf("Skipping binary context file %s", path)
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		filePersona := persona
+		if parts := strings.SplitN(rel, "/", 3); len(parts) == 3 && parts[0] == "personas" {
+			filePersona = parts[1]
+		}
+		for i, content := range chunkFile(rel, string(data)) {
+			chunks = append(chunks, Chunk{Source: rel, Index: i, Persona: filePersona, Content: content})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not read context: %w", err)
+	}
+	return chunks, nil
+}
+
+var (
+	promptLine = regexp.MustCompile(`^(\S+@\S+:\S*[$#]|[$#]) `)
+	manHeader  = regexp.MustCompile(`^[A-Z][A-Z0-9 ]+$`)
+	iniSection = regexp.MustCompile(`^\s*\[[^\]]+\]\s*$`)
+	manExt     = regexp.MustCompile(`\.[1-8][a-z]*$`)
+)
+
+// chunkFile picks a chunker by the file's name and content.
+func chunkFile(name string, data string) []string {
+	data = strings.ReplaceAll(data, "\r\n", "\n")
+	var chunks []string
+	ext := strings.ToLower(filepath.Ext(name))
+	switch {
+	case ext == ".json":
+		chunks = chunkJSON(data)
+	case ext == ".yaml" || ext == ".yml":
+		chunks = chunkYAML(data)
+	case manExt.MatchString(name) || ext == ".man" || strings.Contains(data, "\n.SH "):
+		chunks = chunkManPage(data)
+	case isTranscript(data):
+		chunks = chunkTranscript(data)
+	case ext == ".conf" || ext == ".cfg" || ext == ".ini" || ext == ".service" || strings.HasSuffix(name, "_config"):
+		chunks = chunkConfig(data)
+	default:
+		chunks = chunkParagraphs(data)
+	}
+	var result []string
+	for _, chunk := range chunks {
+		chunk = strings.TrimSpace(chunk)
+		if chunk == "" {
+			continue
+		}
+		result = append(result, splitLong(chunk)...)
+	}
+	return result
+}
+
+// isTranscript reports whether at least two lines look like shell prompts.
+func isTranscript(data string) bool {
+	prompts := 0
+	for _, line := range strings.Split(data, "\n") {
+		if promptLine.MatchString(line) {
+			prompts++
+			if prompts >= 2 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// chunkTranscript gives one chunk per command and its output.
+func chunkTranscript(data string) []string {
+	return splitBefore(data, func(line string) bool { return promptLine.MatchString(line) })
+}
+
+// chunkManPage splits roff source at .SH and rendered pages at their
+// all-caps section headers.
+func chunkManPage(data string) []string {
+	if strings.Contains(data, "\n.SH ") || strings.HasPrefix(data, ".SH ") {
+		return splitBefore(data, func(line string) bool { return strings.HasPrefix(line, ".SH ") })
+	}
+	return splitBefore(data, func(line string) bool { return manHeader.MatchString(line) })
+}
+
+// chunkConfig splits ini style files by [section], other config files by
+// blank-line separated blocks.
+func chunkConfig(data string) []string {
+	if firstMatchingLine(data, iniSection) != "" {
+		return splitBefore(data, func(line string) bool { return iniSection.MatchString(line) })
+	}
+	return chunkParagraphs(data)
+}
+
+// chunkJSON gives one chunk per element of a top-level array. An object
+// small enough is one chunk, a bigger one is split by its top-level keys.
+func chunkJSON(data string) []string {
+	var list []json.RawMessage
+	if err := json.Unmarshal([]byte(data), &list); err == nil {
+		chunks := make([]string, 0, len(list))
+		for _, item := range list {
+			chunks = append(chunks, string(item))
+		}
+		return chunks
+	}
+	if len(data) <= maxChunkBytes {
+		return []string{data}
+	}
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(data), &object); err != nil {
+		log.Printf("Context file is not valid JSON, indexing it as text: %v", err)
+		return chunkParagraphs(data)
+	}
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	chunks := make([]string, 0, len(object))
+	for _, key := range keys {
+		chunks = append(chunks, fmt.Sprintf("{%q: %s}", key, object[key]))
+	}
+	return chunks
+}
+
+// chunkYAML gives one chunk per document. A document too big is split at
+// its top-level keys and list items.
+func chunkYAML(data string) []string {
+	var chunks []string
+	for _, doc := range splitBefore(data, func(line string) bool { return strings.HasPrefix(line, "---") }) {
+		doc = strings.TrimPrefix(strings.TrimSpace(doc), "---")
+		if len(doc) <= maxChunkBytes {
+			chunks = append(chunks, doc)
+			continue
+		}
+		chunks = append(chunks, splitBefore(doc, func(line string) bool {
+			return line != "" && line[0] != ' ' && line[0] != '\t' && line[0] != '#'
+		})...)
+	}
+	return chunks
+}
+
+// chunkParagraphs joins blank-line separated paragraphs up to maxChunkBytes.
+func chunkParagraphs(data string) []string {
+	var chunks []string
+	var current strings.Builder
+	for _, paragraph := range strings.Split(data, "\n\n") {
+		paragraph = strings.TrimSpace(paragraph)
+		if paragraph == "" {
+			continue
+		}
+		if current.Len() > 0 && current.Len()+len(paragraph) > maxChunkBytes {
+			chunks = append(chunks, current.String())
+			current.Reset()
+		}
+		if current.Len() > 0 {
+			current.WriteString("\n\n")
+		}
+		current.WriteString(paragraph)
+	}
+	if current.Len() > 0 {
+		chunks = append(chunks, current.String())
+	}
+	return chunks
+}
+
+// splitBefore starts a new chunk at every line that isStart.
+func splitBefore(data string, isStart func(line string) bool) []string {
+	var chunks []string
+	var current []string
+	for _, line := range strings.Split(data, "\n") {
+		if isStart(line) && len(current) > 0 {
+			chunks = append(chunks, strings.Join(current, "\n"))
+			current = nil
+		}
+		current = append(current, line)
+	}
+	if len(current) > 0 {
+		chunks = append(chunks, strings.Join(current, "\n"))
+	}
+	return chunks
+}
+
+// splitLong cuts a chunk over maxChunkBytes at line boundaries, and a line
+// over it between two characters.
+func splitLong(chunk string) []string {
+	if len(chunk) <= maxChunkBytes {
+		return []string{chunk}
+	}
+	var pieces []string
+	var current strings.Builder
+	for _, line := range strings.Split(chunk, "\n") {
+		for len(line) > maxChunkBytes {
+			if current.Len() > 0 {
+				pieces = append(pieces, current.String())
+				current.Reset()
+			}
+			cut := maxChunkBytes
+			for cut > 0 && !utf8.RuneStart(line[cut]) {
+				cut--
+			}
+			if cut == 0 {
+				// no character starts here, it is not UTF-8 anyway
+				cut = maxChunkBytes
+			}
+			pieces = append(pieces, line[:cut])
+			line = line[cut:]
+		}
+		if current.Len() > 0 && current.Len()+len(line)+1 > maxChunkBytes {
+			pieces = append(pieces, current.String())
+			current.Reset()
+		}
+		if current.Len() > 0 {
+			current.WriteByte('\n')
+		}
+		current.WriteString(line)
+	}
+	if strings.TrimSpace(current.String()) != "" {
+		pieces = append(pieces, current.String())
+	}
+	return pieces
+}
+
+func firstMatchingLine(data string, pattern *regexp.Regexp) string {
+	for _, line := range strings.Split(data, "\n") {
+		if pattern.MatchString(line) {
+			return line
+		}
+	}
+	return ""
+}
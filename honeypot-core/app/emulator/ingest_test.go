@@ -0,0 +1,24 @@
+package emulator
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitLongKeepsCharactersWhole(t *testing.T) {
+	// 1499 bytes of ASCII put the first "é" across the 1500 byte cut
+	line := strings.Repeat("a", maxChunkBytes-1) + strings.Repeat("é", maxChunkBytes)
+	pieces := splitLong(line)
+	if len(pieces) < 2 {
+		t.Fatalf("a %d byte line was not split", len(line))
+	}
+	for i, piece := range pieces {
+		if len(piece) > maxChunkBytes || !utf8.ValidString(piece) {
+			t.Errorf("piece %d is %d bytes, valid UTF-8 %v", i, len(piece), utf8.ValidString(piece))
+		}
+	}
+	if joined := strings.Join(pieces, ""); joined != line {
+		t.Error("the pieces do not add up to the line")
+	}
+}
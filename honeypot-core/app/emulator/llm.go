@@ -0,0 +1,78 @@
+package emulator
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+// Generator produces the reply to a chat.
+type Generator interface {
+	Chat(ctx context.Context, messages []ChatMessage) (string, error)
+}
+
+// StreamGenerator is a Generator that hands out the reply while it is being
+// generated. onChunk gets every piece as it arrives, an error from it stops
+// the generation. The whole reply is returned at the end.
+type StreamGenerator interface {
+	Generator
+	ChatStream(ctx context.Context, messages []ChatMessage, onChunk func(chunk string) error) (string, error)
+}
+
+// Embedder turns text into a vector for the vector store.
+type Embedder interface {
+	Embed(ctx context.Context, text string) ([]float32, error)
+	// Model names the embedding model, vectors of different models cannot
+	// be compared.
+	Model() string
+}
+
+// LLM providers selected with LLM_PROVIDER.
+const (
+	ProviderOllama = "ollama"
+	ProviderOpenAI = "openai"
+	ProviderMock   = "mock"
+)
+
+// NewLLMFromEnv builds the generator and embedder from the environment:
+//
+//	LLM_PROVIDER     ollama (default), openai or mock
+//	OLLAMA_URL       Ollama server, e.g. http://ollama:11434
+//	OPENAI_BASE_URL  OpenAI compatible API, e.g. http://llama-cpp:8080/v1
+//	OPENAI_API_KEY   optional bearer token for the OpenAI compatible API
+//	CHAT_MODEL       model answering commands, defaults to MODEL
+//	EMBED_MODEL      model embedding context, defaults to MODEL
+//	MOCK_RESPONSES   JSON file of canned command outputs for the mock
+func NewLLMFromEnv() (Generator, Embedder, error) {
+	chatModel := envOr("CHAT_MODEL", os.Getenv("MODEL"))
+	embedModel := envOr("EMBED_MODEL", os.Getenv("MODEL"))
+	switch provider := envOr("LLM_PROVIDER", ProviderOllama); provider {
+	case ProviderOllama:
+		client := NewOllamaClient(envOr("OLLAMA_URL", "http://ollama:11434"), chatModel, embedModel)
+		return client, client, nil
+	case ProviderOpenAI:
+		baseURL := os.Getenv("OPENAI_BASE_URL")
+		if baseURL == "" {
+			return nil, nil, fmt.Errorf("OPENAI_BASE_URL must be set for the openai provider")
+		}
+		client := NewOpenAIClient(baseURL, os.Getenv("OPENAI_API_KEY"), chatModel, embedModel)
+		return client, client, nil
+	case ProviderMock:
+		mock := NewMockLLM()
+		if path := os.Getenv("MOCK_RESPONSES"); path != "" {
+			if err := mock.LoadResponses(path); err != nil {
+				return nil, nil, err
+			}
+		}
+		return mock, mock, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown LLM_PROVIDER %q", provider)
+	}
+}
+
+func envOr(name string, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
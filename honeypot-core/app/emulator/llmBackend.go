@@ -0,0 +1,176 @@
+package emulator
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// LLMBackend answers every command of a session with the LLM.
+type LLMBackend struct {
+	Context   NodeContext
+	Generator Generator
+	// Persona is the host the shell pretends to be.
+	Persona    *Persona
+	Filesystem *Snapshot
+	// Cache answers repeated commands without asking the LLM, may be nil.
+	Cache *ResponseCache
+}
+
+// HandleInput runs an emulated shell. Built-ins and file tools are answered
+// locally from a copy-on-write view of the filesystem snapshot and every
+// other command by the LLM.
+func (b *LLMBackend) HandleInput(channel ssh.Channel, request *SessionRequest) error {
+	defer channel.Close()
+	chat := b.newChat(request)
+	shell := NewShell(request.User, b.Persona.Hostname, request.Env)
+	var sfs *SessionFS
+	var pristine uint64
+	shell.Fallback = func(line string, stdout io.Writer) (string, uint32) {
+		// cached answers were given for the snapshot as it is, once the
+		// session changed it they could contradict ls
+		return b.answer(chat, shell, line, stdout, sfs.Generation() == pristine)
+	}
+	shell.Record = chat.Remember
+	snapshot := b.Filesystem
+	if snapshot == nil {
+		snapshot = NewSnapshot()
+	}
+	sfs = snapshot.Session()
+	sfs.Generate = func(name string) (string, error) {
+		chat.ShellPrompt = shell.Prompt()
+		return chat.GenerateResponse("cat " + name)
+	}
+	b.Persona.Seed(sfs, request.User)
+	InstallFilesystem(shell, sfs)
+	b.Persona.Install(shell)
+	pristine = sfs.Generation()
+	return runShell(channel, request, shell, b.Persona.MOTD)
+}
+
+func (b *LLMBackend) newChat(request *SessionRequest) *ChatSession {
+	chat := NewChatSession(request.SessionID, b.Context.CollectionName, b.Context.Store, b.Generator)
+	chat.Persona = b.Persona
+	return chat
+}
+
+// answer asks the LLM for the output of line. With stdout set the output is
+// streamed there through a Pacer and nothing is returned. The cache is only
+// used when cached is set.
+func (b *LLMBackend) answer(chat *ChatSession, shell *Shell, line string, stdout io.Writer, cached bool) (string, uint32) {
+	chat.ShellPrompt = shell.Prompt()
+	key := CacheKey{Persona: b.Persona.Name, User: shell.User, Cwd: shell.Cwd, Command: line}
+	cache := b.Cache
+	if !cached {
+		cache = nil
+	}
+	if output, ok := cache.Get(key); ok {
+		chat.Remember(chat.ShellPrompt+line, output)
+		if stdout == nil {
+			return output, 0
+		}
+		pacer := NewPacer(stdout)
+		err := pacer.Chunk(output)
+		if closeErr := pacer.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			log.Printf("Failed to write output: %v", err)
+		}
+		return "", 0
+	}
+	if stdout == nil {
+		response, err := chat.GenerateResponse(line)
+		if err != nil {
+			log.Printf("LLM failed to answer %q: %v", line, err)
+			return commandNotFound(line), 127
+		}
+		cache.Put(key, response)
+		return response, 0
+	}
+	pacer := NewPacer(stdout)
+	response, err := chat.StreamResponse(line, pacer)
+	if closeErr := pacer.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Printf("LLM failed to answer %q: %v", line, err)
+		// once output has been shown the command just ends there
+		if pacer.Written() == 0 {
+			return commandNotFound(line), 127
+		}
+		return "", 1
+	}
+	cache.Put(key, response)
+	return "", 0
+}
+
+func commandNotFound(line string) string {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("-bash: %s: command not found", fields[0])
+}
+
+// runShell runs an exec command or an interactive read-eval loop through
+// shell. With a PTY the line editing and echo is done by a term.Terminal like
+// a real shell would, after showing motd.
+func runShell(channel ssh.Channel, request *SessionRequest, shell *Shell, motd string) error {
+	shell.Publish = request.Publish
+	if request.Command != "" {
+		shell.Stdout = channel
+		_, status := shell.Execute(request.Command)
+		request.PublishCommand(request.Command, false, &status)
+		SendExitStatus(channel, status)
+		return nil
+	}
+
+	if !request.PTY {
+		// a shell without a terminal prints no prompt
+		shell.Stdout = channel
+		scanner := bufio.NewScanner(channel)
+		for !shell.Exited() && scanner.Scan() {
+			line := scanner.Text()
+			_, status := shell.Execute(line)
+			if strings.TrimSpace(line) != "" {
+				request.PublishCommand(line, true, &status)
+			}
+		}
+		SendExitStatus(channel, shell.Status)
+		return scanner.Err()
+	}
+
+	terminal := term.NewTerminal(channel, shell.Prompt())
+	terminal.SetSize(int(request.Width), int(request.Height))
+	shell.Stdout = terminal
+	if motd != "" {
+		terminal.Write([]byte(motd + "\n"))
+	}
+	go func() {
+		for size := range request.WindowChanges {
+			terminal.SetSize(int(size.Width), int(size.Height))
+		}
+	}()
+	for !shell.Exited() {
+		terminal.SetPrompt(shell.Prompt())
+		line, err := terminal.ReadLine()
+		if err != nil {
+			break
+		}
+		_, status := shell.Execute(line)
+		if strings.TrimSpace(line) != "" {
+			request.PublishCommand(line, true, &status)
+		}
+	}
+	if shell.Exited() {
+		terminal.Write([]byte("logout\n"))
+	}
+	SendExitStatus(channel, shell.Status)
+	return nil
+}
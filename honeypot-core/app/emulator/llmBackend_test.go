@@ -0,0 +1,131 @@
+package emulator
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testChannel is an ssh.Channel that reads the attacker's input from a
+// string and keeps everything written back.
+type testChannel struct {
+	io.Reader
+	out    bytes.Buffer
+	status uint32
+}
+
+func newTestChannel(input string) *testChannel {
+	return &testChannel{Reader: strings.NewReader(input)}
+}
+
+func (c *testChannel) Write(data []byte) (int, error) { return c.out.Write(data) }
+func (c *testChannel) Close() error                   { return nil }
+func (c *testChannel) CloseWrite() error              { return nil }
+func (c *testChannel) Stderr() io.ReadWriter          { return &c.out }
+
+func (c *testChannel) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	if name == "exit-status" {
+		var status struct{ Status uint32 }
+		if err := ssh.Unmarshal(payload, &status); err != nil {
+			return false, err
+		}
+		c.status = status.Status
+	}
+	return true, nil
+}
+
+// countingLLM is a MockLLM that counts the questions it is asked, or fails
+// them all when err is set.
+type countingLLM struct {
+	*MockLLM
+	asked int
+	err   error
+}
+
+func (c *countingLLM) Chat(ctx context.Context, messages []ChatMessage) (string, error) {
+	c.asked++
+	if c.err != nil {
+		return "", c.err
+	}
+	return c.MockLLM.Chat(ctx, messages)
+}
+
+func (c *countingLLM) ChatStream(ctx context.Context, messages []ChatMessage, onChunk func(chunk string) error) (string, error) {
+	c.asked++
+	if c.err != nil {
+		return "", c.err
+	}
+	return c.MockLLM.ChatStream(ctx, messages, onChunk)
+}
+
+func newTestLLMBackend(generator Generator) *LLMBackend {
+	vectors, _ := NewEmbeddedStore("")
+	return &LLMBackend{
+		Context:   NodeContext{CollectionName: "test", Store: &Store{Embedder: NewMockLLM(), Vectors: vectors}},
+		Generator: generator,
+		Persona:   DefaultPersona(),
+		Cache:     NewResponseCache(DefaultCacheTTL),
+	}
+}
+
+func TestLLMBackendCache(t *testing.T) {
+	llm := &countingLLM{MockLLM: NewMockLLM()}
+	backend := newTestLLMBackend(llm)
+	uptime := llm.Responses["uptime"]
+
+	steps := []struct {
+		input string
+		// asked is how many questions the LLM has answered after the input
+		asked int
+	}{
+		// commands the built-ins do not know fall back to the LLM
+		{"uptime\n", 1},
+		// a repeated command is answered from the cache
+		{"uptime\n", 1},
+		// and so is the same command in another session
+		{"uptime\nnproc\n", 2},
+		// once the session wrote a file the cache is neither read nor filled
+		{"echo hi > notes.txt\nuptime\nnproc\n", 4},
+		// the answers of that session were not stored for others
+		{"uptime\nnproc\n", 4},
+	}
+	for i, step := range steps {
+		channel := newTestChannel(step.input)
+		request := &SessionRequest{SessionID: "session", User: "admin"}
+		if err := backend.HandleInput(channel, request); err != nil {
+			t.Fatalf("session %d: %v", i, err)
+		}
+		if llm.asked != step.asked {
+			t.Errorf("session %d: the LLM was asked %d times, want %d", i, llm.asked, step.asked)
+		}
+		if want := strings.Count(step.input, "uptime"); strings.Count(channel.out.String(), uptime) != want {
+			t.Errorf("session %d: output %q, want the uptime answer %d times", i, channel.out.String(), want)
+		}
+	}
+}
+
+func TestLLMBackendFailure(t *testing.T) {
+	llm := &countingLLM{MockLLM: NewMockLLM(), err: errors.New("model server down")}
+	backend := newTestLLMBackend(llm)
+	channel := newTestChannel("uptime\n")
+	if err := backend.HandleInput(channel, &SessionRequest{SessionID: "session", User: "admin"}); err != nil {
+		t.Fatal(err)
+	}
+	if output := channel.out.String(); output != "-bash: uptime: command not found\n" || channel.status != 127 {
+		t.Errorf("got %q status %d, want command not found with status 127", output, channel.status)
+	}
+	// a failed answer is not cached
+	llm.err = nil
+	channel = newTestChannel("uptime\n")
+	if err := backend.HandleInput(channel, &SessionRequest{SessionID: "session", User: "admin"}); err != nil {
+		t.Fatal(err)
+	}
+	if llm.asked != 2 || !strings.Contains(channel.out.String(), llm.Responses["uptime"]) {
+		t.Errorf("after the failure the LLM was asked %d times and answered %q", llm.asked, channel.out.String())
+	}
+}
@@ -0,0 +1,94 @@
+package emulator
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Manifest records which chunks of a context directory are in the vector
+// store and which embedding model made their vectors, so a restart only
+// embeds what changed.
+type Manifest struct {
+	Collection string                   `json:"collection"`
+	Model      string                   `json:"model"`
+	Chunks     map[string]ManifestEntry `json:"chunks"`
+
+	path string
+}
+
+// ManifestEntry is an embedded chunk, keyed by its ID.
+type ManifestEntry struct {
+	Source string `json:"source"`
+	Index  int    `json:"index"`
+}
+
+// LoadManifest reads the manifest at path, a missing file is an empty
+// manifest.
+func LoadManifest(path string) (*Manifest, error) {
+	manifest := &Manifest{Chunks: make(map[string]ManifestEntry), path: path}
+	raw, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return manifest, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading manifest: %w", err)
+	}
+	if err := json.Unmarshal(raw, manifest); err != nil {
+		return nil, fmt.Errorf("parsing manifest %s: %w", path, err)
+	}
+	if manifest.Chunks == nil {
+		manifest.Chunks = make(map[string]ManifestEntry)
+	}
+	return manifest, nil
+}
+
+// Reset forgets every chunk, for when the collection is rebuilt.
+func (m *Manifest) Reset(collection string, model string) {
+	m.Collection = collection
+	m.Model = model
+	m.Chunks = make(map[string]ManifestEntry)
+}
+
+// Diff splits chunks into those not embedded yet and returns the IDs of
+// embedded chunks that are gone from the context.
+func (m *Manifest) Diff(chunks []Chunk) ([]Chunk, []string) {
+	current := make(map[string]bool, len(chunks))
+	var added []Chunk
+	for _, chunk := range chunks {
+		id := chunk.ID()
+		if current[id] {
+			continue
+		}
+		current[id] = true
+		if _, ok := m.Chunks[id]; !ok {
+			added = append(added, chunk)
+		}
+	}
+	var removed []string
+	for id := range m.Chunks {
+		if !current[id] {
+			removed = append(removed, id)
+		}
+	}
+	return added, removed
+}
+
+func (m *Manifest) Save() error {
+	if m.path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(m.path), 0o755); err != nil {
+		return fmt.Errorf("creating manifest directory: %w", err)
+	}
+	raw, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := m.path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0o644); err != nil {
+		return fmt.Errorf("saving manifest: %w", err)
+	}
+	return os.Rename(tmp, m.path)
+}
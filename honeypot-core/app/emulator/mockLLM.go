@@ -0,0 +1,129 @@
+package emulator
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+)
+
+// MockLLM is a deterministic in-process Generator and Embedder for running
+// the honeypot and its tests without a model server. Embeddings are derived
+// from a hash of the text and replies come from a table of canned outputs.
+type MockLLM struct {
+	Dimension int
+	// Responses maps a command line to its output.
+	Responses map[string]string
+}
+
+// defaultMockResponses answer the usual first commands of a scanner.
+var defaultMockResponses = map[string]string{
+	"uname -a": "Linux ics-host 5.15.0-91-generic #101-Ubuntu SMP Tue Nov 14 13:30:08 UTC 2023 x86_64 x86_64 x86_64 GNU/Linux",
+	"uname":    "Linux",
+	"id":       "uid=1000(admin) gid=1000(admin) groups=1000(admin),27(sudo),20(dialout)",
+	"hostname": "ics-host",
+	"uptime":   " 08:14:02 up 41 days,  3:07,  1 user,  load average: 0.08, 0.03, 0.01",
+	"nproc":    "4",
+}
+
+func NewMockLLM() *MockLLM {
+	responses := make(map[string]string, len(defaultMockResponses))
+	for command, output := range defaultMockResponses {
+		responses[command] = output
+	}
+	return &MockLLM{Dimension: 384, Responses: responses}
+}
+
+// LoadResponses adds canned outputs from a JSON object of command to output.
+func (m *MockLLM) LoadResponses(path string) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading mock responses: %w", err)
+	}
+	var responses map[string]string
+	if err := json.Unmarshal(raw, &responses); err != nil {
+		return fmt.Errorf("parsing mock responses %s: %w", path, err)
+	}
+	for command, output := range responses {
+		m.Responses[command] = output
+	}
+	return nil
+}
+
+// Chat answers the last user message, without its shell prompt.
+func (m *MockLLM) Chat(ctx context.Context, messages []ChatMessage) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	command := ""
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == "user" {
+			command = stripPrompt(messages[i].Content)
+			break
+		}
+	}
+	if output, ok := m.Responses[command]; ok {
+		return output, nil
+	}
+	return commandNotFound(command), nil
+}
+
+// ChatStream hands out the canned reply a few bytes at a time, like a model
+// server streaming tokens.
+func (m *MockLLM) ChatStream(ctx context.Context, messages []ChatMessage, onChunk func(chunk string) error) (string, error) {
+	reply, err := m.Chat(ctx, messages)
+	if err != nil {
+		return "", err
+	}
+	for rest := reply; rest != ""; {
+		n := min(len(rest), 6)
+		if err := onChunk(rest[:n]); err != nil {
+			return reply, err
+		}
+		rest = rest[n:]
+	}
+	return reply, nil
+}
+
+// stripPrompt removes a leading "user@host:dir$ " from a command.
+func stripPrompt(line string) string {
+	for _, sign := range []string{"$ ", "# "} {
+		if i := strings.Index(line, sign); i >= 0 && strings.Contains(line[:i], "@") {
+			return strings.TrimSpace(line[i+len(sign):])
+		}
+	}
+	return strings.TrimSpace(line)
+}
+
+// Embed returns a unit vector seeded from the SHA-256 of the text, the same
+// text always gets the same vector.
+func (m *MockLLM) Embed(ctx context.Context, text string) ([]float32, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	vector := make([]float32, m.Dimension)
+	seed := sha256.Sum256([]byte(text))
+	var norm float64
+	for i := range vector {
+		if i%8 == 0 {
+			seed = sha256.Sum256(seed[:])
+		}
+		bits := binary.BigEndian.Uint32(seed[(i%8)*4:])
+		value := float64(bits)/math.MaxUint32*2 - 1
+		vector[i] = float32(value)
+		norm += value * value
+	}
+	norm = math.Sqrt(norm)
+	for i := range vector {
+		vector[i] = float32(float64(vector[i]) / norm)
+	}
+	return vector, nil
+}
+
+func (m *MockLLM) Model() string {
+	return fmt.Sprintf("mock-%d", m.Dimension)
+}
@@ -0,0 +1,142 @@
+package emulator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// OllamaClient talks to an Ollama server's /api/chat and /api/embeddings.
+type OllamaClient struct {
+	URL        string
+	ChatModel  string
+	EmbedModel string
+	HTTP       *http.Client
+}
+
+func NewOllamaClient(url string, chatModel string, embedModel string) *OllamaClient {
+	return &OllamaClient{
+		URL:        strings.TrimRight(url, "/"),
+		ChatModel:  chatModel,
+		EmbedModel: embedModel,
+		HTTP:       &http.Client{Timeout: 2 * time.Minute},
+	}
+}
+
+func (c *OllamaClient) Chat(ctx context.Context, messages []ChatMessage) (string, error) {
+	var result struct {
+		Message ChatMessage `json:"message"`
+	}
+	err := c.post(ctx, "/api/chat", map[string]interface{}{
+		"model":    c.ChatModel,
+		"messages": messages,
+		"stream":   false,
+	}, &result)
+	if err != nil {
+		return "", err
+	}
+	return result.Message.Content, nil
+}
+
+// ChatStream reads the newline delimited JSON objects of a streaming
+// /api/chat response.
+func (c *OllamaClient) ChatStream(ctx context.Context, messages []ChatMessage, onChunk func(chunk string) error) (string, error) {
+	resp, err := postJSON(ctx, c.HTTP, c.URL+"/api/chat", "", map[string]interface{}{
+		"model":    c.ChatModel,
+		"messages": messages,
+		"stream":   true,
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var reply strings.Builder
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var part struct {
+			Message ChatMessage `json:"message"`
+			Done    bool        `json:"done"`
+			Error   string      `json:"error"`
+		}
+		if err := decoder.Decode(&part); err != nil {
+			if err == io.EOF {
+				return reply.String(), nil
+			}
+			return reply.String(), fmt.Errorf("failed to decode /api/chat stream: %w", err)
+		}
+		if part.Error != "" {
+			return reply.String(), fmt.Errorf("ollama: %s", part.Error)
+		}
+		if part.Message.Content != "" {
+			reply.WriteString(part.Message.Content)
+			if err := onChunk(part.Message.Content); err != nil {
+				return reply.String(), err
+			}
+		}
+		if part.Done {
+			return reply.String(), nil
+		}
+	}
+}
+
+func (c *OllamaClient) Embed(ctx context.Context, text string) ([]float32, error) {
+	var result struct {
+		Embedding []float32 `json:"embedding"`
+	}
+	err := c.post(ctx, "/api/embeddings", map[string]interface{}{
+		"model":  c.EmbedModel,
+		"prompt": text,
+	}, &result)
+	if err != nil {
+		return nil, err
+	}
+	return result.Embedding, nil
+}
+
+func (c *OllamaClient) post(ctx context.Context, path string, body interface{}, result interface{}) error {
+	resp, err := postJSON(ctx, c.HTTP, c.URL+path, "", body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("failed to decode %s response: %w", path, err)
+	}
+	return nil
+}
+
+// postJSON posts body as JSON and returns the response when its status is
+// 200, the body of any other status is returned in the error.
+func postJSON(ctx context.Context, client *http.Client, url string, token string, body interface{}) (*http.Response, error) {
+	reqBytes, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(reqBytes))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request to %s failed: %w", url, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("request to %s failed with: %v - %v", url, resp.StatusCode, string(bodyBytes))
+	}
+	return resp, nil
+}
+
+func (c *OllamaClient) Model() string {
+	return c.EmbedModel
+}
@@ -0,0 +1,133 @@
+package emulator
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// OpenAIClient talks to any server with OpenAI's /chat/completions and
+// /embeddings endpoints, such as llama.cpp's server or vLLM.
+type OpenAIClient struct {
+	// BaseURL includes the version prefix, e.g. http://vllm:8000/v1
+	BaseURL    string
+	APIKey     string
+	ChatModel  string
+	EmbedModel string
+	HTTP       *http.Client
+}
+
+func NewOpenAIClient(baseURL string, apiKey string, chatModel string, embedModel string) *OpenAIClient {
+	return &OpenAIClient{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		APIKey:     apiKey,
+		ChatModel:  chatModel,
+		EmbedModel: embedModel,
+		HTTP:       &http.Client{Timeout: 2 * time.Minute},
+	}
+}
+
+func (c *OpenAIClient) Chat(ctx context.Context, messages []ChatMessage) (string, error) {
+	var result struct {
+		Choices []struct {
+			Message ChatMessage `json:"message"`
+		} `json:"choices"`
+	}
+	err := c.post(ctx, "/chat/completions", map[string]interface{}{
+		"model":    c.ChatModel,
+		"messages": messages,
+	}, &result)
+	if err != nil {
+		return "", err
+	}
+	if len(result.Choices) == 0 {
+		return "", fmt.Errorf("chat completion returned no choices")
+	}
+	return result.Choices[0].Message.Content, nil
+}
+
+// ChatStream reads the server-sent events of a streaming chat completion,
+// every "data:" line holds a delta and "data: [DONE]" ends the stream.
+func (c *OpenAIClient) ChatStream(ctx context.Context, messages []ChatMessage, onChunk func(chunk string) error) (string, error) {
+	resp, err := postJSON(ctx, c.HTTP, c.BaseURL+"/chat/completions", c.APIKey, map[string]interface{}{
+		"model":    c.ChatModel,
+		"messages": messages,
+		"stream":   true,
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var reply strings.Builder
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue
+		}
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			break
+		}
+		var event struct {
+			Choices []struct {
+				Delta ChatMessage `json:"delta"`
+			} `json:"choices"`
+		}
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			return reply.String(), fmt.Errorf("failed to decode chat completion chunk: %w", err)
+		}
+		if len(event.Choices) == 0 || event.Choices[0].Delta.Content == "" {
+			continue
+		}
+		chunk := event.Choices[0].Delta.Content
+		reply.WriteString(chunk)
+		if err := onChunk(chunk); err != nil {
+			return reply.String(), err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return reply.String(), fmt.Errorf("reading chat completion stream: %w", err)
+	}
+	return reply.String(), nil
+}
+
+func (c *OpenAIClient) Embed(ctx context.Context, text string) ([]float32, error) {
+	var result struct {
+		Data []struct {
+			Embedding []float32 `json:"embedding"`
+		} `json:"data"`
+	}
+	err := c.post(ctx, "/embeddings", map[string]interface{}{
+		"model": c.EmbedModel,
+		"input": text,
+	}, &result)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Data) == 0 {
+		return nil, fmt.Errorf("embeddings returned no data")
+	}
+	return result.Data[0].Embedding, nil
+}
+
+func (c *OpenAIClient) post(ctx context.Context, path string, body interface{}, result interface{}) error {
+	resp, err := postJSON(ctx, c.HTTP, c.BaseURL+path, c.APIKey, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("failed to decode %s response: %w", path, err)
+	}
+	return nil
+}
+
+func (c *OpenAIClient) Model() string {
+	return c.EmbedModel
+}
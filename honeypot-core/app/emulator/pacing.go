@@ -0,0 +1,97 @@
+package emulator
+
+import (
+	"bytes"
+	"io"
+	"time"
+)
+
+// Output pacing defaults, tuned to look like ls or cat over a slow link
+// rather than a model typing token by token.
+const (
+	DefaultBurstLines = 16
+	DefaultBurstDelay = 12 * time.Millisecond
+)
+
+// Pacer writes streamed generator output in whole lines. Lines go out in
+// bursts of BurstLines with BurstDelay between bursts, a partial line is held
+// back until its newline arrives. The very first chunk is written at once,
+// even without a newline, so the terminal never sits silent waiting for a
+// full line.
+type Pacer struct {
+	W          io.Writer
+	BurstLines int
+	BurstDelay time.Duration
+
+	pending []byte
+	burst   int
+	written int
+	last    byte
+}
+
+func NewPacer(w io.Writer) *Pacer {
+	return &Pacer{W: w, BurstLines: DefaultBurstLines, BurstDelay: DefaultBurstDelay}
+}
+
+// Write queues a chunk and sends the lines it completes.
+func (p *Pacer) Write(chunk []byte) (int, error) {
+	p.pending = append(p.pending, chunk...)
+	if p.written == 0 && len(p.pending) > 0 {
+		if err := p.send(p.pending); err != nil {
+			return 0, err
+		}
+		p.pending = p.pending[:0]
+		return len(chunk), nil
+	}
+	for {
+		i := bytes.IndexByte(p.pending, '\n')
+		if i < 0 {
+			return len(chunk), nil
+		}
+		if p.burst >= p.BurstLines && p.BurstLines > 0 {
+			time.Sleep(p.BurstDelay)
+			p.burst = 0
+		}
+		if err := p.send(p.pending[:i+1]); err != nil {
+			return 0, err
+		}
+		p.pending = p.pending[i+1:]
+		p.burst++
+	}
+}
+
+// Chunk is Write for a string chunk, it makes the Pacer usable as the
+// onChunk callback of a StreamGenerator.
+func (p *Pacer) Chunk(chunk string) error {
+	_, err := p.Write([]byte(chunk))
+	return err
+}
+
+// Close sends what is left and ends the output with a newline, like every
+// command's output does before the next prompt.
+func (p *Pacer) Close() error {
+	if len(p.pending) > 0 {
+		if err := p.send(p.pending); err != nil {
+			return err
+		}
+		p.pending = nil
+	}
+	if p.written > 0 && p.last != '\n' {
+		return p.send([]byte("\n"))
+	}
+	return nil
+}
+
+// Written is the number of bytes sent to W so far.
+func (p *Pacer) Written() int {
+	return p.written
+}
+
+func (p *Pacer) send(data []byte) error {
+	n, err := p.W.Write(data)
+	p.written += n
+	if n > 0 {
+		p.last = data[n-1]
+	}
+	return err
+}
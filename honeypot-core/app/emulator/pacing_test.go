@@ -0,0 +1,91 @@
+package emulator
+
+import (
+	"testing"
+	"time"
+)
+
+// writeLog keeps every Write a Pacer makes.
+type writeLog []string
+
+func (w *writeLog) Write(data []byte) (int, error) {
+	*w = append(*w, string(data))
+	return len(data), nil
+}
+
+func TestPacer(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+		writes []string
+	}{
+		{
+			name:   "the first chunk goes out at once",
+			chunks: []string{"tot"},
+			writes: []string{"tot", "\n"},
+		},
+		{
+			name:   "partial lines wait for their newline",
+			chunks: []string{"total 8\n", "drwx", "r-x a\n-rw-", "r-- b\n"},
+			writes: []string{"total 8\n", "drwxr-x a\n", "-rw-r-- b\n"},
+		},
+		{
+			name:   "a chunk of several lines is sent line by line",
+			chunks: []string{"a", "\nb\nc\nd"},
+			writes: []string{"a", "\n", "b\n", "c\n", "d", "\n"},
+		},
+		{
+			name:   "close adds no newline after one",
+			chunks: []string{"root\n"},
+			writes: []string{"root\n"},
+		},
+		{
+			name:   "no output stays empty",
+			chunks: []string{""},
+			writes: nil,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var writes writeLog
+			pacer := NewPacer(&writes)
+			for _, chunk := range test.chunks {
+				if err := pacer.Chunk(chunk); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := pacer.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if len(writes) != len(test.writes) {
+				t.Fatalf("wrote %q, want %q", writes, test.writes)
+			}
+			for i := range writes {
+				if writes[i] != test.writes[i] {
+					t.Fatalf("wrote %q, want %q", writes, test.writes)
+				}
+			}
+		})
+	}
+}
+
+func TestPacerBursts(t *testing.T) {
+	var writes writeLog
+	pacer := NewPacer(&writes)
+	pacer.BurstLines = 2
+	pacer.BurstDelay = 20 * time.Millisecond
+	start := time.Now()
+	// the first line goes out on its own, the other five in bursts of two
+	if err := pacer.Chunk("1\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := pacer.Chunk("2\n3\n4\n5\n6\n"); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 2*pacer.BurstDelay {
+		t.Errorf("six lines took %v, want two pauses of %v", elapsed, pacer.BurstDelay)
+	}
+	if len(writes) != 6 {
+		t.Errorf("wrote %q, want one write per line", writes)
+	}
+}
@@ -0,0 +1,466 @@
+package emulator
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Persona is the machine the attacker is supposed to be on. The SSH version
+// string, the emulated shell and the LLM prompt all come from it so every
+// surface gives the same answer.
+type Persona struct {
+	Name     string `json:"name"`
+	Hostname string `json:"hostname"`
+	// Role is what the host is there for, as the LLM is told, such as "an
+	// engineering workstation".
+	Role string    `json:"role"`
+	OS   OSRelease `json:"os"`
+	// Kernel is the release, as in uname -r.
+	Kernel string `json:"kernel"`
+	// KernelVersion is the build, as in uname -v.
+	KernelVersion string `json:"kernelVersion"`
+	Arch          string `json:"arch"`
+	// SSHVersion is sent in the SSH handshake, it must start with SSH-2.0-.
+	SSHVersion string         `json:"sshVersion"`
+	Users      []PersonaUser  `json:"users"`
+	Software   []string       `json:"software"`
+	Interfaces []NetInterface `json:"interfaces"`
+	Gateway    string         `json:"gateway"`
+	MOTD       string         `json:"motd"`
+}
+
+// OSRelease holds the fields of /etc/os-release.
+type OSRelease struct {
+	ID              string `json:"id"`
+	Name            string `json:"name"`
+	Version         string `json:"version"`
+	VersionID       string `json:"versionId"`
+	VersionCodename string `json:"versionCodename"`
+	PrettyName      string `json:"prettyName"`
+}
+
+type PersonaUser struct {
+	Name   string   `json:"name"`
+	UID    int      `json:"uid"`
+	Groups []string `json:"groups"`
+	Home   string   `json:"home"`
+	Shell  string   `json:"shell"`
+	Gecos  string   `json:"gecos"`
+}
+
+// NetInterface is a network interface, Address is in CIDR notation.
+type NetInterface struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	MAC     string `json:"mac"`
+}
+
+// wellKnownGroups are the Debian system group IDs.
+var wellKnownGroups = map[string]int{
+	"root": 0, "adm": 4, "dialout": 20, "cdrom": 24, "sudo": 27, "dip": 30,
+	"plugdev": 46, "users": 100, "lxd": 116, "docker": 998,
+}
+
+// DefaultPersona is the Ubuntu engineering workstation the honeypot has
+// always pretended to be.
+func DefaultPersona() *Persona {
+	return &Persona{
+		Name:     "ics-host",
+		Hostname: "ics-host",
+		Role:     "an industrial control system engineering workstation",
+		OS: OSRelease{
+			ID:              "ubuntu",
+			Name:            "Ubuntu",
+			Version:         "20.04.6 LTS (Focal Fossa)",
+			VersionID:       "20.04",
+			VersionCodename: "focal",
+			PrettyName:      "Ubuntu 20.04.6 LTS",
+		},
+		Kernel:        "5.15.0-91-generic",
+		KernelVersion: "#101~20.04.1-Ubuntu SMP Thu Nov 16 14:22:28 UTC 2023",
+		Arch:          "x86_64",
+		SSHVersion:    "SSH-2.0-OpenSSH_8.2p1 Ubuntu-4ubuntu0.9",
+		Users: []PersonaUser{
+			{Name: "admin", UID: 1000, Groups: []string{"admin", "adm", "dialout", "sudo", "plugdev"}, Gecos: "ICS Admin,,,"},
+		},
+		Software: []string{"CODESYS Control for Linux SL 4.5.0.0", "mbpoll 1.4", "python3-pymodbus 2.1.0"},
+		Interfaces: []NetInterface{
+			{Name: "eth0", Address: "172.28.1.20/24", MAC: "02:42:ac:1c:01:14"},
+		},
+		Gateway: "172.28.1.1",
+		MOTD: `Welcome to Ubuntu 20.04.6 LTS (GNU/Linux 5.15.0-91-generic x86_64)
+
+ * Documentation:  https://help.ubuntu.com
+ * Management:     https://landscape.canonical.com
+ * Support:        https://ubuntu.com/advantage
+
+Authorized personnel only. Activity on this system is monitored.
+`,
+	}
+}
+
+// LoadPersona reads a persona by name from dir, or from a file when name is
+// a path to a .json file. Fields the file leaves out keep the default
+// persona's values.
+func LoadPersona(dir string, name string) (*Persona, error) {
+	if name == "" {
+		return DefaultPersona(), nil
+	}
+	path := name
+	if !strings.HasSuffix(name, ".json") {
+		path = filepath.Join(dir, name+".json")
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading persona: %w", err)
+	}
+	// unset fields keep the defaults, but the lists are replaced whole, a
+	// user missing from the file must not inherit the default admin's
+	// groups and gecos
+	persona := DefaultPersona()
+	persona.Name = ""
+	persona.Role = ""
+	persona.Users = nil
+	persona.Interfaces = nil
+	persona.Software = nil
+	if err := json.Unmarshal(raw, persona); err != nil {
+		return nil, fmt.Errorf("parsing persona %s: %w", path, err)
+	}
+	if persona.Name == "" {
+		persona.Name = strings.TrimSuffix(filepath.Base(path), ".json")
+	}
+	if !strings.HasPrefix(persona.SSHVersion, "SSH-2.0-") {
+		return nil, fmt.Errorf("persona %s: sshVersion must start with SSH-2.0-", persona.Name)
+	}
+	return persona, nil
+}
+
+// Fingerprint changes whenever anything about the persona changes.
+func (p *Persona) Fingerprint() string {
+	raw, _ := json.Marshal(p)
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Describe tells the LLM which host it is.
+func (p *Persona) Describe() string {
+	var out strings.Builder
+	fmt.Fprintf(&out, "The host is %s running %s, Linux kernel %s %s on %s.\n",
+		p.Hostname, p.OS.PrettyName, p.Kernel, p.KernelVersion, p.Arch)
+	if len(p.Users) > 0 {
+		users := make([]string, 0, len(p.Users))
+		for _, user := range p.Users {
+			users = append(users, fmt.Sprintf("%s (uid %d, groups %s)", user.Name, user.UID, strings.Join(user.Groups, ",")))
+		}
+		fmt.Fprintf(&out, "Login users: %s.\n", strings.Join(users, "; "))
+	}
+	if len(p.Software) > 0 {
+		fmt.Fprintf(&out, "Installed ICS software: %s.\n", strings.Join(p.Software, "; "))
+	}
+	if len(p.Interfaces) > 0 {
+		interfaces := make([]string, 0, len(p.Interfaces))
+		for _, iface := range p.Interfaces {
+			interfaces = append(interfaces, fmt.Sprintf("%s %s (%s)", iface.Name, iface.Address, iface.MAC))
+		}
+		fmt.Fprintf(&out, "Network interfaces: lo 127.0.0.1/8, %s", strings.Join(interfaces, ", "))
+		if p.Gateway != "" {
+			fmt.Fprintf(&out, ", default gateway %s", p.Gateway)
+		}
+		out.WriteString(".\n")
+	}
+	return strings.TrimSpace(out.String())
+}
+
+// user returns the persona's account of name. Logins the persona does not
+// list, which the auth policy may still accept, get an account made up on
+// the spot.
+func (p *Persona) user(name string) PersonaUser {
+	if name == "root" {
+		return PersonaUser{Name: "root", UID: 0, Groups: []string{"root"}, Home: "/root", Shell: "/bin/bash", Gecos: "root"}
+	}
+	for i, user := range p.Users {
+		if user.Name == name {
+			if user.Home == "" {
+				user.Home = "/home/" + name
+			}
+			if user.Shell == "" {
+				user.Shell = "/bin/bash"
+			}
+			if len(user.Groups) == 0 {
+				user.Groups = []string{name}
+			}
+			if user.UID == 0 {
+				user.UID = 1000 + i
+			}
+			return user
+		}
+	}
+	return PersonaUser{Name: name, UID: 1000 + len(p.Users), Groups: []string{name}, Home: "/home/" + name, Shell: "/bin/bash"}
+}
+
+func (p *Persona) hasUser(name string) bool {
+	if name == "root" {
+		return true
+	}
+	for _, user := range p.Users {
+		if user.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// gid is a group's ID, a user's own group has the user's ID.
+func (p *Persona) gid(group string) int {
+	if id, ok := wellKnownGroups[group]; ok {
+		return id
+	}
+	for _, user := range p.Users {
+		if user.Name == group {
+			return p.user(user.Name).UID
+		}
+	}
+	return 1000 + len(p.Users)
+}
+
+// Seed writes the persona's identity files into a session's filesystem.
+// The login user is added to /etc/passwd if the persona lacks them.
+func (p *Persona) Seed(sfs *SessionFS, login string) {
+	users := append([]PersonaUser(nil), p.Users...)
+	if !p.hasUser(login) {
+		users = append(users, p.user(login))
+	}
+	var passwd, group strings.Builder
+	passwd.WriteString(`root:x:0:0:root:/root:/bin/bash
+daemon:x:1:1:daemon:/usr/sbin:/usr/sbin/nologin
+bin:x:2:2:bin:/bin:/usr/sbin/nologin
+sys:x:3:3:sys:/dev:/usr/sbin/nologin
+sync:x:4:65534:sync:/bin:/bin/sync
+www-data:x:33:33:www-data:/var/www:/usr/sbin/nologin
+nobody:x:65534:65534:nobody:/nonexistent:/usr/sbin/nologin
+systemd-network:x:100:102:systemd Network Management,,,:/run/systemd:/usr/sbin/nologin
+sshd:x:111:65534::/run/sshd:/usr/sbin/nologin
+`)
+	members := make(map[string][]string)
+	for _, account := range users {
+		user := p.user(account.Name)
+		fmt.Fprintf(&passwd, "%s:x:%d:%d:%s:%s:%s\n", user.Name, user.UID, user.UID, user.Gecos, user.Home, user.Shell)
+		for _, name := range user.Groups[1:] {
+			members[name] = append(members[name], user.Name)
+		}
+		sfs.Mkdir(user.Home, true, user.Name)
+	}
+	names := make([]string, 0, len(wellKnownGroups))
+	for name := range wellKnownGroups {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return wellKnownGroups[names[i]] < wellKnownGroups[names[j]] })
+	for _, name := range names {
+		fmt.Fprintf(&group, "%s:x:%d:%s\n", name, wellKnownGroups[name], strings.Join(members[name], ","))
+	}
+	for _, account := range users {
+		user := p.user(account.Name)
+		fmt.Fprintf(&group, "%s:x:%d:\n", user.Name, user.UID)
+	}
+
+	files := map[string]string{
+		"/etc/hostname": p.Hostname + "\n",
+		"/etc/os-release": fmt.Sprintf("NAME=%q\nVERSION=%q\nID=%s\nPRETTY_NAME=%q\nVERSION_ID=%q\nVERSION_CODENAME=%s\n",
+			p.OS.Name, p.OS.Version, p.OS.ID, p.OS.PrettyName, p.OS.VersionID, p.OS.VersionCodename),
+		"/etc/issue":    p.OS.PrettyName + " \\n \\l\n\n",
+		"/etc/motd":     p.MOTD,
+		"/etc/passwd":   passwd.String(),
+		"/etc/group":    group.String(),
+		"/proc/version": p.procVersion(),
+	}
+	for name, content := range files {
+		sfs.Mkdir(filepath.Dir(name), true, "root")
+		sfs.set(name, &VFile{
+			Mode:    0o644,
+			Size:    int64(len(content)),
+			ModTime: snapshotEpoch,
+			Owner:   "root",
+			Group:   "root",
+			Content: []byte(content),
+		})
+	}
+}
+
+func (p *Persona) procVersion() string {
+	builder := "(buildd@lcy02-amd64-033) (gcc (Ubuntu 9.4.0-1ubuntu1~20.04.2) 9.4.0, GNU ld (GNU Binutils for Ubuntu) 2.34)"
+	if p.OS.ID == "debian" {
+		builder = "(debian-kernel@lists.debian.org) (gcc version 8.3.0 (Debian 8.3.0-6))"
+	}
+	return fmt.Sprintf("Linux version %s %s %s\n", p.Kernel, builder, p.KernelVersion)
+}
+
+// Install answers the commands that reveal the host's identity from the
+// persona instead of the LLM.
+func (p *Persona) Install(shell *Shell) {
+	if shell.Commands == nil {
+		shell.Commands = make(map[string]func(args []string) (string, uint32))
+	}
+	shell.Commands["hostname"] = func(args []string) (string, uint32) {
+		return p.Hostname + "\n", 0
+	}
+	shell.Commands["uname"] = p.uname
+	shell.Commands["id"] = func(args []string) (string, uint32) {
+		return p.id(shell.User, args)
+	}
+	shell.Commands["ifconfig"] = func(args []string) (string, uint32) {
+		return p.ifconfig(), 0
+	}
+	shell.Commands["ip"] = p.ip
+}
+
+func (p *Persona) uname(args []string) (string, uint32) {
+	fields := map[byte]string{
+		's': "Linux", 'n': p.Hostname, 'r': p.Kernel, 'v': p.KernelVersion,
+		'm': p.Arch, 'p': p.Arch, 'i': p.Arch, 'o': "GNU/Linux",
+	}
+	long := map[string]byte{
+		"--kernel-name": 's', "--nodename": 'n', "--kernel-release": 'r', "--kernel-version": 'v',
+		"--machine": 'm', "--processor": 'p', "--hardware-platform": 'i', "--operating-system": 'o',
+	}
+	selected := make(map[byte]bool)
+	for _, arg := range args {
+		if flag, ok := long[arg]; ok {
+			selected[flag] = true
+			continue
+		}
+		if arg == "--all" {
+			arg = "-a"
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			return fmt.Sprintf("uname: extra operand '%s'\nTry 'uname --help' for more information.\n", arg), 1
+		}
+		for _, flag := range []byte(arg[1:]) {
+			if flag == 'a' {
+				for name := range fields {
+					selected[name] = true
+				}
+				continue
+			}
+			if _, ok := fields[flag]; !ok {
+				return fmt.Sprintf("uname: invalid option -- '%c'\nTry 'uname --help' for more information.\n", flag), 1
+			}
+			selected[flag] = true
+		}
+	}
+	if len(selected) == 0 {
+		selected['s'] = true
+	}
+	var out []string
+	for _, flag := range []byte("snrvmpio") {
+		if selected[flag] {
+			out = append(out, fields[flag])
+		}
+	}
+	return strings.Join(out, " ") + "\n", 0
+}
+
+func (p *Persona) id(login string, args []string) (string, uint32) {
+	name := login
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name = args[0]
+		if !p.hasUser(name) && name != login {
+			return fmt.Sprintf("id: ‘%s’: no such user\n", name), 1
+		}
+	}
+	user := p.user(name)
+	groups := make([]string, 0, len(user.Groups))
+	for _, group := range user.Groups {
+		groups = append(groups, fmt.Sprintf("%d(%s)", p.gid(group), group))
+	}
+	primary := user.Groups[0]
+	return fmt.Sprintf("uid=%d(%s) gid=%d(%s) groups=%s\n", user.UID, user.Name, p.gid(primary), primary, strings.Join(groups, ",")), 0
+}
+
+func (p *Persona) ifconfig() string {
+	var out strings.Builder
+	for _, iface := range p.Interfaces {
+		ip, network, err := net.ParseCIDR(iface.Address)
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(&out, "%s: flags=4163<UP,BROADCAST,RUNNING,MULTICAST>  mtu 1500\n", iface.Name)
+		fmt.Fprintf(&out, "        inet %s  netmask %s  broadcast %s\n", ip, net.IP(network.Mask), broadcast(network))
+		fmt.Fprintf(&out, "        ether %s  txqueuelen 1000  (Ethernet)\n", iface.MAC)
+		out.WriteString("        RX packets 184223  bytes 41873412 (41.8 MB)\n        RX errors 0  dropped 0  overruns 0  frame 0\n")
+		out.WriteString("        TX packets 120931  bytes 15328841 (15.3 MB)\n        TX errors 0  dropped 0 overruns 0  carrier 0  collisions 0\n\n")
+	}
+	out.WriteString("lo: flags=73<UP,LOOPBACK,RUNNING>  mtu 65536\n        inet 127.0.0.1  netmask 255.0.0.0\n        loop  txqueuelen 1000  (Local Loopback)\n")
+	out.WriteString("        RX packets 5512  bytes 498020 (498.0 KB)\n        RX errors 0  dropped 0  overruns 0  frame 0\n")
+	out.WriteString("        TX packets 5512  bytes 498020 (498.0 KB)\n        TX errors 0  dropped 0 overruns 0  carrier 0  collisions 0\n\n")
+	return out.String()
+}
+
+func (p *Persona) ip(args []string) (string, uint32) {
+	object := ""
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "-") {
+			object = arg
+			break
+		}
+	}
+	switch {
+	case object == "":
+		return "Usage: ip [ OPTIONS ] OBJECT { COMMAND | help }\n       ip [ -force ] -batch filename\nwhere  OBJECT := { link | address | addrlabel | route | rule | neigh | ntable |\n                   tunnel | tuntap | maddress | mroute | mrule | monitor | xfrm |\n                   netns | l2tp | fou | macsec | tcp_metrics | token | netconf | ila |\n                   vrf | sr | nexthop }\n", 255
+	case strings.HasPrefix("address", object):
+		return p.ipAddr(), 0
+	case strings.HasPrefix("route", object):
+		return p.ipRoute(), 0
+	}
+	return fmt.Sprintf("Object \"%s\" is unknown, try \"ip help\".\n", object), 1
+}
+
+func (p *Persona) ipAddr() string {
+	var out strings.Builder
+	out.WriteString("1: lo: <LOOPBACK,UP,LOWER_UP> mtu 65536 qdisc noqueue state UNKNOWN group default qlen 1000\n")
+	out.WriteString("    link/loopback 00:00:00:00:00:00 brd 00:00:00:00:00:00\n")
+	out.WriteString("    inet 127.0.0.1/8 scope host lo\n       valid_lft forever preferred_lft forever\n")
+	for i, iface := range p.Interfaces {
+		_, network, err := net.ParseCIDR(iface.Address)
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(&out, "%d: %s: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500 qdisc fq_codel state UP group default qlen 1000\n", i+2, iface.Name)
+		fmt.Fprintf(&out, "    link/ether %s brd ff:ff:ff:ff:ff:ff\n", iface.MAC)
+		fmt.Fprintf(&out, "    inet %s brd %s scope global %s\n       valid_lft forever preferred_lft forever\n", iface.Address, broadcast(network), iface.Name)
+	}
+	return out.String()
+}
+
+func (p *Persona) ipRoute() string {
+	var out strings.Builder
+	if p.Gateway != "" && len(p.Interfaces) > 0 {
+		fmt.Fprintf(&out, "default via %s dev %s proto static\n", p.Gateway, p.Interfaces[0].Name)
+	}
+	for _, iface := range p.Interfaces {
+		ip, network, err := net.ParseCIDR(iface.Address)
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(&out, "%s dev %s proto kernel scope link src %s\n", network, iface.Name, ip)
+	}
+	return out.String()
+}
+
+func broadcast(network *net.IPNet) net.IP {
+	ip := network.IP.To4()
+	if ip == nil {
+		return network.IP
+	}
+	result := make(net.IP, len(ip))
+	for i := range ip {
+		result[i] = ip[i] | ^network.Mask[i]
+	}
+	return result
+}
@@ -0,0 +1,77 @@
+package emulator
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadPersonaReplacesLists(t *testing.T) {
+	dir := t.TempDir()
+	raw := `{
+  "hostname": "rtu-07",
+  "sshVersion": "SSH-2.0-dropbear_2019.78",
+  "users": [{"name": "rtu", "uid": 1000}],
+  "interfaces": [{"name": "eth0", "address": "10.0.0.7/24"}]
+}`
+	if err := os.WriteFile(filepath.Join(dir, "rtu.json"), []byte(raw), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	persona, err := LoadPersona(dir, "rtu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(persona.Users) != 1 || len(persona.Users[0].Groups) != 0 || persona.Users[0].Gecos != "" {
+		t.Errorf("users inherited from the default persona: %+v", persona.Users)
+	}
+	if len(persona.Interfaces) != 1 || persona.Interfaces[0].MAC != "" {
+		t.Errorf("interfaces inherited from the default persona: %+v", persona.Interfaces)
+	}
+	if len(persona.Software) != 0 {
+		t.Errorf("software inherited from the default persona: %v", persona.Software)
+	}
+	if persona.Name != "rtu" || persona.OS.ID != DefaultPersona().OS.ID {
+		t.Errorf("unset fields should keep their defaults, got name %q os %q", persona.Name, persona.OS.ID)
+	}
+}
+
+func TestSystemPromptFollowsThePersona(t *testing.T) {
+	rtu := &Persona{Hostname: "rtu-07", OS: OSRelease{PrettyName: "Buildroot 2020.02"}}
+	tests := []struct {
+		name string
+		// load names the persona in config/personas, "" is the default
+		load    string
+		persona *Persona
+		want    []string
+		absent  []string
+	}{
+		{"default", "", nil, []string{"ics-host", "engineering workstation", "Ubuntu 20.04.6 LTS"}, nil},
+		{"hmi panel", "hmi-panel", nil, []string{"hmi-pump-station", "HMI panel", "Debian GNU/Linux 10 (buster)"}, []string{"workstation", "Ubuntu"}},
+		{"no role", "", rtu, []string{"rtu-07", "Buildroot"}, []string{"workstation"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			persona := test.persona
+			if persona == nil {
+				var err error
+				if persona, err = LoadPersona("../config/personas", test.load); err != nil {
+					t.Fatal(err)
+				}
+			}
+			session := NewChatSession("session", "test", nil, nil)
+			session.Persona = persona
+			system := session.buildMessages("", "ls")[0].Content
+			for _, want := range test.want {
+				if !strings.Contains(system, want) {
+					t.Errorf("system prompt lacks %q:\n%s", want, system)
+				}
+			}
+			for _, absent := range test.absent {
+				if strings.Contains(system, absent) {
+					t.Errorf("system prompt mentions %q:\n%s", absent, system)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,204 @@
+package emulator
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/qdrant/go-client/qdrant"
+)
+
+// QdrantStore keeps the collections in a Qdrant server. Document IDs must be
+// UUIDs.
+type QdrantStore struct {
+	Client *qdrant.Client
+}
+
+// NewQdrantStore connects to Qdrant's gRPC port and checks it is healthy.
+func NewQdrantStore(host string, port int) (*QdrantStore, error) {
+	client, err := qdrant.NewClient(&qdrant.Config{
+		Host: host,
+		Port: port,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("connecting to qdrant at %s:%d: %w", host, port, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	healthCheckResult, err := client.HealthCheck(ctx)
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("qdrant health check at %s:%d: %w", host, port, err)
+	}
+	log.Printf("Health check result: %v", healthCheckResult)
+	return &QdrantStore{Client: client}, nil
+}
+
+func (q *QdrantStore) EnsureCollection(ctx context.Context, collection string, schema CollectionSchema) error {
+	exists, err := q.Client.CollectionExists(ctx, collection)
+	if err != nil {
+		return fmt.Errorf("checking collection %s: %w", collection, err)
+	}
+	if exists {
+		info, err := q.Client.GetCollectionInfo(ctx, collection)
+		if err != nil {
+			return fmt.Errorf("reading collection %s: %w", collection, err)
+		}
+		params := info.GetConfig().GetParams().GetVectorsConfig().GetParams()
+		if params == nil {
+			return fmt.Errorf("collection %s does not have a single unnamed vector", collection)
+		}
+		existing := CollectionSchema{Dimension: int(params.GetSize()), Distance: distanceFromQdrant(params.GetDistance())}
+		if existing != schema {
+			return fmt.Errorf("collection %s holds %s vectors, the embedder makes %s vectors", collection, existing, schema)
+		}
+		return nil
+	}
+	defaultSeg := uint64(2)
+	err = q.Client.CreateCollection(ctx, &qdrant.CreateCollection{
+		CollectionName: collection,
+		VectorsConfig: qdrant.NewVectorsConfig(&qdrant.VectorParams{
+			Size:     uint64(schema.Dimension),
+			Distance: distanceToQdrant(schema.Distance),
+		}),
+		OptimizersConfig: &qdrant.OptimizersConfigDiff{
+			DefaultSegmentNumber: &defaultSeg,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("creating collection %s: %w", collection, err)
+	}
+	return nil
+}
+
+func (q *QdrantStore) Upsert(ctx context.Context, collection string, docs []Document) error {
+	points := make([]*qdrant.PointStruct, 0, len(docs))
+	for _, doc := range docs {
+		payload, err := qdrant.TryValueMap(doc.Payload)
+		if err != nil {
+			return fmt.Errorf("payload of %s: %w", doc.ID, err)
+		}
+		points = append(points, &qdrant.PointStruct{
+			Id:      qdrant.NewIDUUID(doc.ID),
+			Vectors: qdrant.NewVectors(doc.Vector...),
+			Payload: payload,
+		})
+	}
+	_, err := q.Client.Upsert(ctx, &qdrant.UpsertPoints{
+		CollectionName: collection,
+		Points:         points,
+	})
+	return err
+}
+
+func (q *QdrantStore) Delete(ctx context.Context, collection string, ids []string) error {
+	pointIDs := make([]*qdrant.PointId, 0, len(ids))
+	for _, id := range ids {
+		pointIDs = append(pointIDs, qdrant.NewIDUUID(id))
+	}
+	_, err := q.Client.Delete(ctx, &qdrant.DeletePoints{
+		CollectionName: collection,
+		Points:         qdrant.NewPointsSelectorIDs(pointIDs),
+	})
+	return err
+}
+
+func (q *QdrantStore) DropCollection(ctx context.Context, collection string) error {
+	exists, err := q.Client.CollectionExists(ctx, collection)
+	if err != nil || !exists {
+		return err
+	}
+	return q.Client.DeleteCollection(ctx, collection)
+}
+
+func (q *QdrantStore) Count(ctx context.Context, collection string) (int, error) {
+	exists, err := q.Client.CollectionExists(ctx, collection)
+	if err != nil || !exists {
+		return 0, err
+	}
+	count, err := q.Client.Count(ctx, &qdrant.CountPoints{
+		CollectionName: collection,
+		Exact:          qdrant.PtrOf(true),
+	})
+	return int(count), err
+}
+
+func (q *QdrantStore) Search(ctx context.Context, collection string, vector []float32, limit int) ([]SearchHit, error) {
+	groups, err := q.Client.QueryGroups(ctx, &qdrant.QueryPointGroups{
+		CollectionName: collection,
+		Query:          qdrant.NewQuery(vector...),
+		GroupBy:        "document_id",
+		GroupSize:      qdrant.PtrOf(uint64(MaxHitsPerDocument)),
+		Limit:          qdrant.PtrOf(uint64(limit)),
+		WithPayload:    qdrant.NewWithPayload(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("QueryPointGroups: %w", err)
+	}
+	var hits []SearchHit
+	for _, group := range groups {
+		for _, point := range group.Hits {
+			hits = append(hits, SearchHit{
+				Document: Document{ID: pointID(point.Id), Payload: payloadFromQdrant(point.Payload)},
+				Score:    point.Score,
+			})
+		}
+	}
+	// groups come in the order of their best hit
+	sort.SliceStable(hits, func(i, j int) bool { return hits[i].Score > hits[j].Score })
+	if len(hits) > limit {
+		hits = hits[:limit]
+	}
+	return hits, nil
+}
+
+func (q *QdrantStore) Close() error {
+	return q.Client.Close()
+}
+
+func distanceToQdrant(distance Distance) qdrant.Distance {
+	if distance == DistanceDot {
+		return qdrant.Distance_Dot
+	}
+	return qdrant.Distance_Cosine
+}
+
+func distanceFromQdrant(distance qdrant.Distance) Distance {
+	switch distance {
+	case qdrant.Distance_Dot:
+		return DistanceDot
+	case qdrant.Distance_Cosine:
+		return DistanceCosine
+	}
+	return Distance(strings.ToLower(distance.String()))
+}
+
+func pointID(id *qdrant.PointId) string {
+	if uuid := id.GetUuid(); uuid != "" {
+		return uuid
+	}
+	return strconv.FormatUint(id.GetNum(), 10)
+}
+
+// payloadFromQdrant turns a payload back into plain Go values, nested
+// structs and lists are dropped.
+func payloadFromQdrant(payload map[string]*qdrant.Value) map[string]any {
+	result := make(map[string]any, len(payload))
+	for key, value := range payload {
+		switch kind := value.GetKind().(type) {
+		case *qdrant.Value_StringValue:
+			result[key] = kind.StringValue
+		case *qdrant.Value_IntegerValue:
+			result[key] = kind.IntegerValue
+		case *qdrant.Value_DoubleValue:
+			result[key] = kind.DoubleValue
+		case *qdrant.Value_BoolValue:
+			result[key] = kind.BoolValue
+		}
+	}
+	return result
+}
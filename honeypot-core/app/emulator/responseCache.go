@@ -0,0 +1,255 @@
+package emulator
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultCacheTTL is how long a cached answer is served before the LLM is
+// asked again.
+const DefaultCacheTTL = 24 * time.Hour
+
+// CacheConfig configures the response cache of the LLM backend.
+type CacheConfig struct {
+	// Path of the JSON lines file the cache persists to, empty keeps the
+	// cache in memory only.
+	Path string `json:"path"`
+	// TTL is a Go duration such as "24h", "0" disables the cache.
+	TTL string `json:"ttl"`
+}
+
+// Duration parses TTL, an empty TTL is DefaultCacheTTL.
+func (c CacheConfig) Duration() (time.Duration, error) {
+	if c.TTL == "" {
+		return DefaultCacheTTL, nil
+	}
+	ttl, err := time.ParseDuration(c.TTL)
+	if err != nil {
+		return 0, fmt.Errorf("cache ttl: %w", err)
+	}
+	return ttl, nil
+}
+
+// CacheKey is what an emulated answer depends on: the host persona it was
+// given for, the user and directory it ran in and the command itself.
+type CacheKey struct {
+	Persona string `json:"persona"`
+	User    string `json:"user"`
+	Cwd     string `json:"cwd"`
+	Command string `json:"command"`
+}
+
+type cacheEntry struct {
+	CacheKey
+	// Fingerprint is the persona's fingerprint when the answer was cached.
+	Fingerprint string    `json:"fingerprint"`
+	Output      string    `json:"output"`
+	Created     time.Time `json:"created"`
+}
+
+// ResponseCache remembers the LLM's answers so repeated commands, the
+// thousandth uname -a from a botnet included, are answered at once and the
+// same way in every session. Entries expire after TTL and are dropped when
+// their persona's fingerprint or the embedded context changes. Sessions that
+// changed their filesystem, and hybrid sessions once the container ran one of
+// their commands, neither read nor fill it. New entries are appended
+// to the file at Path, which is rewritten when entries are dropped.
+type ResponseCache struct {
+	Path string
+	TTL  time.Duration
+
+	mu           sync.Mutex
+	entries      map[CacheKey]cacheEntry
+	fingerprints map[string]string
+}
+
+func NewResponseCache(ttl time.Duration) *ResponseCache {
+	return &ResponseCache{
+		TTL:          ttl,
+		entries:      make(map[CacheKey]cacheEntry),
+		fingerprints: make(map[string]string),
+	}
+}
+
+// LoadResponseCache opens the cache persisted at path, a missing file gives
+// an empty cache. Expired entries are skipped.
+func LoadResponseCache(path string, ttl time.Duration) (*ResponseCache, error) {
+	cache := NewResponseCache(ttl)
+	cache.Path = path
+	if path == "" {
+		return cache, nil
+	}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return cache, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("opening response cache: %w", err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		var entry cacheEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			log.Printf("Skipping bad response cache line: %v", err)
+			continue
+		}
+		if cache.expired(entry) {
+			continue
+		}
+		// later lines replace earlier ones
+		cache.entries[entry.CacheKey] = entry
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading response cache %s: %w", path, err)
+	}
+	log.Printf("Loaded %d cached responses from %s", len(cache.entries), path)
+	return cache, nil
+}
+
+// NormalizeCommand collapses whitespace so "uname  -a" and "uname -a " share
+// an entry.
+func NormalizeCommand(command string) string {
+	command = strings.Join(strings.Fields(command), " ")
+	return strings.TrimSpace(strings.TrimRight(command, "; "))
+}
+
+func (c *ResponseCache) expired(entry cacheEntry) bool {
+	return c.TTL > 0 && time.Since(entry.Created) > c.TTL
+}
+
+// SetPersona tells the cache the current fingerprint of a persona, as it is
+// loaded or reloaded. When it changed the persona's answers are dropped.
+func (c *ResponseCache) SetPersona(persona string, fingerprint string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fingerprints[persona] = fingerprint
+	stale := false
+	for key, entry := range c.entries {
+		if key.Persona == persona && entry.Fingerprint != fingerprint {
+			stale = true
+			break
+		}
+	}
+	if stale {
+		log.Printf("Persona %s changed, dropped %d cached responses", persona, c.invalidate(persona))
+	}
+}
+
+// Invalidate drops every answer cached for persona, or every answer when
+// persona is empty, as when the context the LLM answers from changed.
+func (c *ResponseCache) Invalidate(persona string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.invalidate(persona)
+}
+
+// invalidate is Invalidate with c.mu held, it returns how many answers it
+// dropped.
+func (c *ResponseCache) invalidate(persona string) int {
+	dropped := 0
+	for key := range c.entries {
+		if persona == "" || key.Persona == persona {
+			delete(c.entries, key)
+			dropped++
+		}
+	}
+	if dropped > 0 {
+		c.rewrite()
+	}
+	return dropped
+}
+
+// Get returns the cached answer for key.
+func (c *ResponseCache) Get(key CacheKey) (string, bool) {
+	if c == nil || c.TTL == 0 {
+		return "", false
+	}
+	key.Command = NormalizeCommand(key.Command)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	if c.expired(entry) || entry.Fingerprint != c.fingerprints[key.Persona] {
+		delete(c.entries, key)
+		return "", false
+	}
+	return entry.Output, true
+}
+
+// Put caches the answer for key.
+func (c *ResponseCache) Put(key CacheKey, output string) {
+	if c == nil || c.TTL == 0 {
+		return
+	}
+	key.Command = NormalizeCommand(key.Command)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := cacheEntry{
+		CacheKey:    key,
+		Fingerprint: c.fingerprints[key.Persona],
+		Output:      output,
+		Created:     time.Now().UTC(),
+	}
+	c.entries[key] = entry
+	if c.Path == "" {
+		return
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Failed to encode cached response: %v", err)
+		return
+	}
+	file, err := os.OpenFile(c.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		log.Printf("Failed to open response cache: %v", err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		log.Printf("Failed to write response cache: %v", err)
+	}
+}
+
+// rewrite replaces the file with the current entries, c.mu must be held.
+func (c *ResponseCache) rewrite() {
+	if c.Path == "" {
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(c.Path), filepath.Base(c.Path)+".*")
+	if err != nil {
+		log.Printf("Failed to rewrite response cache: %v", err)
+		return
+	}
+	writer := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(writer)
+	for _, entry := range c.entries {
+		if err := encoder.Encode(entry); err != nil {
+			log.Printf("Failed to encode cached response: %v", err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		log.Printf("Failed to rewrite response cache: %v", err)
+	}
+	tmp.Close()
+	if err := os.Rename(tmp.Name(), c.Path); err != nil {
+		log.Printf("Failed to replace response cache: %v", err)
+		os.Remove(tmp.Name())
+	}
+}
@@ -0,0 +1,544 @@
+package emulator
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/JonathanKoerber/CityUCapstoneMSCS/honeypot-core/app/events"
+)
+
+// Shell emulates an interactive bash session. It keeps the working directory,
+// environment and history of the session and answers the deterministic
+// built-ins itself, everything else goes to Fallback.
+type Shell struct {
+	User    string
+	Host    string
+	Home    string
+	Cwd     string
+	Env     map[string]string
+	History []string
+	// Fallback answers commands the shell cannot, usually the LLM. stdout is
+	// where a slow fallback may stream its output while it is produced, it
+	// is nil when the output is redirected. Output written to stdout must
+	// not be returned as well.
+	Fallback func(line string, stdout io.Writer) (string, uint32)
+	// Commands are extra programs answered locally, such as the virtual
+	// filesystem tools. They get the expanded arguments without the name.
+	Commands map[string]func(args []string) (string, uint32)
+	// Record sees every command the shell answered itself with its output,
+	// so the LLM can be told about it.
+	Record func(command string, output string)
+	// Redirect writes the output of "cmd > file" and "cmd >> file", nil
+	// sends redirected commands to Fallback.
+	Redirect func(file string, output string, appendOutput bool) error
+	// DirExists reports whether cd may change into a directory, nil accepts
+	// every path.
+	DirExists func(dir string) bool
+	// Publish, when set, records events such as downloads.
+	Publish func(e events.Event)
+	// Stdout, when set, gets the output of every command as soon as it is
+	// done instead of Execute returning it, so it can be interleaved with
+	// streamed fallback output.
+	Stdout io.Writer
+	// Status is the exit status of the last command, as in $?.
+	Status       uint32
+	exited       bool
+	usedFallback bool
+	capturing    int
+}
+
+// NewShell creates a login shell for user in their home directory.
+func NewShell(user string, host string, env map[string]string) *Shell {
+	home := "/home/" + user
+	if user == "root" {
+		home = "/root"
+	}
+	sh := &Shell{
+		User: user,
+		Host: host,
+		Home: home,
+		Cwd:  home,
+		Env: map[string]string{
+			"HOME":    home,
+			"USER":    user,
+			"LOGNAME": user,
+			"SHELL":   "/bin/bash",
+			"PATH":    "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+			"LANG":    "en_US.UTF-8",
+			"PWD":     home,
+		},
+	}
+	for name, value := range env {
+		sh.Env[name] = value
+	}
+	return sh
+}
+
+// Prompt renders the bash default PS1, user@host:cwd$ with ~ for home.
+func (sh *Shell) Prompt() string {
+	dir := sh.Cwd
+	if dir == sh.Home {
+		dir = "~"
+	} else if strings.HasPrefix(dir, sh.Home+"/") {
+		dir = "~" + strings.TrimPrefix(dir, sh.Home)
+	}
+	sign := "$"
+	if sh.User == "root" {
+		sign = "#"
+	}
+	return fmt.Sprintf("%s@%s:%s%s ", sh.User, sh.Host, dir, sign)
+}
+
+// Exited reports whether the session ran exit or logout.
+func (sh *Shell) Exited() bool {
+	return sh.exited
+}
+
+// Execute runs a command line and returns its output and exit status. With
+// Stdout set the output is written there and not returned.
+func (sh *Shell) Execute(line string) (string, uint32) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return "", sh.Status
+	}
+	sh.History = append(sh.History, line)
+
+	var output strings.Builder
+	for _, command := range splitCommandList(line) {
+		if command.op == "&&" && sh.Status != 0 || command.op == "||" && sh.Status == 0 {
+			continue
+		}
+		out, status := sh.run(command.text)
+		if sh.Stdout != nil && out != "" {
+			if _, err := io.WriteString(sh.Stdout, out); err != nil {
+				log.Printf("Failed to write output: %v", err)
+			}
+		} else {
+			output.WriteString(out)
+		}
+		sh.Status = status
+		if sh.exited {
+			break
+		}
+	}
+	return output.String(), sh.Status
+}
+
+func (sh *Shell) run(command string) (string, uint32) {
+	prompt := sh.Prompt()
+	sh.usedFallback = false
+	output, status := sh.dispatch(command)
+	if !sh.usedFallback && sh.Record != nil {
+		sh.Record(prompt+command, output)
+	}
+	return output, status
+}
+
+func (sh *Shell) dispatch(command string) (string, uint32) {
+	if sh.Redirect != nil {
+		if inner, file, appendOutput, ok := splitRedirect(command); ok {
+			sh.capturing++
+			output, status := sh.dispatch(inner)
+			sh.capturing--
+			target := sh.splitWords(file)
+			if len(target) != 1 {
+				return fmt.Sprintf("-bash: %s: ambiguous redirect\n", file), 1
+			}
+			if target[0] == "/dev/null" {
+				return "", status
+			}
+			if err := sh.Redirect(sh.Resolve(target[0]), output, appendOutput); err != nil {
+				return fmt.Sprintf("-bash: %s: %s\n", target[0], errorText(err)), 1
+			}
+			return "", status
+		}
+	}
+	if hasShellSyntax(command) {
+		return sh.fallback(command)
+	}
+	words := sh.splitWords(command)
+	if len(words) == 0 {
+		return "", 0
+	}
+	// a line of only assignments sets shell variables
+	if isAssignment(words[0]) {
+		for _, word := range words {
+			if !isAssignment(word) {
+				return sh.fallback(command)
+			}
+		}
+		for _, word := range words {
+			name, value, _ := strings.Cut(word, "=")
+			sh.Env[name] = value
+		}
+		return "", 0
+	}
+
+	args := words[1:]
+	switch words[0] {
+	case "cd":
+		return sh.cd(args)
+	case "pwd":
+		return sh.Cwd + "\n", 0
+	case "whoami":
+		return sh.User + "\n", 0
+	case "true", ":":
+		return "", 0
+	case "false":
+		return "", 1
+	case "echo":
+		return echo(args), 0
+	case "export":
+		return sh.export(args)
+	case "history":
+		return sh.history(args)
+	case "exit", "logout":
+		sh.exited = true
+		if len(args) > 0 {
+			if status, err := strconv.Atoi(args[0]); err == nil {
+				return "", uint32(status & 0xff)
+			}
+		}
+		return "", sh.Status
+	}
+	if program, ok := sh.Commands[words[0]]; ok {
+		return program(args)
+	}
+	return sh.fallback(command)
+}
+
+func (sh *Shell) fallback(command string) (string, uint32) {
+	sh.usedFallback = true
+	if sh.Fallback == nil {
+		return commandNotFound(command) + "\n", 127
+	}
+	var stdout io.Writer
+	if sh.capturing == 0 {
+		stdout = sh.Stdout
+	}
+	output, status := sh.Fallback(command, stdout)
+	if output != "" && !strings.HasSuffix(output, "\n") {
+		output += "\n"
+	}
+	return output, status
+}
+
+// Resolve turns a path relative to the working directory into a clean
+// absolute path, expanding ~.
+func (sh *Shell) Resolve(dir string) string {
+	if dir == "~" || strings.HasPrefix(dir, "~/") {
+		dir = sh.Home + dir[1:]
+	}
+	if !path.IsAbs(dir) {
+		dir = path.Join(sh.Cwd, dir)
+	}
+	return path.Clean(dir)
+}
+
+func (sh *Shell) cd(args []string) (string, uint32) {
+	if len(args) > 1 {
+		return "-bash: cd: too many arguments\n", 1
+	}
+	target := sh.Home
+	if len(args) == 1 {
+		target = args[0]
+	}
+	if target == "-" {
+		previous, ok := sh.Env["OLDPWD"]
+		if !ok {
+			return "-bash: cd: OLDPWD not set\n", 1
+		}
+		sh.changeDir(previous)
+		return sh.Cwd + "\n", 0
+	}
+	dir := sh.Resolve(target)
+	if sh.DirExists != nil && !sh.DirExists(dir) {
+		return fmt.Sprintf("-bash: cd: %s: No such file or directory\n", target), 1
+	}
+	sh.changeDir(dir)
+	return "", 0
+}
+
+func (sh *Shell) changeDir(dir string) {
+	sh.Env["OLDPWD"] = sh.Cwd
+	sh.Cwd = dir
+	sh.Env["PWD"] = dir
+}
+
+func echo(args []string) string {
+	newline := true
+	escapes := false
+	for len(args) > 0 && (args[0] == "-n" || args[0] == "-e" || args[0] == "-ne" || args[0] == "-en") {
+		newline = newline && !strings.Contains(args[0], "n")
+		escapes = escapes || strings.Contains(args[0], "e")
+		args = args[1:]
+	}
+	text := strings.Join(args, " ")
+	if escapes {
+		text = strings.NewReplacer(`\n`, "\n", `\t`, "\t", `\\`, `\`).Replace(text)
+	}
+	if newline {
+		text += "\n"
+	}
+	return text
+}
+
+func (sh *Shell) export(args []string) (string, uint32) {
+	if len(args) == 0 || args[0] == "-p" {
+		names := make([]string, 0, len(sh.Env))
+		for name := range sh.Env {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var output strings.Builder
+		for _, name := range names {
+			fmt.Fprintf(&output, "declare -x %s=%q\n", name, sh.Env[name])
+		}
+		return output.String(), 0
+	}
+	for _, arg := range args {
+		name, value, ok := strings.Cut(arg, "=")
+		if !isName(name) {
+			return fmt.Sprintf("-bash: export: `%s': not a valid identifier\n", arg), 1
+		}
+		if ok {
+			sh.Env[name] = value
+		} else if _, set := sh.Env[name]; !set {
+			sh.Env[name] = ""
+		}
+	}
+	return "", 0
+}
+
+func (sh *Shell) history(args []string) (string, uint32) {
+	if len(args) > 0 && args[0] == "-c" {
+		sh.History = nil
+		return "", 0
+	}
+	var output strings.Builder
+	for i, line := range sh.History {
+		fmt.Fprintf(&output, "%5d  %s\n", i+1, line)
+	}
+	return output.String(), 0
+}
+
+// expand replaces $NAME, ${NAME} and $? with their values.
+func (sh *Shell) expand(text string) string {
+	var out strings.Builder
+	for i := 0; i < len(text); i++ {
+		if text[i] != '$' || i+1 == len(text) {
+			out.WriteByte(text[i])
+			continue
+		}
+		rest := text[i+1:]
+		switch {
+		case rest[0] == '?':
+			out.WriteString(strconv.Itoa(int(sh.Status)))
+			i++
+		case rest[0] == '{':
+			end := strings.IndexByte(rest, '}')
+			if end < 0 {
+				out.WriteByte('$')
+				continue
+			}
+			out.WriteString(sh.Env[rest[1:end]])
+			i += end + 1
+		default:
+			end := 0
+			for end < len(rest) && isNameByte(rest[end], end == 0) {
+				end++
+			}
+			if end == 0 {
+				out.WriteByte('$')
+				continue
+			}
+			out.WriteString(sh.Env[rest[:end]])
+			i += end
+		}
+	}
+	return out.String()
+}
+
+// splitWords splits a simple command into words. Single quotes are literal,
+// double quotes and bare words have variables expanded and a leading ~ is
+// the home directory.
+func (sh *Shell) splitWords(command string) []string {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	for i := 0; i < len(command); i++ {
+		c := command[i]
+		switch {
+		case c == ' ' || c == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case c == '\'':
+			end := strings.IndexByte(command[i+1:], '\'')
+			if end < 0 {
+				end = len(command) - i - 1
+			}
+			word.WriteString(command[i+1 : i+1+end])
+			i += end + 1
+			inWord = true
+		case c == '"':
+			end := strings.IndexByte(command[i+1:], '"')
+			if end < 0 {
+				end = len(command) - i - 1
+			}
+			word.WriteString(sh.expand(command[i+1 : i+1+end]))
+			i += end + 1
+			inWord = true
+		case c == '\\' && i+1 < len(command):
+			word.WriteByte(command[i+1])
+			i++
+			inWord = true
+		default:
+			end := i
+			for end < len(command) && !strings.ContainsRune(" \t'\"\\", rune(command[end])) {
+				end++
+			}
+			bare := command[i:end]
+			if !inWord && (bare == "~" || strings.HasPrefix(bare, "~/")) {
+				bare = sh.Home + bare[1:]
+			}
+			word.WriteString(sh.expand(bare))
+			i = end - 1
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words
+}
+
+type listCommand struct {
+	// op is the operator before the command: "", ";", "&&" or "||"
+	op   string
+	text string
+}
+
+// splitCommandList splits a line on ;, && and || outside of quotes.
+func splitCommandList(line string) []listCommand {
+	var commands []listCommand
+	op := ""
+	start := 0
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '\\':
+			i++
+		case c == ';' || (c == '&' || c == '|') && i+1 < len(line) && line[i+1] == c:
+			commands = append(commands, listCommand{op: op, text: strings.TrimSpace(line[start:i])})
+			op = string(c)
+			if c != ';' {
+				op += string(c)
+				i++
+			}
+			start = i + 1
+		}
+	}
+	commands = append(commands, listCommand{op: op, text: strings.TrimSpace(line[start:])})
+	return commands
+}
+
+// splitRedirect splits "cmd > file" and "cmd >> file" when that is the only
+// shell syntax on the command.
+func splitRedirect(command string) (string, string, bool, bool) {
+	var quote byte
+	for i := 0; i < len(command); i++ {
+		c := command[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'':
+			quote = c
+		case c == '"':
+			quote = c
+		case c == '\\':
+			i++
+		case c == '>':
+			// 2> and &> redirect stderr, leave those to the fallback
+			if i > 0 && (command[i-1] == '&' || command[i-1] == '2' && (i == 1 || command[i-2] == ' ')) {
+				return "", "", false, false
+			}
+			inner := strings.TrimSpace(command[:i])
+			appendOutput := i+1 < len(command) && command[i+1] == '>'
+			if appendOutput {
+				i++
+			}
+			file := strings.TrimSpace(command[i+1:])
+			if inner == "" || file == "" || hasShellSyntax(inner) || hasShellSyntax(file) {
+				return "", "", false, false
+			}
+			return inner, file, appendOutput, true
+		}
+	}
+	return "", "", false, false
+}
+
+// hasShellSyntax reports pipes, redirections, background jobs and command
+// substitution outside of quotes, which the built-ins do not handle.
+func hasShellSyntax(command string) bool {
+	var quote byte
+	for i := 0; i < len(command); i++ {
+		c := command[i]
+		switch {
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			}
+		case c == '\\':
+			i++
+		case c == '`' || c == '$' && i+1 < len(command) && command[i+1] == '(':
+			return true
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case strings.IndexByte("|<>&", c) >= 0:
+			return true
+		}
+	}
+	return false
+}
+
+func isAssignment(word string) bool {
+	name, _, ok := strings.Cut(word, "=")
+	return ok && isName(name)
+}
+
+func isName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !isNameByte(name[i], i == 0) {
+			return false
+		}
+	}
+	return true
+}
+
+func isNameByte(c byte, first bool) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || !first && c >= '0' && c <= '9'
+}
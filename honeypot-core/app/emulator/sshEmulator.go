@@ -1,14 +1,17 @@
 package emulator
 
 import (
-	"golang.org/x/crypto/ssh"
-	"io"
 	"log"
-	"time"
 )
 
 type SSHEmulator struct {
 	Context NodeContext
+	// Generator answers the commands of LLM sessions.
+	Generator Generator
+	// Filesystem is the snapshot LLM sessions browse, shared by all sessions.
+	Filesystem *Snapshot
+	// Cache holds the LLM's answers across sessions, nil disables it.
+	Cache *ResponseCache
 }
 
 func NewSSHEmulator() *SSHEmulator {
@@ -18,10 +21,14 @@ func (s *SSHEmulator) Init(store *Store) error {
 	//	s.Config = config
 
 	// Hardcoded context values for now; tweak later
+	collection := store.CollectionFor("ssh_emulator")
 	s.Context = NodeContext{
-		CollectionName: "ssh_emulator",
+		CollectionName: collection,
 		PathToContext:  "data/ssh",
-		Store:          store,
+		// named without the model, so the manifest still knows the
+		// collection of the previous model when it changes
+		ManifestPath: "data/manifests/ssh_emulator.json",
+		Store:        store,
 	}
 	log.Printf("Initialized SSHEmulator with collection: %s\n", s.Context.CollectionName)
 	return nil
@@ -51,70 +58,41 @@ func (s *SSHEmulator) Init(store *Store) error {
 //		return nil
 //
 // }
-func (s *SSHEmulator) GetContext() (NodeContext, error) {
-	return s.Context, nil
-}
-func (s *SSHEmulator) Close() error {
-	return nil
-}
-
-// REPL-based handler piping into fuxa
-func (s *SSHEmulator) HandleInput(channel ssh.Channel) error {
-	defer channel.Close()
-
-	config := &ssh.ClientConfig{
-		User: "admin",
-		Auth: []ssh.AuthMethod{
-			ssh.Password("password"),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Timeout:         5 * time.Second,
-	}
-
-	addr := "ics-host:22" // Make sure this matches the container SSH port
-
-	client, err := ssh.Dial("tcp", addr, config)
+// LoadFilesystem seeds the emulated filesystem from a directory, tarball or
+// JSON listing. An empty source gives a bare Linux directory tree.
+func (s *SSHEmulator) LoadFilesystem(source string) error {
+	snapshot, err := LoadSnapshot(source)
 	if err != nil {
-		log.Printf("failed to connect to container: %v", err)
 		return err
 	}
-	defer client.Close()
+	s.Filesystem = snapshot
+	return nil
+}
 
-	session, err := client.NewSession()
+// LoadCache opens the response cache of the backend config and drops the
+// answers given for an earlier version of the personas.
+func (s *SSHEmulator) LoadCache(config BackendConfig, personas ...*Persona) error {
+	ttl, err := config.Cache.Duration()
 	if err != nil {
-		log.Printf("failed to create session: %v", err)
 		return err
 	}
-	defer session.Close()
-
-	// Request PTY
-	modes := ssh.TerminalModes{
-		ssh.ECHO:          1,
-		ssh.TTY_OP_ISPEED: 14400,
-		ssh.TTY_OP_OSPEED: 14400,
-	}
-	if err := session.RequestPty("xterm", 80, 40, modes); err != nil {
-		log.Printf("failed to request PTY: %v", err)
+	cache, err := LoadResponseCache(config.Cache.Path, ttl)
+	if err != nil {
 		return err
 	}
-
-	// Attach I/O
-	containerIn, _ := session.StdinPipe()
-	containerOut, _ := session.StdoutPipe()
-	containerErr, _ := session.StderrPipe()
-
-	if err := session.Shell(); err != nil {
-		log.Printf("failed to start shell: %v", err)
-		return err
+	if len(personas) == 0 {
+		personas = []*Persona{DefaultPersona()}
 	}
-
-	go io.Copy(containerIn, channel)
-	go io.Copy(channel, containerOut)
-	go io.Copy(channel.Stderr(), containerErr)
-
-	if err := session.Wait(); err != nil {
-		log.Printf("session finished with error: %v", err)
+	for _, persona := range personas {
+		cache.SetPersona(persona.Name, config.Fingerprint(persona))
 	}
+	s.Cache = cache
+	return nil
+}
 
+func (s *SSHEmulator) GetContext() (NodeContext, error) {
+	return s.Context, nil
+}
+func (s *SSHEmulator) Close() error {
 	return nil
 }
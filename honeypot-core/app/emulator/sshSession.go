@@ -0,0 +1,103 @@
+package emulator
+
+import (
+	"encoding/binary"
+	"log"
+
+	"github.com/JonathanKoerber/CityUCapstoneMSCS/honeypot-core/app/events"
+	"golang.org/x/crypto/ssh"
+)
+
+// WindowSize is a terminal size in characters.
+type WindowSize struct {
+	Width  uint32
+	Height uint32
+}
+
+// SessionRequest collects what the attacker asked for on a session channel
+// before the shell or exec request, so the backend session can be opened the
+// same way.
+type SessionRequest struct {
+	// SessionID identifies the connection, it matches the recording name.
+	SessionID  string
+	User       string
+	RemoteAddr string
+	// PTY is set when the client sent a pty-req.
+	PTY    bool
+	Term   string
+	Width  uint32
+	Height uint32
+	Modes  ssh.TerminalModes
+	Env    map[string]string
+	// Command is the exec command, it is empty for an interactive shell.
+	Command string
+	// WindowChanges delivers window-change requests. It is closed when the
+	// channel's request stream ends.
+	WindowChanges <-chan WindowSize
+	// Backend is the name of the backend serving the session.
+	Backend string
+	// Events receives the session's commands and file transfers, may be
+	// nil.
+	Events *events.Bus
+}
+
+// Publish sends e to the session's event bus with the session's details
+// filled in.
+func (r *SessionRequest) Publish(e events.Event) {
+	if r.Events == nil {
+		return
+	}
+	header := e.EventHeader()
+	header.Protocol = events.ProtocolSSH
+	header.SessionID = r.SessionID
+	header.RemoteAddr = r.RemoteAddr
+	r.Events.Publish(e)
+}
+
+// PublishCommand records a command of the session, status is nil when it is
+// not known.
+func (r *SessionRequest) PublishCommand(command string, interactive bool, status *uint32) {
+	r.Publish(&events.Command{
+		User:        r.User,
+		Backend:     r.Backend,
+		Command:     command,
+		Interactive: interactive,
+		ExitStatus:  status,
+	})
+}
+
+func NewSessionRequest() *SessionRequest {
+	return &SessionRequest{
+		Term:   "xterm",
+		Width:  80,
+		Height: 24,
+		Modes:  ssh.TerminalModes{},
+		Env:    make(map[string]string),
+	}
+}
+
+// ParseTerminalModes decodes the encoded terminal modes of a pty-req, RFC
+// 4254 section 8: opcode bytes each followed by a uint32, ending with
+// TTY_OP_END.
+func ParseTerminalModes(encoded string) ssh.TerminalModes {
+	modes := ssh.TerminalModes{}
+	data := []byte(encoded)
+	for len(data) > 0 {
+		opcode := data[0]
+		// opcodes 160 to 255 have unknown arguments, stop parsing there
+		if opcode == 0 || opcode >= 160 || len(data) < 5 {
+			break
+		}
+		modes[opcode] = binary.BigEndian.Uint32(data[1:5])
+		data = data[5:]
+	}
+	return modes
+}
+
+// SendExitStatus tells the client how the shell or command ended.
+func SendExitStatus(channel ssh.Channel, status uint32) {
+	payload := ssh.Marshal(struct{ Status uint32 }{status})
+	if _, err := channel.SendRequest("exit-status", false, payload); err != nil {
+		log.Printf("Failed to send exit-status: %v", err)
+	}
+}
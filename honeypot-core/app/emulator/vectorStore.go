@@ -1,38 +1,96 @@
 package emulator
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
 	"github.com/google/uuid"
-	"io"
 	"log"
-	"net/http"
-	"os"
-	"path/filepath"
-	"strings"
+	"math"
+	"regexp"
+	"strconv"
 	"time"
-
-	"github.com/qdrant/go-client/qdrant"
 )
 
-type VectorStore interface {
-	// New create a new emulator with node-specific data
-	Init(store *Store) error
+// Document is a piece of context and its embedding. Payload holds at least
+// "content", the text given to the LLM, and "document_id", the document the
+// piece was cut from.
+type Document struct {
+	ID      string         `json:"id"`
+	Vector  []float32      `json:"vector"`
+	Payload map[string]any `json:"payload"`
+}
+
+// Content is the text of the document.
+func (d Document) Content() string {
+	content, _ := d.Payload["content"].(string)
+	return content
+}
+
+// SearchHit is a document found by a search and how close it is to the
+// query, higher is closer.
+type SearchHit struct {
+	Document
+	Score float32
+}
 
-	// HandleCommand Handles input to protocol server
-	HandleCommand(sessionID string, input string) (string, error)
+// Distance is how a collection compares vectors.
+type Distance string
 
-	GetContext() (NodeContext, error)
+const (
+	DistanceCosine Distance = "cosine"
+	// DistanceDot ranks unit vectors like cosine without normalizing them.
+	DistanceDot Distance = "dot"
+)
 
-	// Close releases any resource used by emulator
+// CollectionSchema is the shape of the vectors a collection holds.
+type CollectionSchema struct {
+	Dimension int
+	Distance  Distance
+}
+
+func (s CollectionSchema) String() string {
+	return fmt.Sprintf("%d-dimension %s", s.Dimension, s.Distance)
+}
+
+// VectorStore keeps documents in named collections and finds the ones
+// nearest to a vector.
+type VectorStore interface {
+	// EnsureCollection creates the collection if it does not exist yet and
+	// fails if it exists with another schema.
+	EnsureCollection(ctx context.Context, collection string, schema CollectionSchema) error
+	// Upsert adds documents, replacing those with the same ID.
+	Upsert(ctx context.Context, collection string, docs []Document) error
+	// Delete removes documents by ID.
+	Delete(ctx context.Context, collection string, ids []string) error
+	// DropCollection removes a collection and all its documents, a missing
+	// collection is not an error.
+	DropCollection(ctx context.Context, collection string) error
+	// Count returns how many documents the collection holds, a missing
+	// collection holds none.
+	Count(ctx context.Context, collection string) (int, error)
+	// Search returns up to limit hits nearest to vector, best first, with
+	// at most MaxHitsPerDocument of each document_id.
+	Search(ctx context.Context, collection string, vector []float32, limit int) ([]SearchHit, error)
 	Close() error
 }
 
+// MaxHitsPerDocument keeps one long transcript or man page from filling
+// every search, while still letting it answer with more than one chunk.
+const MaxHitsPerDocument = 3
+
+// Vector store backends selected with VECTOR_STORE.
+const (
+	VectorStoreQdrant   = "qdrant"
+	VectorStoreEmbedded = "embedded"
+)
+
 type Store struct {
-	Client      *qdrant.Client
+	Vectors     VectorStore
 	Collections []string
+	// Embedder turns context lines and queries into vectors.
+	Embedder Embedder
+	// Schema is what the embedder's vectors look like, see Probe.
+	Schema CollectionSchema
 }
 
 func NewEmulator() Store {
@@ -40,137 +98,164 @@ func NewEmulator() Store {
 
 }
 
+// Init opens the vector store chosen in the environment:
+//
+//	VECTOR_STORE       qdrant (default) or embedded
+//	QDRANT_HOST        defaults to qdrant
+//	QDRANT_PORT        gRPC port, defaults to 6334
+//	VECTOR_STORE_PATH  directory of the embedded store, defaults to data/vectors
 func (store *Store) Init() error {
-	//vecStoreUri := os.Getenv("VEC_STORE_URI")
-	client, err := qdrant.NewClient(&qdrant.Config{
-		Host: "qdrant",
-		Port: 6334,
-	})
-	if err != nil {
-		log.Fatalf("Fatal error connecting to VEC store: %v", err)
-	}
-	// add qdrant client to vector store
-	store.Client = client
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	healthCheckResult, err := client.HealthCheck(ctx)
-	if err != nil {
-		log.Fatalf("Fatal error connecting to VEC store: %v", err)
-	}
-	log.Printf("Health check result: %v", healthCheckResult)
-	return err
-}
-
-func (store *Store) ReadContextFiles(nodeContext NodeContext) ([]string, error) {
-	//  TODO walk dir and vectorized files.
-	// TODO this is a dir need to embed all the files that are in third the dir.
-	data, err := os.ReadDir(nodeContext.PathToContext)
-	if err != nil {
-		log.Fatalf("Could not read context: %v", err)
-	}
-	var lines []string
-	for _, entry := range data {
-		if entry.IsDir() {
-			//dirPath := filepath.Join(nodeContext.PathToContext, entry.ImageName())
-			//data.append(data, os.ReadDir(dirPath))
-			continue
+	switch backend := envOr("VECTOR_STORE", VectorStoreQdrant); backend {
+	case VectorStoreQdrant:
+		port, err := strconv.Atoi(envOr("QDRANT_PORT", "6334"))
+		if err != nil {
+			return fmt.Errorf("QDRANT_PORT: %w", err)
 		}
-		filePath := filepath.Join(nodeContext.PathToContext, entry.Name())
-		data, err := os.ReadFile(filePath)
+		vectors, err := NewQdrantStore(envOr("QDRANT_HOST", "qdrant"), port)
 		if err != nil {
-			log.Printf("Could not read file: %v", err)
+			return err
 		}
-		lines = strings.Split(string(data), "\n")
-		for line := range lines {
-			lines[line] = strings.TrimSpace(lines[line])
+		store.Vectors = vectors
+	case VectorStoreEmbedded:
+		vectors, err := NewEmbeddedStore(envOr("VECTOR_STORE_PATH", "data/vectors"))
+		if err != nil {
+			return err
 		}
+		store.Vectors = vectors
+	default:
+		return fmt.Errorf("unknown VECTOR_STORE %q", backend)
 	}
-	return lines, nil
+	return nil
 }
 
-func (store *Store) EmbedDocs(line string) (*qdrant.PointStruct, error) {
-	id := uuid.New().String()
-	reqBody := map[string]interface{}{
-		"model":  os.Getenv("MODEL"),
-		"prompt": line,
-	}
-	reqBytes, err := json.Marshal(reqBody)
-	resp, err := http.Post(os.Getenv("OLLAMA_URL")+"/api/embeddings", "application/json", bytes.NewBuffer(reqBytes))
+// Probe embeds a sample text to learn the embedder's dimension. Models that
+// return unit vectors get dot product, which ranks the same as cosine.
+func (store *Store) Probe() error {
+	embedding, err := store.embed(context.Background(), "uname -a")
 	if err != nil {
-		return nil, fmt.Errorf("embedding request failded with: %v", err)
+		return fmt.Errorf("probing embedder: %w", err)
+	}
+	if embedding == nil {
+		return fmt.Errorf("probing embedder: %s returned an empty vector", store.Embedder.Model())
 	}
-	defer resp.Body.Close()
+	var norm float64
+	for _, value := range embedding {
+		norm += float64(value) * float64(value)
+	}
+	store.Schema = CollectionSchema{Dimension: len(embedding), Distance: DistanceCosine}
+	if math.Abs(math.Sqrt(norm)-1) < 1e-3 {
+		store.Schema.Distance = DistanceDot
+	}
+	log.Printf("Embedding model %s makes %s vectors", store.Embedder.Model(), store.Schema)
+	return nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("embedding request failded with: %v - %v", resp.StatusCode, string(bodyBytes))
+// CollectionFor names the collection of base for the embedder's model, so
+// vectors of different models never share a collection. Personas share it,
+// their chunks are told apart by the persona payload.
+func (store *Store) CollectionFor(base string) string {
+	name := base
+	if store.Embedder != nil {
+		name += "_" + store.Embedder.Model()
 	}
+	return collectionNameChars.ReplaceAllString(name, "_")
+}
 
-	var result struct {
-		Embedding []float32 `json:"embedding"`
+var collectionNameChars = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+// EnsureCollection creates the collection for the probed schema and fails
+// with a clear error if it holds vectors of another shape.
+func (store *Store) EnsureCollection(collectionName string) error {
+	if store.Vectors == nil {
+		return fmt.Errorf("vector store is not connected")
+	}
+	if store.Schema.Dimension == 0 {
+		if err := store.Probe(); err != nil {
+			return err
+		}
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return nil, fmt.Errorf("failded to decode embedding: %w", err)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return store.Vectors.EnsureCollection(ctx, collectionName, store.Schema)
+}
+
+// ReadContextFiles cuts every file under the context's directory into
+// chunks, see ReadContext.
+func (store *Store) ReadContextFiles(nodeContext NodeContext) ([]Chunk, error) {
+	return ReadContext(nodeContext.PathToContext, nodeContext.Persona)
+}
+
+func (store *Store) embed(ctx context.Context, text string) ([]float32, error) {
+	if store.Embedder == nil {
+		return nil, fmt.Errorf("store has no embedder")
 	}
-	//embedding := make([]float64, len(result.Embedding))
-	payload := map[string]interface{}{"content": line}
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	embedding, err := store.Embedder.Embed(ctx, text)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create payload: %w", err)
+		return nil, fmt.Errorf("embedding request failed with: %w", err)
 	}
-	if len(result.Embedding) == 0 {
-		log.Printf("no embedding found: %s", line)
+	if len(embedding) == 0 {
+		log.Printf("no embedding found: %s", text)
 		return nil, nil
 	}
-	point := &qdrant.PointStruct{
-		Id: &qdrant.PointId{
-			PointIdOptions: &qdrant.PointId_Uuid{Uuid: id}, // or use UIntId if numeric
-		},
-		Vectors: qdrant.NewVectors(result.Embedding...),
-		Payload: qdrant.NewValueMap(payload),
-	}
+	return embedding, nil
+}
 
-	return point, nil
+// EmbedDocs embeds a line, such as a command to find context for.
+func (store *Store) EmbedDocs(line string) (*Document, error) {
+	embedding, err := store.embed(context.Background(), line)
+	if embedding == nil {
+		return nil, err
+	}
+	id := uuid.New().String()
+	return &Document{
+		ID:      id,
+		Vector:  embedding,
+		Payload: map[string]any{"content": line, "document_id": id},
+	}, nil
 }
 
-func (store *Store) CreateCollection(collectionName string, vectorSize uint64) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	var defaultSeg *uint64
-	v := uint64(2)
-	defaultSeg = &v
-	err := store.Client.CreateCollection(ctx, &qdrant.CreateCollection{
-		CollectionName: collectionName,
-		VectorsConfig: qdrant.NewVectorsConfig(&qdrant.VectorParams{
-			Size:     vectorSize,
-			Distance: qdrant.Distance_Dot,
-		}),
-		OptimizersConfig: &qdrant.OptimizersConfigDiff{
-			DefaultSegmentNumber: defaultSeg,
-		},
-	})
-	if err != nil {
-		log.Fatalf("Fatal error creating collection: %v", err)
+// EmbedChunk embeds a chunk of a context file with its metadata.
+func (store *Store) EmbedChunk(ctx context.Context, chunk Chunk) (*Document, error) {
+	embedding, err := store.embed(ctx, chunk.Content)
+	if embedding == nil {
+		return nil, err
 	}
-	return err
+	return &Document{
+		ID:      chunk.ID(),
+		Vector:  embedding,
+		Payload: chunk.Payload(),
+	}, nil
 }
 
-func (store *Store) AddVectors(collectionName string, upsertPoints []*qdrant.PointStruct) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	connect, err := store.Client.CollectionExists(ctx, collectionName)
-	if err != nil {
-		log.Fatalf("Fatal error connecting to collection: %v", err)
+// AddVectors upserts docs, creating the collection on first use. Documents
+// of another dimension than the collection's are refused.
+func (store *Store) AddVectors(collectionName string, docs []Document) error {
+	if len(docs) == 0 {
+		return nil
 	}
-	if !connect {
-		store.CreateCollection(collectionName, 2560)
+	if err := store.EnsureCollection(collectionName); err != nil {
+		return err
 	}
-	_, err = store.Client.Upsert(ctx, &qdrant.UpsertPoints{
-		CollectionName: collectionName,
-		Points:         upsertPoints,
-	})
-	if err != nil {
-		log.Fatalf("Could not upsert points: %v", err)
+	for _, doc := range docs {
+		if len(doc.Vector) != store.Schema.Dimension {
+			return fmt.Errorf("document %s has %d dimensions, collection %s holds %s vectors", doc.ID, len(doc.Vector), collectionName, store.Schema)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := store.Vectors.Upsert(ctx, collectionName, docs); err != nil {
+		return fmt.Errorf("could not upsert points: %w", err)
+	}
+	log.Println("Upsert", len(docs), "points")
+	return nil
+}
+
+// Close releases the vector store.
+func (store *Store) Close() error {
+	if store.Vectors == nil {
+		return nil
 	}
-	log.Println("Upsert", len(upsertPoints), "points")
-	return err
+	return store.Vectors.Close()
 }
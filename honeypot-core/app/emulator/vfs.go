@@ -0,0 +1,541 @@
+package emulator
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxSnapshotContent is the largest file whose content is kept when seeding
+// from a directory or archive, bigger files are kept as stubs.
+const maxSnapshotContent = 1 << 20
+
+// VFile is a file, directory or symlink in the virtual filesystem.
+type VFile struct {
+	Mode    fs.FileMode
+	Size    int64
+	ModTime time.Time
+	Owner   string
+	Group   string
+	Content []byte
+	// Target is the destination of a symlink.
+	Target string
+	// Stub files are listed in the snapshot without content, it is made up
+	// by the LLM on first read and cached.
+	Stub bool
+}
+
+func (f *VFile) IsDir() bool {
+	return f.Mode.IsDir()
+}
+
+func (f *VFile) copy() *VFile {
+	c := *f
+	c.Content = append([]byte(nil), f.Content...)
+	return &c
+}
+
+// Snapshot is the read-only filesystem image every session starts from,
+// typically taken from an ICS engineering workstation. Generated contents of
+// stub files are cached in it so every session sees the same file.
+type Snapshot struct {
+	lock     sync.RWMutex
+	files    map[string]*VFile
+	children map[string]map[string]bool
+}
+
+// skeletonDirs are always present so an empty snapshot still looks like a
+// Linux host.
+var skeletonDirs = []string{
+	"/bin", "/boot", "/dev", "/etc", "/home", "/lib", "/media", "/mnt", "/opt", "/proc",
+	"/root", "/run", "/sbin", "/srv", "/sys", "/tmp", "/usr", "/usr/bin", "/usr/lib",
+	"/usr/local", "/usr/sbin", "/usr/share", "/var", "/var/lib", "/var/log", "/var/tmp",
+}
+
+// snapshotEpoch dates entries a snapshot has no time for, roughly when the
+// workstation was installed.
+var snapshotEpoch = time.Date(2024, time.March, 4, 9, 12, 0, 0, time.UTC)
+
+func NewSnapshot() *Snapshot {
+	snapshot := &Snapshot{
+		files:    make(map[string]*VFile),
+		children: make(map[string]map[string]bool),
+	}
+	epoch := snapshotEpoch
+	snapshot.put("/", &VFile{Mode: fs.ModeDir | 0o755, Size: 4096, ModTime: epoch, Owner: "root", Group: "root"})
+	for _, dir := range skeletonDirs {
+		mode := fs.FileMode(0o755)
+		if dir == "/tmp" || dir == "/var/tmp" {
+			mode = 0o777 | fs.ModeSticky
+		}
+		if dir == "/root" {
+			mode = 0o700
+		}
+		snapshot.put(dir, &VFile{Mode: fs.ModeDir | mode, Size: 4096, ModTime: epoch, Owner: "root", Group: "root"})
+	}
+	return snapshot
+}
+
+// LoadSnapshot seeds a snapshot from a directory, a .tar or .tar.gz archive,
+// or a .json listing of VFile entries keyed by path. JSON entries without
+// content become stubs.
+func LoadSnapshot(source string) (*Snapshot, error) {
+	snapshot := NewSnapshot()
+	if source == "" {
+		return snapshot, nil
+	}
+	info, err := os.Stat(source)
+	if err != nil {
+		return nil, fmt.Errorf("reading filesystem snapshot: %w", err)
+	}
+	switch {
+	case info.IsDir():
+		err = snapshot.loadDir(source)
+	case strings.HasSuffix(source, ".json"):
+		err = snapshot.loadListing(source)
+	default:
+		err = snapshot.loadTar(source)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("loading filesystem snapshot %s: %w", source, err)
+	}
+	log.Printf("Loaded filesystem snapshot %s with %d entries", source, len(snapshot.files))
+	return snapshot, nil
+}
+
+func (s *Snapshot) loadDir(root string) error {
+	return filepath.WalkDir(root, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, file)
+		if err != nil || rel == "." {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		vfile := &VFile{Mode: info.Mode(), Size: info.Size(), ModTime: info.ModTime(), Owner: "root", Group: "root"}
+		switch {
+		case info.Mode()&fs.ModeSymlink != 0:
+			vfile.Target, _ = os.Readlink(file)
+		case info.Mode().IsRegular() && info.Size() > maxSnapshotContent:
+			vfile.Stub = true
+		case info.Mode().IsRegular():
+			if vfile.Content, err = os.ReadFile(file); err != nil {
+				return err
+			}
+		}
+		s.put("/"+filepath.ToSlash(rel), vfile)
+		return nil
+	})
+}
+
+func (s *Snapshot) loadTar(archive string) error {
+	file, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var reader io.Reader = file
+	if strings.HasSuffix(archive, ".gz") || strings.HasSuffix(archive, ".tgz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		reader = gz
+	}
+	tr := tar.NewReader(reader)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Clean("/" + header.Name)
+		if name == "/" {
+			continue
+		}
+		vfile := &VFile{
+			Mode:    header.FileInfo().Mode(),
+			Size:    header.Size,
+			ModTime: header.ModTime,
+			Owner:   nameOr(header.Uname, "root"),
+			Group:   nameOr(header.Gname, "root"),
+		}
+		switch header.Typeflag {
+		case tar.TypeSymlink:
+			vfile.Target = header.Linkname
+		case tar.TypeLink:
+			// a hard link names an earlier entry from the archive root, it
+			// is the same file so it gets a copy of it
+			linked, ok := s.files[path.Clean("/"+header.Linkname)]
+			if !ok || linked.IsDir() {
+				vfile.Stub = true
+				break
+			}
+			vfile = linked.copy()
+		case tar.TypeReg:
+			if header.Size > maxSnapshotContent {
+				vfile.Stub = true
+				break
+			}
+			if vfile.Content, err = io.ReadAll(io.LimitReader(tr, maxSnapshotContent)); err != nil {
+				return err
+			}
+		}
+		s.put(name, vfile)
+	}
+}
+
+func (s *Snapshot) loadListing(listing string) error {
+	raw, err := os.ReadFile(listing)
+	if err != nil {
+		return err
+	}
+	var entries map[string]struct {
+		Mode    string    `json:"mode"`
+		Size    int64     `json:"size"`
+		ModTime time.Time `json:"modTime"`
+		Owner   string    `json:"owner"`
+		Group   string    `json:"group"`
+		Content *string   `json:"content"`
+		Target  string    `json:"target"`
+	}
+	if err := json.Unmarshal(raw, &entries); err != nil {
+		return err
+	}
+	for name, entry := range entries {
+		vfile := &VFile{
+			Mode:    parseMode(entry.Mode),
+			Size:    entry.Size,
+			ModTime: entry.ModTime,
+			Owner:   nameOr(entry.Owner, "root"),
+			Group:   nameOr(entry.Group, nameOr(entry.Owner, "root")),
+			Target:  entry.Target,
+		}
+		if vfile.Target != "" {
+			vfile.Mode = fs.ModeSymlink | 0o777
+		}
+		if vfile.Mode.IsRegular() {
+			if entry.Content == nil {
+				vfile.Stub = true
+			} else {
+				vfile.Content = []byte(*entry.Content)
+				vfile.Size = int64(len(vfile.Content))
+			}
+		}
+		s.put(path.Clean("/"+name), vfile)
+	}
+	return nil
+}
+
+// parseMode reads an ls style mode such as "drwxr-xr-x" or "-rw-r--r--".
+func parseMode(mode string) fs.FileMode {
+	if len(mode) != 10 {
+		return 0o644
+	}
+	var parsed fs.FileMode
+	if mode[0] == 'd' {
+		parsed = fs.ModeDir
+	}
+	for i, c := range mode[1:] {
+		if c != '-' {
+			parsed |= 1 << uint(8-i)
+		}
+	}
+	return parsed
+}
+
+func nameOr(name string, fallback string) string {
+	if name == "" {
+		return fallback
+	}
+	return name
+}
+
+// put adds a file and any missing parent directories. The lock must be held
+// or the snapshot not shared yet.
+func (s *Snapshot) put(name string, file *VFile) {
+	if file.IsDir() && file.Size == 0 {
+		file.Size = 4096
+	}
+	if file.ModTime.IsZero() {
+		file.ModTime = snapshotEpoch
+	}
+	s.files[name] = file
+	for name != "/" {
+		parent := path.Dir(name)
+		if s.children[parent] == nil {
+			s.children[parent] = make(map[string]bool)
+		}
+		s.children[parent][path.Base(name)] = true
+		if _, ok := s.files[parent]; !ok {
+			s.files[parent] = &VFile{Mode: fs.ModeDir | 0o755, Size: 4096, ModTime: file.ModTime, Owner: "root", Group: "root"}
+		}
+		name = parent
+	}
+}
+
+func (s *Snapshot) get(name string) (*VFile, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	file, ok := s.files[name]
+	return file, ok
+}
+
+func (s *Snapshot) list(dir string) []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	names := make([]string, 0, len(s.children[dir]))
+	for name := range s.children[dir] {
+		names = append(names, name)
+	}
+	return names
+}
+
+// fill caches generated content for a stub file.
+func (s *Snapshot) fill(name string, content []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if file, ok := s.files[name]; ok && file.Stub {
+		filled := file.copy()
+		filled.Content = content
+		filled.Size = int64(len(content))
+		filled.Stub = false
+		s.files[name] = filled
+	}
+}
+
+// Session starts a copy-on-write view of the snapshot for one attacker.
+func (s *Snapshot) Session() *SessionFS {
+	return &SessionFS{
+		snapshot: s,
+		overlay:  make(map[string]*VFile),
+		removed:  make(map[string]bool),
+	}
+}
+
+// SessionFS is a copy-on-write view of a Snapshot. Changes made during a
+// session live in the overlay and are gone when the session ends.
+type SessionFS struct {
+	snapshot *Snapshot
+	overlay  map[string]*VFile
+	removed  map[string]bool
+	// generation counts the changes made during the session.
+	generation uint64
+	// Generate makes up the content of a stub file, nil leaves stubs empty.
+	Generate func(name string) (string, error)
+}
+
+// Lstat looks up a path without following a final symlink.
+func (sfs *SessionFS) Lstat(name string) (*VFile, bool) {
+	if sfs.removed[name] {
+		return nil, false
+	}
+	if file, ok := sfs.overlay[name]; ok {
+		return file, true
+	}
+	return sfs.snapshot.get(name)
+}
+
+// Stat looks up a path, following symlinks.
+func (sfs *SessionFS) Stat(name string) (*VFile, bool) {
+	_, file, ok := sfs.follow(name)
+	return file, ok
+}
+
+// follow resolves symlinks, up to a few levels, and returns the final path.
+func (sfs *SessionFS) follow(name string) (string, *VFile, bool) {
+	file, ok := sfs.Lstat(name)
+	for i := 0; ok && file.Target != "" && i < 8; i++ {
+		target := file.Target
+		if !path.IsAbs(target) {
+			target = path.Join(path.Dir(name), target)
+		}
+		name = path.Clean(target)
+		file, ok = sfs.Lstat(name)
+	}
+	return name, file, ok
+}
+
+// ReadDir returns the sorted names in a directory.
+func (sfs *SessionFS) ReadDir(dir string) ([]string, error) {
+	dir, file, ok := sfs.follow(dir)
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	if !file.IsDir() {
+		return nil, errNotDir
+	}
+	seen := make(map[string]bool)
+	var names []string
+	for _, name := range sfs.snapshot.list(dir) {
+		if !sfs.removed[path.Join(dir, name)] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	for full := range sfs.overlay {
+		if full != "/" && path.Dir(full) == dir && !seen[path.Base(full)] {
+			names = append(names, path.Base(full))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+var errNotDir = errors.New("not a directory")
+var errIsDir = errors.New("is a directory")
+var errNotEmpty = errors.New("directory not empty")
+
+func (sfs *SessionFS) ReadFile(name string) ([]byte, error) {
+	name, file, ok := sfs.follow(name)
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	if file.IsDir() {
+		return nil, errIsDir
+	}
+	if file.Stub && sfs.Generate != nil {
+		content, err := sfs.Generate(name)
+		if err != nil {
+			return nil, err
+		}
+		sfs.snapshot.fill(name, []byte(content))
+		file, _ = sfs.Lstat(name)
+	}
+	return file.Content, nil
+}
+
+func (sfs *SessionFS) parentExists(name string) error {
+	parent, ok := sfs.Stat(path.Dir(name))
+	if !ok {
+		return fs.ErrNotExist
+	}
+	if !parent.IsDir() {
+		return errNotDir
+	}
+	return nil
+}
+
+// WriteFile creates or replaces a file, or appends to it.
+func (sfs *SessionFS) WriteFile(name string, data []byte, appendData bool, owner string) error {
+	if err := sfs.parentExists(name); err != nil {
+		return err
+	}
+	existing, ok := sfs.Lstat(name)
+	if ok && existing.IsDir() {
+		return errIsDir
+	}
+	var file *VFile
+	if ok {
+		file = existing.copy()
+	} else {
+		file = &VFile{Mode: 0o644, Owner: owner, Group: owner}
+	}
+	if appendData {
+		file.Content = append(file.Content, data...)
+	} else {
+		file.Content = append([]byte(nil), data...)
+	}
+	file.Size = int64(len(file.Content))
+	file.Stub = false
+	file.ModTime = time.Now()
+	sfs.set(name, file)
+	return nil
+}
+
+// Touch creates an empty file or updates its modification time.
+func (sfs *SessionFS) Touch(name string, owner string) error {
+	if existing, ok := sfs.Lstat(name); ok {
+		file := existing.copy()
+		file.ModTime = time.Now()
+		sfs.set(name, file)
+		return nil
+	}
+	return sfs.WriteFile(name, nil, false, owner)
+}
+
+func (sfs *SessionFS) Mkdir(name string, parents bool, owner string) error {
+	if file, ok := sfs.Lstat(name); ok {
+		if parents && file.IsDir() {
+			return nil
+		}
+		return fs.ErrExist
+	}
+	if err := sfs.parentExists(name); err != nil {
+		if !parents || name == "/" {
+			return err
+		}
+		if err := sfs.Mkdir(path.Dir(name), true, owner); err != nil {
+			return err
+		}
+	}
+	sfs.set(name, &VFile{Mode: fs.ModeDir | 0o755, Size: 4096, ModTime: time.Now(), Owner: owner, Group: owner})
+	return nil
+}
+
+func (sfs *SessionFS) Remove(name string, recursive bool) error {
+	file, ok := sfs.Lstat(name)
+	if !ok {
+		return fs.ErrNotExist
+	}
+	if file.IsDir() {
+		children, _ := sfs.ReadDir(name)
+		if len(children) > 0 && !recursive {
+			return errNotEmpty
+		}
+		for _, child := range children {
+			sfs.Remove(path.Join(name, child), true)
+		}
+	}
+	delete(sfs.overlay, name)
+	sfs.removed[name] = true
+	sfs.generation++
+	return nil
+}
+
+func (sfs *SessionFS) set(name string, file *VFile) {
+	delete(sfs.removed, name)
+	sfs.overlay[name] = file
+	sfs.generation++
+}
+
+// Generation changes whenever the session changes the filesystem.
+func (sfs *SessionFS) Generation() uint64 {
+	return sfs.generation
+}
+
+// Walk calls visit for name and everything below it, depth first in name
+// order.
+func (sfs *SessionFS) Walk(name string, visit func(name string, file *VFile)) {
+	file, ok := sfs.Lstat(name)
+	if !ok {
+		return
+	}
+	visit(name, file)
+	if !file.IsDir() {
+		return
+	}
+	children, _ := sfs.ReadDir(name)
+	for _, child := range children {
+		sfs.Walk(path.Join(name, child), visit)
+	}
+}
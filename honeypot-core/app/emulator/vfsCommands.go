@@ -0,0 +1,696 @@
+package emulator
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/JonathanKoerber/CityUCapstoneMSCS/honeypot-core/app/events"
+)
+
+// InstallFilesystem answers the file tools of shell from sfs so that ls, cat,
+// find, stat and writes agree with each other for the whole session.
+func InstallFilesystem(shell *Shell, sfs *SessionFS) {
+	if _, ok := sfs.Stat(shell.Home); !ok {
+		sfs.Mkdir(shell.Home, true, shell.User)
+	}
+	shell.DirExists = func(dir string) bool {
+		file, ok := sfs.Stat(dir)
+		return ok && file.IsDir()
+	}
+	shell.Redirect = func(file string, output string, appendOutput bool) error {
+		return sfs.WriteFile(file, []byte(output), appendOutput, shell.User)
+	}
+	tools := &fileTools{shell: shell, fs: sfs}
+	if shell.Commands == nil {
+		shell.Commands = make(map[string]func(args []string) (string, uint32))
+	}
+	shell.Commands["ls"] = tools.ls
+	shell.Commands["cat"] = tools.cat
+	shell.Commands["find"] = tools.find
+	shell.Commands["stat"] = tools.stat
+	shell.Commands["touch"] = tools.touch
+	shell.Commands["mkdir"] = tools.mkdir
+	shell.Commands["rm"] = tools.rm
+	shell.Commands["rmdir"] = tools.rmdir
+	shell.Commands["cp"] = tools.cp
+	shell.Commands["mv"] = tools.mv
+	shell.Commands["wget"] = tools.wget
+}
+
+type fileTools struct {
+	shell *Shell
+	fs    *SessionFS
+}
+
+// errorText is the libc message for a filesystem error.
+func errorText(err error) string {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return "No such file or directory"
+	case errors.Is(err, fs.ErrExist):
+		return "File exists"
+	case errors.Is(err, fs.ErrPermission):
+		return "Permission denied"
+	case errors.Is(err, errIsDir):
+		return "Is a directory"
+	case errors.Is(err, errNotDir):
+		return "Not a directory"
+	case errors.Is(err, errNotEmpty):
+		return "Directory not empty"
+	}
+	return err.Error()
+}
+
+// splitFlags separates short options from operands, "--" ends options.
+func splitFlags(args []string) (string, []string) {
+	var flags strings.Builder
+	var operands []string
+	for i, arg := range args {
+		if arg == "--" {
+			operands = append(operands, args[i+1:]...)
+			break
+		}
+		if len(arg) > 1 && arg[0] == '-' && arg[1] != '-' {
+			flags.WriteString(arg[1:])
+			continue
+		}
+		operands = append(operands, arg)
+	}
+	return flags.String(), operands
+}
+
+func (t *fileTools) ls(args []string) (string, uint32) {
+	flags, operands := splitFlags(args)
+	long := strings.Contains(flags, "l")
+	all := strings.Contains(flags, "a")
+	almostAll := strings.Contains(flags, "A")
+	human := strings.Contains(flags, "h")
+	onePerLine := strings.Contains(flags, "1")
+	dirAsFile := strings.Contains(flags, "d")
+	if len(operands) == 0 {
+		operands = []string{"."}
+	}
+
+	var out strings.Builder
+	var status uint32
+	var files []string
+	var dirs []string
+	for _, operand := range operands {
+		file, ok := t.fs.Stat(t.shell.Resolve(operand))
+		if !ok {
+			fmt.Fprintf(&out, "ls: cannot access '%s': No such file or directory\n", operand)
+			status = 2
+			continue
+		}
+		if file.IsDir() && !dirAsFile {
+			dirs = append(dirs, operand)
+		} else {
+			files = append(files, operand)
+		}
+	}
+	sort.Strings(files)
+	sort.Strings(dirs)
+
+	render := func(dir string, names []string) {
+		if long {
+			out.WriteString(t.longListing(dir, names, human, dir != ""))
+		} else if onePerLine {
+			for _, name := range names {
+				out.WriteString(name + "\n")
+			}
+		} else if len(names) > 0 {
+			out.WriteString(strings.Join(names, "  ") + "\n")
+		}
+	}
+	render("", files)
+	for i, operand := range dirs {
+		if len(operands) > 1 {
+			if i > 0 || len(files) > 0 {
+				out.WriteString("\n")
+			}
+			out.WriteString(operand + ":\n")
+		}
+		dir := t.shell.Resolve(operand)
+		names, _ := t.fs.ReadDir(dir)
+		var shown []string
+		if all {
+			shown = append(shown, ".", "..")
+		}
+		for _, name := range names {
+			if strings.HasPrefix(name, ".") && !all && !almostAll {
+				continue
+			}
+			shown = append(shown, name)
+		}
+		render(dir, shown)
+	}
+	return out.String(), status
+}
+
+// longListing renders ls -l lines. With dir set names are relative to it and
+// a total line is printed.
+func (t *fileTools) longListing(dir string, names []string, human bool, total bool) string {
+	type row struct {
+		mode, links, owner, group, size, date, name string
+	}
+	var rows []row
+	var blocks int64
+	widths := make([]int, 5)
+	for _, name := range names {
+		full := t.shell.Resolve(name)
+		if dir != "" {
+			full = path.Join(dir, name)
+		}
+		file, ok := t.fs.Lstat(full)
+		if !ok {
+			continue
+		}
+		blocks += (file.Size + 4095) / 4096 * 4
+		r := row{
+			mode:  modeString(file.Mode),
+			links: "1",
+			owner: file.Owner,
+			group: file.Group,
+			size:  strconv.FormatInt(file.Size, 10),
+			date:  lsDate(file.ModTime),
+			name:  name,
+		}
+		if file.IsDir() {
+			r.links = "2"
+		}
+		if human {
+			r.size = humanSize(file.Size)
+		}
+		if file.Target != "" {
+			r.name += " -> " + file.Target
+		}
+		for i, field := range []string{r.links, r.owner, r.group, r.size, r.date} {
+			if len(field) > widths[i] {
+				widths[i] = len(field)
+			}
+		}
+		rows = append(rows, r)
+	}
+	var out strings.Builder
+	if total {
+		if human {
+			fmt.Fprintf(&out, "total %s\n", humanSize(blocks*1024))
+		} else {
+			fmt.Fprintf(&out, "total %d\n", blocks)
+		}
+	}
+	for _, r := range rows {
+		fmt.Fprintf(&out, "%s %*s %-*s %-*s %*s %s %s\n", r.mode,
+			widths[0], r.links, widths[1], r.owner, widths[2], r.group, widths[3], r.size, r.date, r.name)
+	}
+	return out.String()
+}
+
+func modeString(mode fs.FileMode) string {
+	perm := []byte((mode & fs.ModePerm).String())
+	switch {
+	case mode.IsDir():
+		perm[0] = 'd'
+	case mode&fs.ModeSymlink != 0:
+		perm[0] = 'l'
+	}
+	if mode&fs.ModeSticky != 0 {
+		perm[9] = 't'
+	}
+	return string(perm)
+}
+
+func lsDate(t time.Time) string {
+	if time.Since(t) > 180*24*time.Hour || t.After(time.Now().Add(time.Hour)) {
+		return t.Format("Jan _2  2006")
+	}
+	return t.Format("Jan _2 15:04")
+}
+
+func humanSize(size int64) string {
+	if size < 1024 {
+		return strconv.FormatInt(size, 10)
+	}
+	value := float64(size)
+	for _, unit := range []string{"K", "M", "G", "T"} {
+		value /= 1024
+		if value < 1024 {
+			if value < 10 {
+				return fmt.Sprintf("%.1f%s", value, unit)
+			}
+			return fmt.Sprintf("%.0f%s", value, unit)
+		}
+	}
+	return fmt.Sprintf("%.0fP", value/1024)
+}
+
+func (t *fileTools) cat(args []string) (string, uint32) {
+	_, operands := splitFlags(args)
+	var out strings.Builder
+	var status uint32
+	for _, operand := range operands {
+		content, err := t.fs.ReadFile(t.shell.Resolve(operand))
+		if err != nil {
+			fmt.Fprintf(&out, "cat: %s: %s\n", operand, errorText(err))
+			status = 1
+			continue
+		}
+		out.Write(content)
+	}
+	return out.String(), status
+}
+
+func (t *fileTools) find(args []string) (string, uint32) {
+	var roots []string
+	for len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		roots = append(roots, args[0])
+		args = args[1:]
+	}
+	if len(roots) == 0 {
+		roots = []string{"."}
+	}
+	var namePattern, fileType string
+	ignoreCase := false
+	maxDepth := -1
+	for i := 0; i < len(args); i++ {
+		if i+1 >= len(args) {
+			return fmt.Sprintf("find: missing argument to `%s'\n", args[i]), 1
+		}
+		switch args[i] {
+		case "-name":
+			namePattern = args[i+1]
+		case "-iname":
+			namePattern = strings.ToLower(args[i+1])
+			ignoreCase = true
+		case "-type":
+			fileType = args[i+1]
+		case "-maxdepth":
+			depth, err := strconv.Atoi(args[i+1])
+			if err != nil {
+				return fmt.Sprintf("find: invalid -maxdepth argument '%s'\n", args[i+1]), 1
+			}
+			maxDepth = depth
+		default:
+			return fmt.Sprintf("find: unknown predicate `%s'\n", args[i]), 1
+		}
+		i++
+	}
+
+	var out strings.Builder
+	var status uint32
+	for _, root := range roots {
+		start := t.shell.Resolve(root)
+		if _, ok := t.fs.Lstat(start); !ok {
+			fmt.Fprintf(&out, "find: '%s': No such file or directory\n", root)
+			status = 1
+			continue
+		}
+		t.fs.Walk(start, func(name string, file *VFile) {
+			rel := strings.TrimPrefix(strings.TrimPrefix(name, start), "/")
+			depth := 0
+			if rel != "" {
+				depth = strings.Count(rel, "/") + 1
+			}
+			if maxDepth >= 0 && depth > maxDepth {
+				return
+			}
+			if fileType == "d" && !file.IsDir() || fileType == "f" && !file.Mode.IsRegular() {
+				return
+			}
+			if namePattern != "" {
+				base := path.Base(name)
+				if ignoreCase {
+					base = strings.ToLower(base)
+				}
+				if matched, _ := path.Match(namePattern, base); !matched {
+					return
+				}
+			}
+			shown := root
+			if rel != "" {
+				shown = strings.TrimSuffix(root, "/") + "/" + rel
+			}
+			out.WriteString(shown + "\n")
+		})
+	}
+	return out.String(), status
+}
+
+func (t *fileTools) stat(args []string) (string, uint32) {
+	_, operands := splitFlags(args)
+	if len(operands) == 0 {
+		return "stat: missing operand\nTry 'stat --help' for more information.\n", 1
+	}
+	var out strings.Builder
+	var status uint32
+	for _, operand := range operands {
+		name := t.shell.Resolve(operand)
+		file, ok := t.fs.Lstat(name)
+		if !ok {
+			fmt.Fprintf(&out, "stat: cannot statx '%s': No such file or directory\n", operand)
+			status = 1
+			continue
+		}
+		kind := "regular file"
+		switch {
+		case file.IsDir():
+			kind = "directory"
+		case file.Target != "":
+			kind = "symbolic link"
+			operand += " -> " + file.Target
+		case file.Size == 0:
+			kind = "regular empty file"
+		}
+		links := 1
+		if file.IsDir() {
+			links = 2
+		}
+		inode := fnv.New32a()
+		inode.Write([]byte(name))
+		timestamp := file.ModTime.Format("2006-01-02 15:04:05.000000000 -0700")
+		fmt.Fprintf(&out, "  File: %s\n", operand)
+		fmt.Fprintf(&out, "  Size: %-10d\tBlocks: %-10d IO Block: 4096   %s\n", file.Size, (file.Size+4095)/4096*8, kind)
+		fmt.Fprintf(&out, "Device: 802h/2050d\tInode: %-11d Links: %d\n", inode.Sum32()%4000000, links)
+		fmt.Fprintf(&out, "Access: (%04o/%s)  Uid: (%5d/%8s)   Gid: (%5d/%8s)\n",
+			uint32(file.Mode.Perm()), modeString(file.Mode), t.accountID("/etc/passwd", file.Owner), file.Owner, t.accountID("/etc/group", file.Group), file.Group)
+		fmt.Fprintf(&out, "Access: %s\nModify: %s\nChange: %s\n Birth: -\n", timestamp, timestamp, timestamp)
+	}
+	return out.String(), status
+}
+
+// accountID is a user's or group's ID from the session's /etc/passwd or
+// /etc/group, which the persona seeds, so stat agrees with id.
+func (t *fileTools) accountID(file string, name string) int {
+	if name == "root" {
+		return 0
+	}
+	if accounts, ok := t.fs.Stat(file); ok && !accounts.Stub {
+		for _, line := range strings.Split(string(accounts.Content), "\n") {
+			fields := strings.Split(line, ":")
+			if len(fields) < 3 || fields[0] != name {
+				continue
+			}
+			if id, err := strconv.Atoi(fields[2]); err == nil {
+				return id
+			}
+		}
+	}
+	return 1000
+}
+
+func (t *fileTools) touch(args []string) (string, uint32) {
+	_, operands := splitFlags(args)
+	if len(operands) == 0 {
+		return "touch: missing file operand\nTry 'touch --help' for more information.\n", 1
+	}
+	var out strings.Builder
+	var status uint32
+	for _, operand := range operands {
+		if err := t.fs.Touch(t.shell.Resolve(operand), t.shell.User); err != nil {
+			fmt.Fprintf(&out, "touch: cannot touch '%s': %s\n", operand, errorText(err))
+			status = 1
+		}
+	}
+	return out.String(), status
+}
+
+func (t *fileTools) mkdir(args []string) (string, uint32) {
+	flags, operands := splitFlags(args)
+	if len(operands) == 0 {
+		return "mkdir: missing operand\nTry 'mkdir --help' for more information.\n", 1
+	}
+	var out strings.Builder
+	var status uint32
+	for _, operand := range operands {
+		if err := t.fs.Mkdir(t.shell.Resolve(operand), strings.Contains(flags, "p"), t.shell.User); err != nil {
+			fmt.Fprintf(&out, "mkdir: cannot create directory ‘%s’: %s\n", operand, errorText(err))
+			status = 1
+		}
+	}
+	return out.String(), status
+}
+
+func (t *fileTools) rm(args []string) (string, uint32) {
+	flags, operands := splitFlags(args)
+	recursive := strings.ContainsAny(flags, "rR")
+	force := strings.Contains(flags, "f")
+	if len(operands) == 0 && !force {
+		return "rm: missing operand\nTry 'rm --help' for more information.\n", 1
+	}
+	var out strings.Builder
+	var status uint32
+	for _, operand := range operands {
+		name := t.shell.Resolve(operand)
+		file, ok := t.fs.Lstat(name)
+		switch {
+		case !ok:
+			if !force {
+				fmt.Fprintf(&out, "rm: cannot remove '%s': No such file or directory\n", operand)
+				status = 1
+			}
+		case file.IsDir() && !recursive:
+			fmt.Fprintf(&out, "rm: cannot remove '%s': Is a directory\n", operand)
+			status = 1
+		default:
+			t.fs.Remove(name, true)
+		}
+	}
+	return out.String(), status
+}
+
+func (t *fileTools) rmdir(args []string) (string, uint32) {
+	_, operands := splitFlags(args)
+	var out strings.Builder
+	var status uint32
+	for _, operand := range operands {
+		name := t.shell.Resolve(operand)
+		file, ok := t.fs.Lstat(name)
+		err := fs.ErrNotExist
+		if ok && !file.IsDir() {
+			err = errNotDir
+		} else if ok {
+			err = t.fs.Remove(name, false)
+		}
+		if err != nil {
+			fmt.Fprintf(&out, "rmdir: failed to remove '%s': %s\n", operand, errorText(err))
+			status = 1
+		}
+	}
+	return out.String(), status
+}
+
+// destination resolves the target of cp and mv, into a directory when the
+// target is one. shown is the destination as coreutils prints it.
+func (t *fileTools) destination(source string, target string) (name string, shown string) {
+	name = t.shell.Resolve(target)
+	if file, ok := t.fs.Stat(name); ok && file.IsDir() {
+		return path.Join(name, path.Base(source)), path.Join(target, path.Base(source))
+	}
+	return name, target
+}
+
+// inside is whether name is dir or below it.
+func inside(name string, dir string) bool {
+	return name == dir || dir == "/" || strings.HasPrefix(name, dir+"/")
+}
+
+func (t *fileTools) cp(args []string) (string, uint32) {
+	flags, operands := splitFlags(args)
+	if len(operands) < 2 {
+		return "cp: missing destination file operand\nTry 'cp --help' for more information.\n", 1
+	}
+	recursive := strings.ContainsAny(flags, "rRa")
+	target := operands[len(operands)-1]
+	var out strings.Builder
+	var status uint32
+	for _, source := range operands[:len(operands)-1] {
+		from := t.shell.Resolve(source)
+		file, ok := t.fs.Stat(from)
+		if !ok {
+			fmt.Fprintf(&out, "cp: cannot stat '%s': No such file or directory\n", source)
+			status = 1
+			continue
+		}
+		if file.IsDir() && !recursive {
+			fmt.Fprintf(&out, "cp: -r not specified; omitting directory '%s'\n", source)
+			status = 1
+			continue
+		}
+		to, shown := t.destination(source, target)
+		switch {
+		case to == from:
+			fmt.Fprintf(&out, "cp: '%s' and '%s' are the same file\n", source, shown)
+			status = 1
+			continue
+		case file.IsDir() && inside(to, from):
+			fmt.Fprintf(&out, "cp: cannot copy a directory, '%s', into itself, '%s'\n", source, shown)
+			status = 1
+			continue
+		}
+		if err := t.copyTree(from, to); err != nil {
+			fmt.Fprintf(&out, "cp: cannot create regular file '%s': %s\n", target, errorText(err))
+			status = 1
+		}
+	}
+	return out.String(), status
+}
+
+// copyTree copies from and everything below it to to. The tree is listed
+// before anything is written, so a copy never walks into itself.
+func (t *fileTools) copyTree(from string, to string) error {
+	type entry struct {
+		name string
+		dir  bool
+	}
+	var entries []entry
+	t.fs.Walk(from, func(name string, file *VFile) {
+		entries = append(entries, entry{name: name, dir: file.IsDir()})
+	})
+	for _, entry := range entries {
+		dest := to + strings.TrimPrefix(entry.name, from)
+		if entry.dir {
+			if err := t.fs.Mkdir(dest, true, t.shell.User); err != nil {
+				return err
+			}
+			continue
+		}
+		content, err := t.fs.ReadFile(entry.name)
+		if err != nil {
+			return err
+		}
+		if err := t.fs.WriteFile(dest, content, false, t.shell.User); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *fileTools) mv(args []string) (string, uint32) {
+	_, operands := splitFlags(args)
+	if len(operands) < 2 {
+		return "mv: missing destination file operand\nTry 'mv --help' for more information.\n", 1
+	}
+	target := operands[len(operands)-1]
+	var out strings.Builder
+	var status uint32
+	for _, source := range operands[:len(operands)-1] {
+		from := t.shell.Resolve(source)
+		file, ok := t.fs.Lstat(from)
+		if !ok {
+			fmt.Fprintf(&out, "mv: cannot stat '%s': No such file or directory\n", source)
+			status = 1
+			continue
+		}
+		to, shown := t.destination(source, target)
+		switch {
+		case to == from:
+			fmt.Fprintf(&out, "mv: '%s' and '%s' are the same file\n", source, shown)
+			status = 1
+			continue
+		case file.IsDir() && inside(to, from):
+			fmt.Fprintf(&out, "mv: cannot move '%s' to a subdirectory of itself, '%s'\n", source, shown)
+			status = 1
+			continue
+		}
+		if err := t.copyTree(from, to); err != nil {
+			fmt.Fprintf(&out, "mv: cannot move '%s' to '%s': %s\n", source, target, errorText(err))
+			status = 1
+			continue
+		}
+		t.fs.Remove(from, true)
+	}
+	return out.String(), status
+}
+
+// wget pretends to download a file and leaves an empty file behind, the
+// honeypot never fetches attacker payloads itself.
+func (t *fileTools) wget(args []string) (string, uint32) {
+	var output string
+	var urls []string
+	quiet := false
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "-O" && i+1 < len(args):
+			output = args[i+1]
+			i++
+		case args[i] == "-q":
+			quiet = true
+		case !strings.HasPrefix(args[i], "-"):
+			urls = append(urls, args[i])
+		}
+	}
+	if len(urls) == 0 {
+		return "wget: missing URL\nUsage: wget [OPTION]... [URL]...\n\nTry `wget --help' for more options.\n", 1
+	}
+	var out strings.Builder
+	for _, raw := range urls {
+		if !strings.Contains(raw, "://") {
+			raw = "http://" + raw
+		}
+		parsed, err := url.Parse(raw)
+		if err != nil || parsed.Host == "" {
+			fmt.Fprintf(&out, "%s: Invalid host name.\n", raw)
+			return out.String(), 1
+		}
+		name := output
+		if name == "" {
+			name = path.Base(parsed.Path)
+			if name == "/" || name == "." {
+				name = "index.html"
+			}
+		}
+		if err := t.fs.WriteFile(t.shell.Resolve(name), nil, false, t.shell.User); err != nil {
+			fmt.Fprintf(&out, "%s: %s\n", name, errorText(err))
+			return out.String(), 3
+		}
+		if t.shell.Publish != nil {
+			t.shell.Publish(&events.FileTransfer{
+				User:      t.shell.User,
+				Direction: events.DirectionInbound,
+				URL:       raw,
+				Path:      t.shell.Resolve(name),
+				Tool:      "wget",
+			})
+		}
+		if quiet {
+			continue
+		}
+		host := parsed.Hostname()
+		addr := fakeAddress(host)
+		now := time.Now().Format("2006-01-02 15:04:05")
+		fmt.Fprintf(&out, "--%s--  %s\n", now, raw)
+		fmt.Fprintf(&out, "Resolving %s (%s)... %s\n", host, host, addr)
+		fmt.Fprintf(&out, "Connecting to %s (%s)|%s|:%s... connected.\n", host, host, addr, portOf(parsed))
+		out.WriteString("HTTP request sent, awaiting response... 200 OK\n")
+		out.WriteString("Length: unspecified [application/octet-stream]\n")
+		fmt.Fprintf(&out, "Saving to: ‘%s’\n\n", name)
+		fmt.Fprintf(&out, "%-20s    [ <=>                ]       0  --.-KB/s    in 0s\n\n", name)
+		fmt.Fprintf(&out, "%s (0.00 B/s) - ‘%s’ saved [0]\n\n", now, name)
+	}
+	return out.String(), 0
+}
+
+// fakeAddress gives every host name a stable documentation address.
+func fakeAddress(host string) string {
+	h := fnv.New32a()
+	h.Write([]byte(host))
+	return fmt.Sprintf("203.0.113.%d", h.Sum32()%254+1)
+}
+
+func portOf(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return port
+	}
+	if u.Scheme == "https" {
+		return "443"
+	}
+	return "80"
+}
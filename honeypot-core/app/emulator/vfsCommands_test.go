@@ -0,0 +1,121 @@
+package emulator
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestShell(t *testing.T, user string) (*Shell, *SessionFS) {
+	t.Helper()
+	shell := NewShell(user, "ics-host", nil)
+	sfs := NewSnapshot().Session()
+	persona := DefaultPersona()
+	persona.Users = append(persona.Users, PersonaUser{Name: "engineer", UID: 1001, Groups: []string{"engineer"}})
+	persona.Seed(sfs, user)
+	InstallFilesystem(shell, sfs)
+	return shell, sfs
+}
+
+func TestCopyIntoItself(t *testing.T) {
+	tests := []struct {
+		command string
+		output  string
+	}{
+		{"cp -r a a/b", "cp: cannot copy a directory, 'a', into itself, 'a/b/a'\n"},
+		{"cp -r a a", "cp: cannot copy a directory, 'a', into itself, 'a/a'\n"},
+		{"mv a a/b", "mv: cannot move 'a' to a subdirectory of itself, 'a/b/a'\n"},
+		{"mv a a", "mv: cannot move 'a' to a subdirectory of itself, 'a/a'\n"},
+		{"cp a/f a/f", "cp: 'a/f' and 'a/f' are the same file\n"},
+		{"mv a/f a/f", "mv: 'a/f' and 'a/f' are the same file\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.command, func(t *testing.T) {
+			shell, sfs := newTestShell(t, "admin")
+			shell.Execute("mkdir -p a/b")
+			shell.Execute("touch a/f")
+			output, status := shell.Execute(test.command)
+			if output != test.output || status != 1 {
+				t.Errorf("got %q status %d, want %q status 1", output, status, test.output)
+			}
+			if _, ok := sfs.Stat("/home/admin/a/f"); !ok {
+				t.Errorf("%s lost a/f", test.command)
+			}
+			if _, ok := sfs.Stat("/home/admin/a/b/a"); ok {
+				t.Errorf("%s copied a into itself", test.command)
+			}
+		})
+	}
+}
+
+func TestCopyTree(t *testing.T) {
+	shell, sfs := newTestShell(t, "admin")
+	shell.Execute("mkdir -p a/b")
+	shell.Execute("echo hi > a/b/f")
+	if output, status := shell.Execute("cp -r a c"); output != "" || status != 0 {
+		t.Fatalf("cp -r: %q status %d", output, status)
+	}
+	if content, err := sfs.ReadFile("/home/admin/c/b/f"); err != nil || string(content) != "hi\n" {
+		t.Errorf("copy holds %q, %v", content, err)
+	}
+	if output, status := shell.Execute("mv a c"); output != "" || status != 0 {
+		t.Fatalf("mv: %q status %d", output, status)
+	}
+	if _, ok := sfs.Stat("/home/admin/c/a/b/f"); !ok {
+		t.Error("mv into a directory lost the file")
+	}
+	if _, ok := sfs.Stat("/home/admin/a"); ok {
+		t.Error("mv left the source behind")
+	}
+}
+
+func TestStatUsesPersonaIDs(t *testing.T) {
+	shell, _ := newTestShell(t, "engineer")
+	shell.Execute("touch f")
+	output, _ := shell.Execute("stat f")
+	if !strings.Contains(output, "Uid: ( 1001/engineer)") || !strings.Contains(output, "Gid: ( 1001/engineer)") {
+		t.Errorf("stat does not match id:\n%s", output)
+	}
+}
+
+func TestLoadTarLinksAndLimits(t *testing.T) {
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	files := []struct {
+		header  tar.Header
+		content []byte
+	}{
+		{tar.Header{Name: "etc/plc/config.xml", Typeflag: tar.TypeReg, Mode: 0o644}, []byte("<plc/>")},
+		{tar.Header{Name: "opt/plc/config.xml", Typeflag: tar.TypeLink, Linkname: "etc/plc/config.xml"}, nil},
+		{tar.Header{Name: "opt/plc/current", Typeflag: tar.TypeSymlink, Linkname: "config.xml"}, nil},
+		{tar.Header{Name: "var/log/huge.log", Typeflag: tar.TypeReg, Mode: 0o644}, make([]byte, maxSnapshotContent+1)},
+	}
+	for _, file := range files {
+		file.header.Size = int64(len(file.content))
+		if err := tw.WriteHeader(&file.header); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(file.content)
+	}
+	tw.Close()
+	name := filepath.Join(t.TempDir(), "snapshot.tar")
+	if err := os.WriteFile(name, archive.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := LoadSnapshot(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sfs := snapshot.Session()
+	for _, linked := range []string{"/opt/plc/config.xml", "/opt/plc/current"} {
+		if content, err := sfs.ReadFile(linked); err != nil || string(content) != "<plc/>" {
+			t.Errorf("%s holds %q, %v", linked, content, err)
+		}
+	}
+	if huge, ok := sfs.Stat("/var/log/huge.log"); !ok || !huge.Stub || huge.Content != nil {
+		t.Errorf("a file over maxSnapshotContent should be a stub, got %+v", huge)
+	}
+}
@@ -0,0 +1,115 @@
+package events
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultBufferSize is how many events a Bus holds before dropping.
+const DefaultBufferSize = 1024
+
+// Bus delivers published events to every subscribed sink in the order they
+// were published. Publishing never blocks a protocol server: when the sinks
+// fall behind and the buffer is full new events are dropped and counted.
+// A nil *Bus discards everything.
+type Bus struct {
+	mu      sync.RWMutex
+	sinks   []Sink
+	queue   chan Event
+	closed  bool
+	dropped atomic.Uint64
+	done    chan struct{}
+}
+
+// NewBus starts a bus buffering up to buffer events, 0 uses
+// DefaultBufferSize.
+func NewBus(buffer int) *Bus {
+	if buffer <= 0 {
+		buffer = DefaultBufferSize
+	}
+	bus := &Bus{
+		queue: make(chan Event, buffer),
+		done:  make(chan struct{}),
+	}
+	go bus.dispatch()
+	return bus
+}
+
+// Subscribe adds a sink, it gets the events published from now on.
+func (b *Bus) Subscribe(sink Sink) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sinks = append(b.sinks, sink)
+}
+
+// Publish stamps e with its type and, unless set, the current time and
+// queues it for the sinks.
+func (b *Bus) Publish(e Event) {
+	if b == nil || e == nil {
+		return
+	}
+	header := e.EventHeader()
+	header.Type = e.EventType()
+	if header.Time.IsZero() {
+		header.Time = time.Now().UTC()
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return
+	}
+	select {
+	case b.queue <- e:
+	default:
+		if b.dropped.Add(1)%100 == 1 {
+			log.Printf("Event bus is full, dropped %d events so far", b.dropped.Load())
+		}
+	}
+}
+
+// Dropped is how many events were lost to a full buffer.
+func (b *Bus) Dropped() uint64 {
+	if b == nil {
+		return 0
+	}
+	return b.dropped.Load()
+}
+
+func (b *Bus) dispatch() {
+	defer close(b.done)
+	for e := range b.queue {
+		b.mu.RLock()
+		sinks := b.sinks
+		b.mu.RUnlock()
+		for _, sink := range sinks {
+			if err := sink.Write(e); err != nil {
+				log.Printf("Event sink failed to write %s event: %v", e.EventType(), err)
+			}
+		}
+	}
+}
+
+// Close delivers the queued events and closes the sinks.
+func (b *Bus) Close() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	close(b.queue)
+	b.mu.Unlock()
+	<-b.done
+	var firstErr error
+	for _, sink := range b.sinks {
+		if err := sink.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
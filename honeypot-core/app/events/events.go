@@ -0,0 +1,205 @@
+// Package events is the structured record of everything the honeypot sees.
+// Protocol servers publish typed events on a Bus and sinks store or forward
+// them, so analytics never have to parse the log. It is a module of its own
+// so the plc-node, built apart from the honeypot, shares the same events.
+package events
+
+import (
+	"time"
+)
+
+// Type names an event kind, it is the "type" field of the JSON form.
+type Type string
+
+const (
+	TypeConnectionOpened  Type = "connection_opened"
+	TypeConnectionClosed  Type = "connection_closed"
+	TypeAuthAttempt       Type = "auth_attempt"
+	TypeCommand           Type = "command"
+	TypeFileTransfer      Type = "file_transfer"
+	TypeModbusRead        Type = "modbus_read"
+	TypeModbusWrite       Type = "modbus_write"
+	TypeModbusRequest     Type = "modbus_request"
+	TypeDeviceStateChange Type = "device_state_change"
+	TypeRejectedDatagram  Type = "rejected_datagram"
+)
+
+// Protocols of the servers publishing events.
+const (
+	ProtocolSSH    = "ssh"
+	ProtocolModbus = "modbus"
+	// ProtocolProcess is the exchange of process state between plc-nodes.
+	ProtocolProcess = "process"
+)
+
+// Event is one of the event structs of this package.
+type Event interface {
+	EventHeader() *Header
+	EventType() Type
+}
+
+// Header is shared by every event. Publish fills in Type and Time.
+type Header struct {
+	Type      Type      `json:"type"`
+	Time      time.Time `json:"time"`
+	Protocol  string    `json:"protocol"`
+	SessionID string    `json:"sessionId,omitempty"`
+	// RemoteAddr is the attacker's address, host:port.
+	RemoteAddr string `json:"remoteAddr,omitempty"`
+}
+
+func (h *Header) EventHeader() *Header {
+	return h
+}
+
+// ConnectionOpened is a TCP connection accepted by a protocol server.
+type ConnectionOpened struct {
+	Header
+	LocalAddr string `json:"localAddr"`
+}
+
+func (*ConnectionOpened) EventType() Type { return TypeConnectionOpened }
+
+type ConnectionClosed struct {
+	Header
+	LocalAddr  string  `json:"localAddr"`
+	DurationMs float64 `json:"durationMs"`
+	// Reason is why the connection ended early, such as a failed
+	// handshake. Empty for a normal close.
+	Reason string `json:"reason,omitempty"`
+}
+
+func (*ConnectionClosed) EventType() Type { return TypeConnectionClosed }
+
+// AuthAttempt is a password or public key login attempt.
+type AuthAttempt struct {
+	Header
+	User           string `json:"user"`
+	Method         string `json:"method"`
+	Password       string `json:"password,omitempty"`
+	KeyType        string `json:"keyType,omitempty"`
+	KeyFingerprint string `json:"keyFingerprint,omitempty"`
+	ClientVersion  string `json:"clientVersion,omitempty"`
+	Accepted       bool   `json:"accepted"`
+}
+
+func (*AuthAttempt) EventType() Type { return TypeAuthAttempt }
+
+// Command is a command line an attacker ran.
+type Command struct {
+	Header
+	User    string `json:"user"`
+	Backend string `json:"backend,omitempty"`
+	Command string `json:"command"`
+	// Interactive is set for lines typed into a shell, unset for exec
+	// requests.
+	Interactive bool `json:"interactive"`
+	// ExitStatus is nil when the status is not known, as for lines typed
+	// into a proxied shell.
+	ExitStatus *uint32 `json:"exitStatus,omitempty"`
+}
+
+func (*Command) EventType() Type { return TypeCommand }
+
+// File transfer directions, seen from the honeypot: inbound files land on
+// the host, outbound files leave it.
+const (
+	DirectionInbound  = "inbound"
+	DirectionOutbound = "outbound"
+)
+
+// FileTransfer is a file an attacker fetched onto the host or copied to or
+// from it.
+type FileTransfer struct {
+	Header
+	User      string `json:"user"`
+	Direction string `json:"direction"`
+	// URL is where a download came from, empty for scp.
+	URL  string `json:"url,omitempty"`
+	Path string `json:"path"`
+	Tool string `json:"tool"`
+}
+
+func (*FileTransfer) EventType() Type { return TypeFileTransfer }
+
+// ModbusTransaction is what every Modbus request event records: the
+// request as the client framed it and how the server answered.
+type ModbusTransaction struct {
+	// LocalAddr is the honeypot's address the client connected to.
+	LocalAddr     string `json:"localAddr"`
+	TransactionID uint16 `json:"transactionId"`
+	UnitID        uint8  `json:"unitId"`
+	FunctionCode  uint8  `json:"functionCode"`
+	Function      string `json:"function"`
+	// Exception is the exception the server answered with, such as
+	// "illegal data address", or "no response" when the connection closed
+	// first. Empty for a normal response.
+	Exception     string  `json:"exception,omitempty"`
+	ExceptionCode uint8   `json:"exceptionCode,omitempty"`
+	LatencyMs     float64 `json:"latencyMs"`
+}
+
+// ModbusRead is a read of coils, discrete inputs or registers.
+type ModbusRead struct {
+	Header
+	ModbusTransaction
+	Address  uint16 `json:"address"`
+	Quantity uint16 `json:"quantity"`
+	// Values holds what was returned, coils as 0 and 1.
+	Values []uint16 `json:"values,omitempty"`
+}
+
+func (*ModbusRead) EventType() Type { return TypeModbusRead }
+
+// ModbusWrite is a write of coils or holding registers.
+type ModbusWrite struct {
+	Header
+	ModbusTransaction
+	Address  uint16 `json:"address"`
+	Quantity uint16 `json:"quantity"`
+	// Values holds what was written, coils as 0 and 1.
+	Values []uint16 `json:"values"`
+}
+
+func (*ModbusWrite) EventType() Type { return TypeModbusWrite }
+
+// ModbusRequest is any other function, such as diagnostics, device
+// identification or function codes no device implements.
+type ModbusRequest struct {
+	Header
+	ModbusTransaction
+	// Request and Response are the PDU data after the function code, in
+	// hex.
+	Request  string `json:"request"`
+	Response string `json:"response,omitempty"`
+}
+
+func (*ModbusRequest) EventType() Type { return TypeModbusRequest }
+
+// DeviceStateChange is a field of a simulated device taking a new value,
+// from an attacker's write or the simulation.
+type DeviceStateChange struct {
+	Header
+	DeviceID uint8  `json:"deviceId"`
+	Device   string `json:"device"`
+	Field    string `json:"field"`
+	Old      string `json:"old"`
+	New      string `json:"new"`
+	// Cause is "write" or "simulation".
+	Cause string `json:"cause"`
+}
+
+func (*DeviceStateChange) EventType() Type { return TypeDeviceStateChange }
+
+// RejectedDatagram is a datagram sent to a plc-node's process state port
+// from an address that is not one of its peers, someone trying to spoof a
+// neighbor's state.
+type RejectedDatagram struct {
+	Header
+	LocalAddr string `json:"localAddr"`
+	Size      int    `json:"size"`
+	// Payload is the start of the datagram, as text.
+	Payload string `json:"payload"`
+}
+
+func (*RejectedDatagram) EventType() Type { return TypeRejectedDatagram }
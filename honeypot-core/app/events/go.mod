@@ -0,0 +1,3 @@
+module github.com/JonathanKoerber/CityUCapstoneMSCS/honeypot-core/app/events
+
+go 1.24.2
@@ -0,0 +1,412 @@
+package events
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Point is a measurement in InfluxDB line protocol. Field values may be
+// float64, float32, int, int64, uint16, uint32, bool or string.
+type Point struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      map[string]any
+	Time        time.Time
+}
+
+// Line protocol has no escape for a line break, one would end the point and
+// let whatever follows, such as an attacker's user name, be read as a point
+// of its own. They are written as the two characters \n and \r.
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`, "\r", `\r`)
+	keyEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`, "\r", `\r`)
+	stringEscaper      = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`)
+)
+
+// Line renders the point with nanosecond precision. Empty tags are left out
+// as InfluxDB refuses them, a point without fields renders empty.
+func (p Point) Line() string {
+	if len(p.Fields) == 0 {
+		return ""
+	}
+	var line strings.Builder
+	line.WriteString(measurementEscaper.Replace(p.Measurement))
+	for _, key := range sortedKeys(p.Tags) {
+		if p.Tags[key] == "" {
+			continue
+		}
+		fmt.Fprintf(&line, ",%s=%s", keyEscaper.Replace(key), keyEscaper.Replace(p.Tags[key]))
+	}
+	for i, key := range sortedKeys(p.Fields) {
+		separator := ","
+		if i == 0 {
+			separator = " "
+		}
+		fmt.Fprintf(&line, "%s%s=%s", separator, keyEscaper.Replace(key), fieldValue(p.Fields[key]))
+	}
+	timestamp := p.Time
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	fmt.Fprintf(&line, " %d", timestamp.UnixNano())
+	return line.String()
+}
+
+func fieldValue(value any) string {
+	switch v := value.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32)
+	case int:
+		return strconv.Itoa(v) + "i"
+	case int64:
+		return strconv.FormatInt(v, 10) + "i"
+	case int16:
+		return strconv.Itoa(int(v)) + "i"
+	case uint16:
+		return strconv.Itoa(int(v)) + "i"
+	case uint32:
+		return strconv.FormatUint(uint64(v), 10) + "i"
+	case bool:
+		return strconv.FormatBool(v)
+	case string:
+		return `"` + stringEscaper.Replace(v) + `"`
+	}
+	return `"` + stringEscaper.Replace(fmt.Sprint(value)) + `"`
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// InfluxConfig is where and how an InfluxWriter writes.
+type InfluxConfig struct {
+	// URL is the InfluxDB 1.x HTTP API, such as http://influxdb:8086.
+	URL      string
+	Database string
+	Username string
+	Password string
+	// BatchSize points are sent in one request, 0 uses 500.
+	BatchSize int
+	// FlushInterval sends a partial batch after this long, 0 uses 5s.
+	FlushInterval time.Duration
+	// Retries of a failed batch, 0 uses 3.
+	Retries int
+	// Backoff before the first retry, doubling after that, 0 uses 1s.
+	Backoff time.Duration
+}
+
+// InfluxConfigFromEnv reads INFLUX_URL, INFLUX_DB (defaults to ics_logs),
+// INFLUX_USER and INFLUX_PASSWORD. ok is false when INFLUX_URL is unset.
+func InfluxConfigFromEnv() (InfluxConfig, bool) {
+	config := InfluxConfig{
+		URL:      os.Getenv("INFLUX_URL"),
+		Database: os.Getenv("INFLUX_DB"),
+		Username: os.Getenv("INFLUX_USER"),
+		Password: os.Getenv("INFLUX_PASSWORD"),
+	}
+	if config.Database == "" {
+		config.Database = "ics_logs"
+	}
+	return config, config.URL != ""
+}
+
+// InfluxWriter sends points to InfluxDB's /write endpoint in batches from a
+// background goroutine. A batch that fails with a network error or a 5xx
+// status is retried with backoff, then dropped. Write never blocks, points
+// that do not fit in the buffer are dropped and counted. A nil
+// *InfluxWriter discards everything.
+type InfluxWriter struct {
+	config InfluxConfig
+	client *http.Client
+
+	mu      sync.RWMutex
+	queue   chan Point
+	closed  bool
+	dropped atomic.Uint64
+	done    chan struct{}
+}
+
+func NewInfluxWriter(config InfluxConfig) *InfluxWriter {
+	if config.BatchSize <= 0 {
+		config.BatchSize = 500
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = 5 * time.Second
+	}
+	if config.Retries <= 0 {
+		config.Retries = 3
+	}
+	if config.Backoff <= 0 {
+		config.Backoff = time.Second
+	}
+	w := &InfluxWriter{
+		config: config,
+		client: &http.Client{Timeout: 10 * time.Second},
+		queue:  make(chan Point, 10*config.BatchSize),
+		done:   make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// Write queues points for the next batch.
+func (w *InfluxWriter) Write(points ...Point) {
+	if w == nil {
+		return
+	}
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		return
+	}
+	for _, point := range points {
+		select {
+		case w.queue <- point:
+		default:
+			if w.dropped.Add(1)%100 == 1 {
+				log.Printf("InfluxDB writer is behind, dropped %d points so far", w.dropped.Load())
+			}
+		}
+	}
+}
+
+// Dropped is how many points were lost to a full buffer or failed batches.
+func (w *InfluxWriter) Dropped() uint64 {
+	if w == nil {
+		return 0
+	}
+	return w.dropped.Load()
+}
+
+func (w *InfluxWriter) run() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.config.FlushInterval)
+	defer ticker.Stop()
+	var batch []Point
+	for {
+		select {
+		case point, ok := <-w.queue:
+			if !ok {
+				w.flush(batch)
+				return
+			}
+			batch = append(batch, point)
+			if len(batch) >= w.config.BatchSize {
+				w.flush(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			w.flush(batch)
+			batch = nil
+		}
+	}
+}
+
+// flush sends a batch, retrying failures that may go away.
+func (w *InfluxWriter) flush(batch []Point) {
+	var body bytes.Buffer
+	for _, point := range batch {
+		if line := point.Line(); line != "" {
+			body.WriteString(line)
+			body.WriteByte('\n')
+		}
+	}
+	if body.Len() == 0 {
+		return
+	}
+	backoff := w.config.Backoff
+	for attempt := 0; ; attempt++ {
+		retry, err := w.send(body.Bytes())
+		if err == nil {
+			return
+		}
+		if !retry || attempt == w.config.Retries {
+			w.dropped.Add(uint64(len(batch)))
+			log.Printf("Failed to write %d points to InfluxDB, dropping them: %v", len(batch), err)
+			return
+		}
+		log.Printf("Failed to write to InfluxDB, retrying in %v: %v", backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// send posts a body of lines, retry tells whether a failure is worth
+// retrying.
+func (w *InfluxWriter) send(body []byte) (bool, error) {
+	query := url.Values{"db": {w.config.Database}, "precision": {"ns"}}
+	request, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(w.config.URL, "/")+"/write?"+query.Encode(), bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	request.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if w.config.Username != "" {
+		request.SetBasicAuth(w.config.Username, w.config.Password)
+	}
+	response, err := w.client.Do(request)
+	if err != nil {
+		return true, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 == 2 {
+		return false, nil
+	}
+	message, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+	err = fmt.Errorf("influxdb answered %s: %s", response.Status, strings.TrimSpace(string(message)))
+	return response.StatusCode >= 500 || response.StatusCode == http.StatusTooManyRequests, err
+}
+
+// Close sends the queued points and stops the writer.
+func (w *InfluxWriter) Close() error {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	close(w.queue)
+	w.mu.Unlock()
+	<-w.done
+	return nil
+}
+
+// InfluxSink writes every event as a point, the measurement is the event
+// type.
+type InfluxSink struct {
+	Writer *InfluxWriter
+}
+
+func (s InfluxSink) Write(e Event) error {
+	s.Writer.Write(EventPoint(e))
+	return nil
+}
+
+func (s InfluxSink) Close() error {
+	return s.Writer.Close()
+}
+
+// EventPoint turns an event into a point. What is grouped by becomes a tag,
+// everything else a field; count is always 1 so events can be summed. What
+// attackers choose freely, their address and user names, are fields, as
+// every new tag value is a new series.
+func EventPoint(e Event) Point {
+	header := e.EventHeader()
+	point := Point{
+		Measurement: string(e.EventType()),
+		Tags:        map[string]string{"protocol": header.Protocol},
+		Fields:      map[string]any{"count": 1},
+		Time:        header.Time,
+	}
+	if host := remoteHost(header.RemoteAddr); host != "" {
+		point.Fields["remote_host"] = host
+	}
+	if header.SessionID != "" {
+		point.Fields["session_id"] = header.SessionID
+	}
+	switch event := e.(type) {
+	case *ConnectionOpened:
+		point.Tags["local_addr"] = event.LocalAddr
+	case *ConnectionClosed:
+		point.Tags["local_addr"] = event.LocalAddr
+		point.Fields["duration_ms"] = event.DurationMs
+		if event.Reason != "" {
+			point.Fields["reason"] = event.Reason
+		}
+	case *AuthAttempt:
+		point.Fields["user"] = event.User
+		point.Tags["method"] = event.Method
+		point.Tags["accepted"] = strconv.FormatBool(event.Accepted)
+		point.Fields["password"] = event.Password
+		point.Fields["key_fingerprint"] = event.KeyFingerprint
+		point.Fields["client_version"] = event.ClientVersion
+	case *Command:
+		point.Fields["user"] = event.User
+		point.Tags["backend"] = event.Backend
+		point.Tags["interactive"] = strconv.FormatBool(event.Interactive)
+		point.Fields["command"] = event.Command
+		if event.ExitStatus != nil {
+			point.Fields["exit_status"] = *event.ExitStatus
+		}
+	case *FileTransfer:
+		point.Fields["user"] = event.User
+		point.Tags["direction"] = event.Direction
+		point.Tags["tool"] = event.Tool
+		point.Fields["url"] = event.URL
+		point.Fields["path"] = event.Path
+	case *ModbusRead:
+		modbusFields(&point, event.ModbusTransaction)
+		point.Fields["address"] = event.Address
+		point.Fields["quantity"] = event.Quantity
+		registerField(&point, event.Values)
+	case *ModbusWrite:
+		modbusFields(&point, event.ModbusTransaction)
+		point.Fields["address"] = event.Address
+		point.Fields["quantity"] = event.Quantity
+		registerField(&point, event.Values)
+	case *ModbusRequest:
+		modbusFields(&point, event.ModbusTransaction)
+		point.Fields["request"] = event.Request
+		point.Fields["response"] = event.Response
+	case *DeviceStateChange:
+		point.Tags["device_id"] = strconv.Itoa(int(event.DeviceID))
+		point.Tags["device"] = event.Device
+		point.Tags["field"] = event.Field
+		point.Tags["cause"] = event.Cause
+		point.Fields["old"] = event.Old
+		point.Fields["new"] = event.New
+	case *RejectedDatagram:
+		point.Tags["local_addr"] = event.LocalAddr
+		point.Fields["size"] = event.Size
+		point.Fields["payload"] = event.Payload
+	}
+	return point
+}
+
+func modbusFields(point *Point, transaction ModbusTransaction) {
+	point.Tags["unit_id"] = strconv.Itoa(int(transaction.UnitID))
+	point.Tags["function"] = transaction.Function
+	point.Tags["exception"] = transaction.Exception
+	point.Fields["function_code"] = int(transaction.FunctionCode)
+	point.Fields["latency_ms"] = transaction.LatencyMs
+}
+
+func registerField(point *Point, values []uint16) {
+	if len(values) == 0 {
+		return
+	}
+	text := make([]string, len(values))
+	for i, value := range values {
+		text[i] = strconv.Itoa(int(value))
+	}
+	point.Fields["values"] = strings.Join(text, ",")
+}
+
+func remoteHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
@@ -0,0 +1,177 @@
+package events
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// influxServer records the bodies posted to /write and answers with the
+// statuses in turn, the last one for every later request.
+type influxServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	bodies   []string
+}
+
+func newInfluxServer(t *testing.T, statuses ...int) *influxServer {
+	s := &influxServer{statuses: statuses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/write" || r.URL.Query().Get("db") != "ics_logs" {
+			t.Errorf("unexpected request %s", r.URL)
+		}
+		body, _ := io.ReadAll(r.Body)
+		s.mu.Lock()
+		s.bodies = append(s.bodies, string(body))
+		status := s.statuses[0]
+		if len(s.statuses) > 1 {
+			s.statuses = s.statuses[1:]
+		}
+		s.mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *influxServer) requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.bodies...)
+}
+
+func (s *influxServer) writer(batchSize int) *InfluxWriter {
+	return NewInfluxWriter(InfluxConfig{
+		URL:           s.URL,
+		Database:      "ics_logs",
+		BatchSize:     batchSize,
+		FlushInterval: time.Hour,
+		Retries:       2,
+		Backoff:       time.Millisecond,
+	})
+}
+
+func testPoints(n int) []Point {
+	points := make([]Point, n)
+	for i := range points {
+		points[i] = Point{Measurement: "plc_telemetry", Fields: map[string]any{"reading": i}, Time: time.Unix(0, int64(i))}
+	}
+	return points
+}
+
+func TestInfluxWriterBatches(t *testing.T) {
+	server := newInfluxServer(t, http.StatusNoContent)
+	writer := server.writer(2)
+	writer.Write(testPoints(5)...)
+	writer.Close()
+	var lines []int
+	for _, body := range server.requests() {
+		lines = append(lines, strings.Count(body, "\n"))
+	}
+	if len(lines) != 3 || lines[0] != 2 || lines[1] != 2 || lines[2] != 1 {
+		t.Errorf("got batches of %v lines, want [2 2 1]", lines)
+	}
+	if writer.Dropped() != 0 {
+		t.Errorf("dropped %d points", writer.Dropped())
+	}
+}
+
+func TestInfluxWriterRetries(t *testing.T) {
+	server := newInfluxServer(t, http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusNoContent)
+	writer := server.writer(10)
+	writer.Write(testPoints(3)...)
+	writer.Close()
+	requests := server.requests()
+	if len(requests) != 3 {
+		t.Fatalf("sent %d requests, want 3", len(requests))
+	}
+	if requests[0] != requests[2] {
+		t.Errorf("the retry sent another body:\n%s\n%s", requests[0], requests[2])
+	}
+	if writer.Dropped() != 0 {
+		t.Errorf("dropped %d points", writer.Dropped())
+	}
+}
+
+func TestInfluxWriterGivesUp(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		requests int
+	}{
+		// a bad point is not retried, it would fail again
+		{"bad request", http.StatusBadRequest, 1},
+		{"server error", http.StatusInternalServerError, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newInfluxServer(t, test.status)
+			writer := server.writer(10)
+			writer.Write(testPoints(4)...)
+			writer.Close()
+			if requests := len(server.requests()); requests != test.requests {
+				t.Errorf("sent %d requests, want %d", requests, test.requests)
+			}
+			if writer.Dropped() != 4 {
+				t.Errorf("dropped %d points, want 4", writer.Dropped())
+			}
+		})
+	}
+}
+
+func TestPointLineEscapes(t *testing.T) {
+	tests := []struct {
+		name  string
+		point Point
+		want  string
+	}{
+		{
+			"tag",
+			Point{Measurement: "auth_attempt", Tags: map[string]string{"method": "password\nevil,a=b x=1"}, Fields: map[string]any{"count": 1}},
+			`auth_attempt,method=password\nevil\,a\=b\ x\=1 count=1i 1`,
+		},
+		{
+			"measurement",
+			Point{Measurement: "cmd\r\nevil x", Fields: map[string]any{"count": 1}},
+			`cmd\r\nevil\ x count=1i 1`,
+		},
+		{
+			"string field",
+			Point{Measurement: "command", Fields: map[string]any{"command": "echo \"a\\b\"\nreboot"}},
+			`command command="echo \"a\\b\"\nreboot" 1`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.point.Time = time.Unix(0, 1)
+			if got := test.point.Line(); got != test.want {
+				t.Errorf("got  %s\nwant %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestEventPointKeepsAttackerInputOutOfTags(t *testing.T) {
+	event := &AuthAttempt{
+		Header: Header{Protocol: ProtocolSSH, RemoteAddr: "203.0.113.7:40022"},
+		User:   "root\nauth_attempt,protocol=ssh accepted=true",
+		Method: "password",
+	}
+	point := EventPoint(event)
+	for _, key := range []string{"user", "remote_host"} {
+		if _, ok := point.Tags[key]; ok {
+			t.Errorf("%s is a tag", key)
+		}
+		if _, ok := point.Fields[key]; !ok {
+			t.Errorf("%s is not a field", key)
+		}
+	}
+	if line := point.Line(); strings.ContainsAny(line, "\r\n") {
+		t.Errorf("the line breaks: %q", line)
+	}
+}
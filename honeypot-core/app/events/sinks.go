@@ -0,0 +1,115 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// Sink receives every event published on a Bus, one at a time from the
+// bus's dispatch goroutine.
+type Sink interface {
+	Write(e Event) error
+	Close() error
+}
+
+// SinkFunc subscribes a function, for in-process consumers.
+type SinkFunc func(e Event) error
+
+func (f SinkFunc) Write(e Event) error { return f(e) }
+
+func (f SinkFunc) Close() error { return nil }
+
+// JSONLSink writes every event as a line of JSON.
+type JSONLSink struct {
+	out io.WriteCloser
+}
+
+// NewJSONLSink appends to the file at path.
+func NewJSONLSink(path string) (*JSONLSink, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("opening event log: %w", err)
+	}
+	return &JSONLSink{out: file}, nil
+}
+
+func (s *JSONLSink) Write(e Event) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = s.out.Write(append(line, '\n'))
+	return err
+}
+
+func (s *JSONLSink) Close() error {
+	return s.out.Close()
+}
+
+// LogSink writes every event to the standard logger.
+type LogSink struct{}
+
+func (LogSink) Write(e Event) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	log.Printf("event %s", line)
+	return nil
+}
+
+func (LogSink) Close() error { return nil }
+
+// Sink names for EVENT_SINKS.
+const (
+	SinkJSONL  = "jsonl"
+	SinkLog    = "log"
+	SinkInflux = "influx"
+)
+
+// NewBusFromEnv starts a bus with the sinks named in the environment:
+//
+//	EVENT_SINKS  comma separated sinks, defaults to defaultSinks, "none" disables
+//	EVENT_LOG    file of the jsonl sink, defaults to events.jsonl
+//
+// The influx sink is configured as in InfluxConfigFromEnv.
+func NewBusFromEnv(defaultSinks string) (*Bus, error) {
+	bus := NewBus(0)
+	names := os.Getenv("EVENT_SINKS")
+	if names == "" {
+		names = defaultSinks
+	}
+	for _, name := range strings.Split(names, ",") {
+		switch name = strings.TrimSpace(name); name {
+		case "", "none":
+		case SinkJSONL:
+			path := os.Getenv("EVENT_LOG")
+			if path == "" {
+				path = "events.jsonl"
+			}
+			sink, err := NewJSONLSink(path)
+			if err != nil {
+				bus.Close()
+				return nil, err
+			}
+			bus.Subscribe(sink)
+		case SinkLog:
+			bus.Subscribe(LogSink{})
+		case SinkInflux:
+			config, ok := InfluxConfigFromEnv()
+			if !ok {
+				bus.Close()
+				return nil, fmt.Errorf("event sink influx needs INFLUX_URL")
+			}
+			bus.Subscribe(InfluxSink{Writer: NewInfluxWriter(config)})
+		default:
+			bus.Close()
+			return nil, fmt.Errorf("unknown event sink %q", name)
+		}
+	}
+	return bus, nil
+}
@@ -1,10 +1,16 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"github.com/JonathanKoerber/CityUCapstoneMSCS/honeypot-core/app/emulator"
+	"github.com/JonathanKoerber/CityUCapstoneMSCS/honeypot-core/app/events"
 	"github.com/JonathanKoerber/CityUCapstoneMSCS/honeypot-core/app/server"
 	"log"
 	"net"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 // TODO move env to docker env
@@ -74,13 +80,21 @@ func main() {
 	//	log.Printf("Model found: %s\n", modelName)
 	//}
 	//// -------------------------- Emulator Context ----------------------------
-	store := emulator.Store{}
+	generator, embedder, err := emulator.NewLLMFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to set up LLM provider: %v", err)
+	}
+	store := emulator.Store{Embedder: embedder}
 	if err := store.Init(); err != nil {
 		log.Printf("Failed to init store: %v", err)
 	}
+	if err := store.Probe(); err != nil {
+		log.Printf("Failed to probe embedder: %v", err)
+	}
 	// set up store
 	// register emulators
 	sshEmulator := emulator.NewSSHEmulator()
+	sshEmulator.Generator = generator
 	if err := sshEmulator.Init(&store); err != nil {
 
 		log.Fatalf("Failed to init ssh emulator: %v", err)
@@ -89,44 +103,79 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to get SSH context: %v", err)
 	}
-	err = emulator.EmbedContext(sshContext, store)
-
+	// every protocol server publishes what it sees here
+	eventBus, err := events.NewBusFromEnv(events.SinkJSONL)
 	if err != nil {
-		log.Fatalf("Failed to embed context: %v", err)
+		log.Fatalf("Failed to set up event sinks: %v", err)
 	}
 	// Start and run protocol Servers
-	log.Println("Data embedded")
-	sshServer, err := server.NewSSHServer(2222)
+	sshServers, err := server.NewSSHServers(2222)
 	if err != nil {
 		log.Fatalf("Failed init server: %v", err)
 	}
-	sshServer.Start()
-	log.Println("Server started getting ready to accept connections")
-	inComingChan := make(chan net.Conn, 100)
-	go func() {
-		log.Println("Listening for incoming connections")
-		for {
-			log.Println("Waiting for incoming connection")
-			inComing, err := sshServer.Listener.Accept()
-			if err != nil {
-				log.Printf("Failed to accept incomming socket: %v", err)
-				continue
-			}
-			inComingChan <- inComing
+	// the listeners share the filesystem and cache, only their personas
+	// and backends differ
+	backendConfig := sshServers[0].Backend
+	var personas []*emulator.Persona
+	for _, sshServer := range sshServers {
+		personas = append(personas, sshServer.Persona)
+	}
+	if err := sshEmulator.LoadFilesystem(backendConfig.Filesystem); err != nil {
+		log.Fatalf("Failed to load emulated filesystem: %v", err)
+	}
+	if err := sshEmulator.LoadCache(backendConfig, personas...); err != nil {
+		log.Fatalf("Failed to load response cache: %v", err)
+	}
+	// EMBED_IN_BACKGROUND=true serves while the context is embedded, the
+	// first sessions then get answers with less or no context
+	embedContext := func() {
+		result, err := emulator.EmbedContext(context.Background(), sshContext, store, emulator.EmbedOptions{})
+		if err != nil {
+			log.Printf("Failed to embed context, answering without it: %v", err)
+			return
 		}
-		log.Println("Closing incoming connections")
-	}()
-	go func() {
-		log.Println("Listening for outgoing connections from inComming Channels")
-		sshEmulator := emulator.NewSSHEmulator()
-		sshEmulator.Init(&store)
-		for conn := range inComingChan {
-			go sshServer.HandleConn(conn, *sshEmulator)
+		log.Printf("Data embedded: %v", result)
+		// answers cached before were given from another context
+		if result.Embedded > 0 || result.Deleted > 0 {
+			sshEmulator.Cache.Invalidate("")
 		}
-		log.Println("Done from incoming Channels")
-	}()
-	if err != nil {
-		log.Fatalf("Failed to create server ssh server: %v", err)
+	}
+	if os.Getenv("EMBED_IN_BACKGROUND") == "true" {
+		go embedContext()
+	} else {
+		embedContext()
+	}
+	for _, sshServer := range sshServers {
+		sshServer.Events = eventBus
+		sshServer.Start()
+		if sshServer.Listener == nil {
+			log.Fatalf("Failed to create ssh server on port %d", sshServer.Port)
+		}
+		log.Println("Server started getting ready to accept connections")
+		inComingChan := make(chan net.Conn, 100)
+		go func() {
+			log.Println("Listening for incoming connections")
+			for {
+				log.Println("Waiting for incoming connection")
+				inComing, err := sshServer.Listener.Accept()
+				if errors.Is(err, net.ErrClosed) {
+					close(inComingChan)
+					return
+				}
+				if err != nil {
+					log.Printf("Failed to accept incomming socket: %v", err)
+					continue
+				}
+				inComingChan <- inComing
+			}
+		}()
+		go func() {
+			log.Println("Listening for outgoing connections from inComming Channels")
+			for conn := range inComingChan {
+				go sshServer.HandleConn(conn, *sshEmulator)
+			}
+			log.Println("Done from incoming Channels")
+		}()
 	}
 	//ics := ics_node.NewICS()
 	//modbusDevice := ics_node.DeviceConfig{
@@ -145,5 +194,16 @@ func main() {
 	// err = ics.BuildAndRunContainer(ctx, modbusDevice)
 	// if err != nil { log.Fatalf("Failed to build container: %v", err) }
 	//fmt.Println("Servers running...")
-	select {}
+
+	// serve until docker stops the container, then send the queued events
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	<-ctx.Done()
+	log.Println("Shutting down")
+	for _, sshServer := range sshServers {
+		sshServer.Stop()
+	}
+	if err := eventBus.Close(); err != nil {
+		log.Printf("Failed to close event sinks: %v", err)
+	}
 }
@@ -2,7 +2,12 @@ module main
 
 go 1.24.2
 
+require github.com/goburrow/serial v0.1.0 // indirect
+
 require (
-	github.com/goburrow/serial v0.1.0 // indirect
-	github.com/simonvetter/modbus v1.6.3 // indirect
+	github.com/JonathanKoerber/CityUCapstoneMSCS/honeypot-core/app/events v0.0.0
+	github.com/simonvetter/modbus v1.6.3
 )
+
+// the events module is shared with the honeypot
+replace github.com/JonathanKoerber/CityUCapstoneMSCS/honeypot-core/app/events => ../events
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
 	"log"
-	"time"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"main/modbusServer"
 )
@@ -10,20 +13,29 @@ import (
 func main() {
 	log.Printf("Starting Modbus TCP Server")
 	server, handler := modbusServer.NewModbusTCPServer(502)
-	server.Start()
+	scheduler, err := modbusServer.NewSchedulerFromEnv(handler)
+	if err != nil {
+		log.Fatalf("Error setting up the simulation: %v", err)
+	}
+	if err := server.Start(); err != nil {
+		log.Fatalf("Error starting Modbus server: %v", err)
+	}
+	if err := handler.Audit.Start(); err != nil {
+		log.Fatalf("Error starting Modbus audit: %v", err)
+	}
 	log.Printf("Server Modbus running ...")
-	// get the server running.
 
-	ticker := time.NewTicker(2 * time.Second)
-	defer ticker.Stop()
-	for _, device := range handler.Device {
+	// run the simulation until docker stops the container
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	scheduler.Run(ctx)
 
-		for {
-			select {
-			case <-ticker.C:
-				device.SimulateActivity()
-			}
-		}
-		select {}
+	log.Printf("Shutting down")
+	if err := handler.Audit.Stop(); err != nil {
+		log.Printf("Error stopping Modbus audit: %v", err)
+	}
+	if err := server.Stop(); err != nil {
+		log.Printf("Error stopping Modbus server: %v", err)
 	}
+	handler.Close()
 }
@@ -1,9 +1,13 @@
 package modbusServer
 
 import (
+	"fmt"
 	"log"
 	"math/rand"
 	"strconv"
+	"time"
+
+	"github.com/JonathanKoerber/CityUCapstoneMSCS/honeypot-core/app/events"
 )
 
 type ModbusDevice struct {
@@ -13,18 +17,37 @@ type ModbusDevice struct {
 	active      bool
 	deviceFault bool
 	manualStop  bool
+	// manualMode takes the device out of automatic control, it runs only
+	// when started and a standby device no longer waits for its neighbors.
+	manualMode bool
+	// emergencyStop latches on a safety event and holds the device down
+	// until a fault reset finds the event over.
+	emergencyStop bool
+
+	// the setpoint and limits keep what was written, a register with a
+	// scale can set tenths
+	target float64
 
-	target int16
+	lowerBound float64
+	lowerWarn  float64
+	upperBound float64
+	upperWarn  float64
 
-	lowerBound int16
-	lowerWarn  int16
-	upperBound int16
-	upperWarn  int16
+	reading float64
 
-	reading int16
+	started time.Time
+	// tables is the compiled register map.
+	tables  map[string]*registerTable
+	process *Process
+	rng     *rand.Rand
+	// neighbors are the devices whose state the process reads.
+	neighbors []uint8
+	// running is whether the process ran on the last step, a standby
+	// device can be commanded to run and still wait.
+	running bool
 }
 
-// coil map
+// coil map, the control map of devices without a register map
 const (
 	CoilOnline     = 0
 	CoilFault      = 1
@@ -35,93 +58,328 @@ const (
 	CoilLowerWarn  = 5
 	CoilUpperWarn  = 6
 	CoilUpperBound = 7
+
+	// commands, writing 1 acts and they read back 0
+	CoilStart      = 8
+	CoilStop       = 9
+	CoilFaultReset = 10
+
+	CoilManualMode = 11
 )
 
-// ---- GET VAL FROM ENV
-func NewModbusDeviceFromContext(context map[string]string) (*ModbusDevice, error) {
+// DeviceConfig is one device of a Device-Config file. Numbers are written
+// as strings.
+type DeviceConfig struct {
+	DeviceID   string         `json:"deviceId"`
+	DeviceName string         `json:"deviceName"`
+	LowerBound string         `json:"lowerBound"`
+	LowerWarn  string         `json:"lowerWarn"`
+	UpperBound string         `json:"upperBound"`
+	UpperWarn  string         `json:"upperWarn"`
+	Target     string         `json:"target"`
+	MetaData   DeviceMetaData `json:"metaData"`
+	// Registers is what the device exposes over Modbus, devices without
+	// one get the default state coils and reading register.
+	Registers *RegisterMap `json:"registers"`
+	// Process is the physics behind the reading, devices without one lag
+	// toward their target.
+	Process *ProcessConfig `json:"process"`
+}
+
+type DeviceMetaData struct {
+	Context string `json:"context"`
+	// ProcessNeighbors are the ids of the devices this one's process
+	// depends on, see ProcessGraph.
+	ProcessNeighbors []string `json:"processNeighbors"`
+}
+
+func NewModbusDeviceFromConfig(config DeviceConfig) (*ModbusDevice, error) {
 
 	device := new(ModbusDevice)
+	device.online = true
 	device.active = true
 	device.deviceFault = false
 	device.manualStop = false
+	device.started = time.Now()
+	device.rng = rand.New(rand.NewSource(device.started.UnixNano()))
 
-	if val, ok := context["deviceId"]; ok {
-		log.Printf("Device ID: %v", val)
-		id, err := strconv.Atoi(val)
-		if err != nil {
-			return nil, err
-		}
-		device.deviceID = uint8(id)
-	}
-	if val, ok := context["displayName"]; ok {
-		device.displayName = val
+	log.Printf("Device ID: %v", config.DeviceID)
+	id, err := strconv.ParseUint(config.DeviceID, 10, 8)
+	if err != nil {
+		return nil, fmt.Errorf("device id %q: %w", config.DeviceID, err)
 	}
-	if val, ok := context["lowerBound"]; ok {
-		lowerBound, err := strconv.Atoi(val)
-		device.lowerBound = int16(lowerBound)
+	device.deviceID = uint8(id)
+	device.displayName = config.DeviceName
+	for _, neighbor := range config.MetaData.ProcessNeighbors {
+		id, err := strconv.ParseUint(neighbor, 10, 8)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("device %d process neighbor %q: %w", device.deviceID, neighbor, err)
 		}
-	}
-	if val, ok := context["lowerWarn"]; ok {
-		lowerWarn, err := strconv.Atoi(val)
-		if err != nil {
-			return nil, err
+		if uint8(id) != device.deviceID {
+			device.neighbors = append(device.neighbors, uint8(id))
 		}
-		device.lowerWarn = int16(lowerWarn)
 	}
-	if val, ok := context["upperBound"]; ok {
-		upperBound, err := strconv.Atoi(val)
-		if err != nil {
-			return nil, err
-		}
-		device.upperBound = int16(upperBound)
+
+	values := []struct {
+		name  string
+		text  string
+		field *float64
+	}{
+		{"lowerBound", config.LowerBound, &device.lowerBound},
+		{"lowerWarn", config.LowerWarn, &device.lowerWarn},
+		{"upperBound", config.UpperBound, &device.upperBound},
+		{"upperWarn", config.UpperWarn, &device.upperWarn},
+		{"target", config.Target, &device.target},
 	}
-	if val, ok := context["upperWarn"]; ok {
-		upperWarn, err := strconv.Atoi(val)
-		if err != nil {
-			return nil, err
+	for _, value := range values {
+		if value.text == "" {
+			continue
 		}
-		device.upperWarn = int16(upperWarn)
-	}
-	if val, ok := context["target"]; ok {
-		target, err := strconv.Atoi(val)
+		number, err := strconv.ParseFloat(value.text, 64)
 		if err != nil {
-			device.target = int16(target)
+			return nil, fmt.Errorf("device %d %s: %w", device.deviceID, value.name, err)
 		}
+		*value.field = number
+	}
 
+	registers := config.Registers
+	if registers == nil {
+		registers = defaultRegisterMap()
+	}
+	device.tables, err = registers.compile()
+	if err != nil {
+		return nil, fmt.Errorf("device %d registers: %w", device.deviceID, err)
+	}
+	process := config.Process
+	if process == nil {
+		process = defaultProcess()
+	}
+	device.process, err = NewProcess(*process)
+	if err != nil {
+		return nil, fmt.Errorf("device %d: %w", device.deviceID, err)
 	}
 	return device, nil
 }
 
-// read state values to a [100]bool
+// read state values to a [100]bool, an alarm is set while the reading is
+// past its limit
 func (device *ModbusDevice) WriteStateCoils() ([100]bool, error) {
 	var coilState [100]bool
 	coilState[CoilOnline] = device.online
 	coilState[CoilFault] = device.deviceFault
 	coilState[CoilInuse] = device.active
 	coilState[CoilManualStop] = device.manualStop
-	coilState[CoilLowerBound] = device.lowerBound < device.reading
-	coilState[CoilLowerWarn] = device.lowerWarn < device.reading
-	coilState[CoilUpperBound] = device.upperBound > device.reading
-	coilState[CoilUpperWarn] = device.upperWarn > device.reading
+	coilState[CoilLowerBound] = device.reading < device.lowerBound
+	coilState[CoilLowerWarn] = device.reading < device.lowerWarn
+	coilState[CoilUpperWarn] = device.reading > device.upperWarn
+	coilState[CoilUpperBound] = device.reading > device.upperBound
+	coilState[CoilManualMode] = device.manualMode
 	return coilState, nil
 }
 
-func (device *ModbusDevice) ReadStateCoils(coils [100]bool) error {
-	device.active = coils[CoilOnline]
-	device.deviceFault = coils[CoilFault]
-	device.manualStop = coils[CoilManualStop]
+// deviceVariables are the names Variable knows, and whether SetVariable
+// may change them. Bools are 0 and 1.
+var deviceVariables = map[string]bool{
+	"reading":    true,
+	"target":     true,
+	"lowerBound": true,
+	"lowerWarn":  true,
+	"upperBound": true,
+	"upperWarn":  true,
+	"online":     true,
+	"active":     true,
+	"manualStop": true,
+	"manualMode": true,
+	// commands, writing 1 starts, stops or resets the fault and they read 0
+	"start":      true,
+	"stop":       true,
+	"faultReset": true,
+	// a fault latches until it is reset, as does the emergency stop
+	"fault":         false,
+	"emergencyStop": false,
+	// whether the process is running, a standby device waits even when
+	// commanded to run
+	"running":         false,
+	"lowerBoundAlarm": false,
+	"lowerWarnAlarm":  false,
+	"upperWarnAlarm":  false,
+	"upperBoundAlarm": false,
+	// seconds since the device started
+	"uptime": false,
+	// the process model's measurements, speed and heaterDuty in percent
+	"speed":       false,
+	"flow":        false,
+	"pressure":    false,
+	"level":       false,
+	"temperature": false,
+	"heaterDuty":  false,
+	// the tank's level switches
+	"highLevel": false,
+	"lowLevel":  false,
+}
 
-	// Optional — if Inuse is treated as a separate state:
-	deviceInUse := coils[CoilInuse]
-	_ = deviceInUse // use this value if you have a field or behavior to attach
+// Variable is the value of a simulated variable a register can be bound
+// to.
+func (device *ModbusDevice) Variable(name string) (float64, bool) {
+	coils, _ := device.WriteStateCoils()
+	switch name {
+	case "reading":
+		return device.reading, true
+	case "target":
+		return device.target, true
+	case "lowerBound":
+		return device.lowerBound, true
+	case "lowerWarn":
+		return device.lowerWarn, true
+	case "upperBound":
+		return device.upperBound, true
+	case "upperWarn":
+		return device.upperWarn, true
+	case "online":
+		return boolValue(device.online), true
+	case "active":
+		return boolValue(device.active), true
+	case "fault":
+		return boolValue(device.deviceFault), true
+	case "emergencyStop":
+		return boolValue(device.emergencyStop), true
+	case "manualStop":
+		return boolValue(device.manualStop), true
+	case "manualMode":
+		return boolValue(device.manualMode), true
+	case "start", "stop", "faultReset":
+		return 0, true
+	case "running":
+		return boolValue(device.running), true
+	case "lowerBoundAlarm":
+		return boolValue(coils[CoilLowerBound]), true
+	case "lowerWarnAlarm":
+		return boolValue(coils[CoilLowerWarn]), true
+	case "upperWarnAlarm":
+		return boolValue(coils[CoilUpperWarn]), true
+	case "upperBoundAlarm":
+		return boolValue(coils[CoilUpperBound]), true
+	case "uptime":
+		return time.Since(device.started).Seconds(), true
+	}
+	return device.process.Variable(name)
+}
 
+// SetVariable changes a writable variable, as a register write does.
+func (device *ModbusDevice) SetVariable(name string, value float64) error {
+	switch name {
+	case "reading":
+		device.reading = value
+	case "target":
+		device.target = value
+	case "lowerBound":
+		device.lowerBound = value
+	case "lowerWarn":
+		device.lowerWarn = value
+	case "upperBound":
+		device.upperBound = value
+	case "upperWarn":
+		device.upperWarn = value
+	case "online":
+		device.online = value != 0
+	case "active":
+		device.active = value != 0
+	case "manualStop":
+		device.manualStop = value != 0
+	case "manualMode":
+		device.manualMode = value != 0
+	case "start":
+		if value == 0 {
+			break
+		}
+		if device.deviceFault || device.emergencyStop {
+			log.Printf("Device %d ignored a start while faulted", device.deviceID)
+			break
+		}
+		device.ManualStart()
+	case "stop":
+		if value != 0 {
+			device.ManualStop()
+		}
+	case "faultReset":
+		if value == 0 {
+			break
+		}
+		device.deviceFault = false
+		if !device.emergencyStop {
+			break
+		}
+		if event := device.safetyEvent(); event != "" {
+			log.Printf("Device %d emergency stop stays latched: %s", device.deviceID, event)
+			break
+		}
+		device.emergencyStop = false
+	default:
+		if _, ok := deviceVariables[name]; ok {
+			return fmt.Errorf("variable %s is read only", name)
+		}
+		return fmt.Errorf("unknown variable %s", name)
+	}
 	return nil
 }
 
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// State is the device's fields as text, for spotting changes.
+func (device *ModbusDevice) State() map[string]string {
+	return map[string]string{
+		"online":        strconv.FormatBool(device.online),
+		"active":        strconv.FormatBool(device.active),
+		"fault":         strconv.FormatBool(device.deviceFault),
+		"emergencyStop": strconv.FormatBool(device.emergencyStop),
+		"manualStop":    strconv.FormatBool(device.manualStop),
+		"manualMode":    strconv.FormatBool(device.manualMode),
+		"running":       strconv.FormatBool(device.running),
+		"target":        strconv.FormatFloat(device.target, 'f', -1, 64),
+		"reading":       strconv.FormatFloat(device.reading, 'f', 1, 64),
+	}
+}
+
+// TelemetryPoint is the device's reading, setpoint and coil states as an
+// InfluxDB point.
+func (device *ModbusDevice) TelemetryPoint() events.Point {
+	coils, _ := device.WriteStateCoils()
+	point := events.Point{
+		Measurement: "plc_telemetry",
+		Tags: map[string]string{
+			"device_id": strconv.Itoa(int(device.deviceID)),
+			"device":    device.displayName,
+		},
+		Fields: map[string]any{
+			"reading":        device.reading,
+			"target":         device.target,
+			"online":         coils[CoilOnline],
+			"fault":          coils[CoilFault],
+			"emergency_stop": device.emergencyStop,
+			"in_use":         coils[CoilInuse],
+			"manual_stop":    coils[CoilManualStop],
+			"manual_mode":    coils[CoilManualMode],
+			"lower_bound":    coils[CoilLowerBound],
+			"lower_warn":     coils[CoilLowerWarn],
+			"upper_warn":     coils[CoilUpperWarn],
+			"upper_bound":    coils[CoilUpperBound],
+		},
+		Time: time.Now(),
+	}
+	for _, name := range []string{"speed", "flow", "pressure", "level", "temperature", "heaterDuty", "highLevel", "lowLevel"} {
+		value, _ := device.process.Variable(name)
+		point.Fields[name] = value
+	}
+	return point
+}
+
 // / ---- Helper
-func (device *ModbusDevice) SetReading(reading int16) {
+func (device *ModbusDevice) SetReading(reading float64) {
 	device.reading = reading
 }
 
@@ -136,30 +394,83 @@ func (device *ModbusDevice) ManualStart() {
 
 // --- Simulate activty
 
-func (d *ModbusDevice) SimulateActivity() {
-	// Randomly flip booleans with ~20% chance
-	d.online = flipWithChance(d.online, 0.02)
-	d.active = flipWithChance(d.active, 0.2)
-	d.manualStop = flipWithChance(d.manualStop, 0.1)
+// Running is whether the device is commanded to run: online, in use, not
+// faulted or emergency stopped and not stopped by hand.
+func (d *ModbusDevice) Running() bool {
+	return d.online && d.active && !d.deviceFault && !d.emergencyStop && !d.manualStop
+}
 
-	// Simulate sensor reading fluctuation
-	change := rand.Intn(11) - 5 // -5 to +5
-	newReading := int(d.reading) + change
-	if newReading == 0 {
-		newReading = int(d.target)
+// safetyEvent is why the emergency stop has to latch, empty while the
+// process is safe: the reading past its high-high limit or the tank
+// overflowing.
+func (d *ModbusDevice) safetyEvent() string {
+	if d.reading > d.upperBound {
+		return fmt.Sprintf("reading %.1f above its limit of %g", d.reading, d.upperBound)
 	}
-	if newReading < int(d.lowerBound) {
-		newReading = int(d.lowerBound)
+	if d.process.Overflowing() {
+		return "tank overflowing"
 	}
-	if newReading > int(d.upperBound) {
-		newReading = int(d.upperBound)
+	return ""
+}
+
+// Seed makes the device's noise and faults repeat from run to run. Devices
+// get different streams from the same seed.
+func (d *ModbusDevice) Seed(seed int64) {
+	d.rng = rand.New(rand.NewSource(seed + int64(d.deviceID)))
+}
+
+// Neighbors are the ids of the devices whose state the process reads.
+func (d *ModbusDevice) Neighbors() []uint8 {
+	return d.neighbors
+}
+
+// NeighborState is the state the device shares with its neighbors.
+func (d *ModbusDevice) NeighborState() NeighborState {
+	flow, _ := d.process.Variable("flow")
+	pressure, _ := d.process.Variable("pressure")
+	level, _ := d.process.Variable("level")
+	return NeighborState{
+		DeviceID: d.deviceID,
+		Online:   d.online,
+		Running:  d.running,
+		Fault:    d.deviceFault || d.emergencyStop,
+		Flow:     flow,
+		Pressure: pressure,
+		Level:    level,
 	}
-	d.reading = int16(newReading)
 }
 
-func flipWithChance(current bool, chance float64) bool {
-	if rand.Float64() < chance {
-		return !current
+// SimulateActivity advances the device's process by dt, given the latest
+// state of its neighbors.
+func (d *ModbusDevice) SimulateActivity(dt time.Duration, neighbors []NeighborState) {
+	running := d.Running()
+	inflow := 0.0
+	// a standby device runs when one of the devices it backs up is down
+	backupNeeded := false
+	for _, neighbor := range neighbors {
+		if neighbor.Known {
+			inflow += neighbor.Flow
+		}
+		if !neighbor.Known || !neighbor.Online || neighbor.Fault {
+			backupNeeded = true
+		}
+	}
+	if d.process.Standby && !d.manualMode && !backupNeeded {
+		running = false
+	}
+	// the high level switch stops the device filling its tank
+	if d.process.HighLevel() {
+		running = false
+	}
+	if running && d.process.Trips(dt, d.rng) {
+		log.Printf("Device %d tripped on a fault", d.deviceID)
+		d.deviceFault = true
+		running = false
+	}
+	d.running = running
+	d.reading = d.process.Step(dt, running, d.target, inflow, d.rng)
+	if event := d.safetyEvent(); event != "" && !d.emergencyStop {
+		log.Printf("Device %d emergency stopped: %s", d.deviceID, event)
+		d.emergencyStop = true
 	}
-	return current
 }
@@ -0,0 +1,134 @@
+package modbusServer
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestAlarmCoils(t *testing.T) {
+	tests := []struct {
+		reading float64
+		// lowerBound, lowerWarn, upperWarn, upperBound
+		alarms [4]bool
+	}{
+		{5, [4]bool{true, true, false, false}},
+		{15, [4]bool{false, true, false, false}},
+		{20, [4]bool{false, false, false, false}},
+		{50, [4]bool{false, false, false, false}},
+		{80, [4]bool{false, false, false, false}},
+		{85, [4]bool{false, false, true, false}},
+		{95, [4]bool{false, false, true, true}},
+	}
+	device := newTestDevice(t, DeviceConfig{LowerBound: "10", LowerWarn: "20", UpperWarn: "80", UpperBound: "90"})
+	for _, test := range tests {
+		t.Run(fmt.Sprint(test.reading), func(t *testing.T) {
+			device.SetReading(test.reading)
+			coils, err := device.ReadBits(TableCoils, CoilLowerBound, 4)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if [4]bool(coils) != test.alarms {
+				t.Errorf("alarm coils %v, want %v", coils, test.alarms)
+			}
+		})
+	}
+}
+
+func TestCommandCoils(t *testing.T) {
+	const fault = -1
+	tests := []struct {
+		name string
+		// coils written 1 in turn, fault trips the device instead
+		writes     []int
+		running    bool
+		faulted    bool
+		manualStop bool
+	}{
+		{"stop", []int{CoilStop}, false, false, true},
+		{"start after a stop", []int{CoilStop, CoilStart}, true, false, false},
+		{"start while faulted", []int{CoilStop, fault, CoilStart}, false, true, true},
+		{"fault reset", []int{fault, CoilFaultReset}, true, false, false},
+		{"fault reset then start", []int{CoilStop, fault, CoilFaultReset, CoilStart}, true, false, false},
+		{"stop while faulted", []int{fault, CoilStop, CoilFaultReset}, false, false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			device := newTestDevice(t, DeviceConfig{})
+			for _, coil := range test.writes {
+				if coil == fault {
+					device.deviceFault = true
+					continue
+				}
+				if err := device.WriteCoils(uint16(coil), []bool{true}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if device.Running() != test.running || device.deviceFault != test.faulted || device.manualStop != test.manualStop {
+				t.Errorf("running %v faulted %v manualStop %v, want %v %v %v",
+					device.Running(), device.deviceFault, device.manualStop, test.running, test.faulted, test.manualStop)
+			}
+			commands, err := device.ReadBits(TableCoils, CoilStart, 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, command := range commands {
+				if command {
+					t.Errorf("command coil %d reads 1", CoilStart+i)
+				}
+			}
+		})
+	}
+}
+
+func TestEmergencyStopLatch(t *testing.T) {
+	const (
+		// climb runs the device until the reading passes upperBound
+		climb = iota
+		// settle stops the device until the reading is back below it
+		settle
+		start
+		faultReset
+	)
+	steps := []struct {
+		name          string
+		action        int
+		emergencyStop bool
+		running       bool
+	}{
+		{"reading past upperBound", climb, true, false},
+		{"reset while the reading is still high", faultReset, true, false},
+		{"start while latched", start, true, false},
+		{"reading back in range", settle, true, false},
+		{"reset once safe", faultReset, false, true},
+	}
+	device := newTestDevice(t, DeviceConfig{
+		Target: "120", UpperBound: "90", UpperWarn: "80",
+		Process: &ProcessConfig{Model: ModelLag, TimeConstant: 5},
+	})
+	for _, step := range steps {
+		switch step.action {
+		case climb:
+			for i := 0; i < 60 && !device.emergencyStop; i++ {
+				device.SimulateActivity(time.Second, nil)
+			}
+		case settle:
+			for i := 0; i < 60 && device.reading > 90; i++ {
+				device.SimulateActivity(time.Second, nil)
+			}
+		case start:
+			device.WriteCoils(CoilStart, []bool{true})
+		case faultReset:
+			device.WriteCoils(CoilFaultReset, []bool{true})
+		}
+		// discrete input 1 of the default map is the emergency stop
+		inputs, err := device.ReadBits(TableDiscreteInputs, 1, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if inputs[0] != step.emergencyStop || device.Running() != step.running {
+			t.Errorf("%s: emergency stop %v running %v, want %v %v (reading %.1f)",
+				step.name, inputs[0], device.Running(), step.emergencyStop, step.running, device.reading)
+		}
+	}
+}
@@ -0,0 +1,351 @@
+package modbusServer
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/JonathanKoerber/CityUCapstoneMSCS/honeypot-core/app/events"
+)
+
+// AuditProxy sits in front of the Modbus server and records every
+// transaction on the wire: the client's address, the MBAP header, the
+// request, the response or exception and how long the server took. The
+// modbus library answers unsupported function codes and malformed requests
+// itself without calling the handler, so this is the only place that sees
+// them all.
+type AuditProxy struct {
+	// Listen is the public address attackers connect to.
+	Listen string
+	// Backend is the loopback address the modbus library listens on.
+	Backend string
+	Events  *events.Bus
+
+	listener net.Listener
+	// clients maps the proxy's local address of a backend connection, which
+	// the library reports as the client, to the attacker's address.
+	clients sync.Map
+}
+
+func NewAuditProxy(listen string, backend string, bus *events.Bus) *AuditProxy {
+	return &AuditProxy{Listen: listen, Backend: backend, Events: bus}
+}
+
+func (p *AuditProxy) Start() error {
+	listener, err := net.Listen("tcp", p.Listen)
+	if err != nil {
+		return fmt.Errorf("audit proxy listen on %s: %w", p.Listen, err)
+	}
+	p.listener = listener
+	go func() {
+		for {
+			client, err := listener.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					log.Printf("Audit proxy stopped accepting: %v", err)
+				}
+				return
+			}
+			go p.serve(client)
+		}
+	}()
+	log.Printf("Auditing Modbus on %s in front of %s", p.Listen, p.Backend)
+	return nil
+}
+
+func (p *AuditProxy) Stop() error {
+	if p.listener == nil {
+		return nil
+	}
+	return p.listener.Close()
+}
+
+// ClientAddr is the attacker behind a client address the modbus library
+// reports, addresses that did not come through the proxy are returned as
+// they are.
+func (p *AuditProxy) ClientAddr(addr string) string {
+	if p == nil {
+		return addr
+	}
+	if client, ok := p.clients.Load(addr); ok {
+		return client.(string)
+	}
+	return addr
+}
+
+// auditedRequest is a request waiting for its response.
+type auditedRequest struct {
+	received      time.Time
+	transactionID uint16
+	unitID        uint8
+	// pdu is the function code and its data.
+	pdu []byte
+}
+
+// auditConn relays one client connection. The library answers a
+// connection's requests one at a time and in order, so responses are
+// matched to requests first in, first out.
+type auditConn struct {
+	proxy  *AuditProxy
+	remote string
+	local  string
+
+	mu      sync.Mutex
+	pending []auditedRequest
+}
+
+func (p *AuditProxy) serve(client net.Conn) {
+	defer client.Close()
+	upstream, err := net.DialTimeout("tcp", p.Backend, 5*time.Second)
+	if err != nil {
+		log.Printf("Audit proxy could not reach the Modbus server: %v", err)
+		return
+	}
+	defer upstream.Close()
+	key := upstream.LocalAddr().String()
+	p.clients.Store(key, client.RemoteAddr().String())
+	defer p.clients.Delete(key)
+
+	conn := &auditConn{proxy: p, remote: client.RemoteAddr().String(), local: client.LocalAddr().String()}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn.relayResponses(upstream, client)
+		// the server hung up, stop reading the client
+		client.Close()
+	}()
+	conn.relayRequests(client, upstream)
+	// let the server answer what it already got before it sees EOF
+	if tcp, ok := upstream.(*net.TCPConn); ok {
+		tcp.CloseWrite()
+	} else {
+		upstream.Close()
+	}
+	<-done
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	for _, request := range conn.pending {
+		conn.publish(request, nil, "no response")
+	}
+}
+
+// readFrame reads an MBAP header and the PDU after it. A header that cannot
+// be Modbus is returned with a nil PDU.
+func readFrame(r io.Reader) (header []byte, pdu []byte, err error) {
+	header = make([]byte, 7)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	length := binary.BigEndian.Uint16(header[4:6])
+	// the length covers the unit ID and a PDU of at most 253 bytes
+	if binary.BigEndian.Uint16(header[2:4]) != 0 || length < 2 || length > 254 {
+		return header, nil, nil
+	}
+	pdu = make([]byte, length-1)
+	if _, err := io.ReadFull(r, pdu); err != nil {
+		return nil, nil, err
+	}
+	return header, pdu, nil
+}
+
+func (c *auditConn) relayRequests(client net.Conn, upstream net.Conn) {
+	for {
+		header, pdu, err := readFrame(client)
+		if err != nil {
+			return
+		}
+		if pdu == nil {
+			// the server drops the connection on a bad header, pass it on
+			// so the attacker sees the same
+			c.publish(auditedRequest{received: time.Now(), transactionID: binary.BigEndian.Uint16(header[0:2]), unitID: header[6], pdu: header}, nil, "malformed frame")
+			if _, err := upstream.Write(header); err != nil {
+				return
+			}
+			io.Copy(upstream, client)
+			return
+		}
+		c.mu.Lock()
+		c.pending = append(c.pending, auditedRequest{
+			received:      time.Now(),
+			transactionID: binary.BigEndian.Uint16(header[0:2]),
+			unitID:        header[6],
+			pdu:           pdu,
+		})
+		c.mu.Unlock()
+		if _, err := upstream.Write(append(header, pdu...)); err != nil {
+			return
+		}
+	}
+}
+
+func (c *auditConn) relayResponses(upstream net.Conn, client net.Conn) {
+	for {
+		header, pdu, err := readFrame(upstream)
+		if err != nil || pdu == nil {
+			return
+		}
+		c.mu.Lock()
+		if len(c.pending) > 0 {
+			request := c.pending[0]
+			c.pending = c.pending[1:]
+			c.publish(request, pdu, "")
+		}
+		c.mu.Unlock()
+		if _, err := client.Write(append(header, pdu...)); err != nil {
+			return
+		}
+	}
+}
+
+// publish records a transaction, response is nil when there was none and
+// failure says why.
+func (c *auditConn) publish(request auditedRequest, response []byte, failure string) {
+	transaction := events.ModbusTransaction{
+		LocalAddr:     c.local,
+		TransactionID: request.transactionID,
+		UnitID:        request.unitID,
+		Exception:     failure,
+		LatencyMs:     float64(time.Since(request.received).Microseconds()) / 1000,
+	}
+	header := events.Header{Time: request.received.UTC(), Protocol: events.ProtocolModbus, RemoteAddr: c.remote}
+	if failure == "malformed frame" {
+		transaction.Function = "malformed"
+		transaction.LatencyMs = 0
+		c.proxy.Events.Publish(&events.ModbusRequest{Header: header, ModbusTransaction: transaction, Request: hex.EncodeToString(request.pdu)})
+		return
+	}
+	functionCode := request.pdu[0]
+	transaction.FunctionCode = functionCode
+	transaction.Function = functionName(functionCode)
+	if len(response) >= 2 && response[0]&0x80 != 0 {
+		transaction.ExceptionCode = response[1]
+		transaction.Exception = exceptionName(response[1])
+	}
+	answered := response != nil && transaction.ExceptionCode == 0
+	data := request.pdu[1:]
+	var result []byte
+	if answered {
+		result = response[1:]
+	}
+
+	switch {
+	case (functionCode >= 1 && functionCode <= 4) && len(data) == 4:
+		read := &events.ModbusRead{
+			Header:            header,
+			ModbusTransaction: transaction,
+			Address:           binary.BigEndian.Uint16(data[0:2]),
+			Quantity:          binary.BigEndian.Uint16(data[2:4]),
+		}
+		// responses are a byte count and the packed values
+		if len(result) > 1 {
+			if functionCode <= 2 {
+				read.Values = unpackBits(result[1:], int(read.Quantity))
+			} else {
+				read.Values = unpackRegisters(result[1:])
+			}
+		}
+		c.proxy.Events.Publish(read)
+	case (functionCode == 5 || functionCode == 6) && len(data) == 4:
+		value := binary.BigEndian.Uint16(data[2:4])
+		if functionCode == 5 && value == 0xff00 {
+			value = 1
+		}
+		c.proxy.Events.Publish(&events.ModbusWrite{
+			Header:            header,
+			ModbusTransaction: transaction,
+			Address:           binary.BigEndian.Uint16(data[0:2]),
+			Quantity:          1,
+			Values:            []uint16{value},
+		})
+	case (functionCode == 15 || functionCode == 16) && len(data) >= 5:
+		write := &events.ModbusWrite{
+			Header:            header,
+			ModbusTransaction: transaction,
+			Address:           binary.BigEndian.Uint16(data[0:2]),
+			Quantity:          binary.BigEndian.Uint16(data[2:4]),
+		}
+		if functionCode == 15 {
+			write.Values = unpackBits(data[5:], int(write.Quantity))
+		} else {
+			write.Values = unpackRegisters(data[5:])
+		}
+		c.proxy.Events.Publish(write)
+	default:
+		c.proxy.Events.Publish(&events.ModbusRequest{
+			Header:            header,
+			ModbusTransaction: transaction,
+			Request:           hex.EncodeToString(data),
+			Response:          hex.EncodeToString(result),
+		})
+	}
+}
+
+func unpackBits(packed []byte, quantity int) []uint16 {
+	values := make([]uint16, 0, quantity)
+	for i := 0; i < quantity && i/8 < len(packed); i++ {
+		values = append(values, uint16(packed[i/8]>>(i%8)&1))
+	}
+	return values
+}
+
+func unpackRegisters(packed []byte) []uint16 {
+	values := make([]uint16, 0, len(packed)/2)
+	for i := 0; i+1 < len(packed); i += 2 {
+		values = append(values, binary.BigEndian.Uint16(packed[i:i+2]))
+	}
+	return values
+}
+
+var functionNames = map[uint8]string{
+	1:  "read_coils",
+	2:  "read_discrete_inputs",
+	3:  "read_holding_registers",
+	4:  "read_input_registers",
+	5:  "write_single_coil",
+	6:  "write_single_register",
+	7:  "read_exception_status",
+	8:  "diagnostics",
+	11: "get_comm_event_counter",
+	12: "get_comm_event_log",
+	15: "write_multiple_coils",
+	16: "write_multiple_registers",
+	17: "report_server_id",
+	20: "read_file_record",
+	21: "write_file_record",
+	22: "mask_write_register",
+	23: "read_write_multiple_registers",
+	24: "read_fifo_queue",
+	43: "encapsulated_interface_transport",
+}
+
+func functionName(code uint8) string {
+	if name, ok := functionNames[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown_0x%02x", code)
+}
+
+var exceptionNames = map[uint8]string{
+	1:  "illegal function",
+	2:  "illegal data address",
+	3:  "illegal data value",
+	4:  "server device failure",
+	5:  "acknowledge",
+	6:  "server device busy",
+	8:  "memory parity error",
+	10: "gateway path unavailable",
+	11: "gateway target device failed to respond",
+}
+
+func exceptionName(code uint8) string {
+	if name, ok := exceptionNames[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("exception 0x%02x", code)
+}
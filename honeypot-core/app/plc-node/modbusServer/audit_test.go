@@ -0,0 +1,169 @@
+package modbusServer
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/JonathanKoerber/CityUCapstoneMSCS/honeypot-core/app/events"
+)
+
+// scriptedBackend stands in for the modbus library: it answers reads of
+// holding registers with the register addresses, echoes single register
+// writes, answers coil reads with an illegal data address exception and
+// never answers input register reads. Like the library it hangs up on a
+// malformed header.
+func scriptedBackend(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					header, pdu, err := readFrame(conn)
+					if err != nil || pdu == nil {
+						return
+					}
+					var response []byte
+					switch pdu[0] {
+					case 1:
+						response = []byte{0x81, 2}
+					case 3:
+						address := binary.BigEndian.Uint16(pdu[1:3])
+						quantity := binary.BigEndian.Uint16(pdu[3:5])
+						response = []byte{3, byte(2 * quantity)}
+						for i := uint16(0); i < quantity; i++ {
+							response = binary.BigEndian.AppendUint16(response, address+i)
+						}
+					case 6:
+						response = pdu
+					default:
+						continue
+					}
+					conn.Write(frame(binary.BigEndian.Uint16(header[0:2]), header[6], response))
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// frame puts an MBAP header in front of a PDU.
+func frame(transactionID uint16, unitID uint8, pdu []byte) []byte {
+	header := make([]byte, 7, 7+len(pdu))
+	binary.BigEndian.PutUint16(header[0:2], transactionID)
+	binary.BigEndian.PutUint16(header[4:6], uint16(len(pdu)+1))
+	header[6] = unitID
+	return append(header, pdu...)
+}
+
+func TestAuditProxy(t *testing.T) {
+	sink := &recordingSink{}
+	bus := events.NewBus(0)
+	bus.Subscribe(sink)
+	proxy := NewAuditProxy("127.0.0.1:0", scriptedBackend(t), bus)
+	if err := proxy.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Stop()
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", proxy.listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		return conn
+	}
+	exchange := func(conn net.Conn, request []byte, want []byte) {
+		t.Helper()
+		if _, err := conn.Write(request); err != nil {
+			t.Fatal(err)
+		}
+		response := make([]byte, len(want))
+		if _, err := io.ReadFull(conn, response); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(response, want) {
+			t.Errorf("got % x, want % x", response, want)
+		}
+	}
+
+	// two requests on one connection are paired with their responses in
+	// order
+	conn := dial()
+	exchange(conn, frame(1, 7, []byte{3, 0, 10, 0, 2}), frame(1, 7, []byte{3, 4, 0, 10, 0, 11}))
+	exchange(conn, frame(2, 7, []byte{6, 0, 5, 0x01, 0x2c}), frame(2, 7, []byte{6, 0, 5, 0x01, 0x2c}))
+	exchange(conn, frame(3, 7, []byte{1, 0, 200, 0, 1}), frame(3, 7, []byte{0x81, 2}))
+	conn.Close()
+
+	// a header with a protocol ID other than 0 is passed on and the server
+	// hangs up
+	conn = dial()
+	conn.Write([]byte{0, 4, 0, 1, 0, 6, 7})
+	if n, err := conn.Read(make([]byte, 1)); n != 0 || err == nil {
+		t.Errorf("the connection stayed open after a malformed header: %d bytes, %v", n, err)
+	}
+	conn.Close()
+
+	// the client leaves with a request still unanswered
+	conn = dial()
+	conn.Write(frame(5, 7, []byte{4, 0, 0, 0, 1}))
+	time.Sleep(50 * time.Millisecond)
+	conn.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		sink.mu.Lock()
+		published := len(sink.events)
+		sink.mu.Unlock()
+		if published >= 5 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	bus.Close()
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if len(sink.events) != 5 {
+		t.Fatalf("published %d events, want 5: %#v", len(sink.events), sink.events)
+	}
+	read, ok := sink.events[0].(*events.ModbusRead)
+	if !ok || read.TransactionID != 1 || read.UnitID != 7 || read.Function != "read_holding_registers" ||
+		read.Address != 10 || read.Quantity != 2 || !reflect.DeepEqual(read.Values, []uint16{10, 11}) || read.Exception != "" {
+		t.Errorf("event 0 is %#v, want a read of registers 10 and 11", sink.events[0])
+	}
+	if read != nil && read.RemoteAddr == "" {
+		t.Error("the read has no client address")
+	}
+	write, ok := sink.events[1].(*events.ModbusWrite)
+	if !ok || write.TransactionID != 2 || write.Function != "write_single_register" ||
+		write.Address != 5 || !reflect.DeepEqual(write.Values, []uint16{300}) {
+		t.Errorf("event 1 is %#v, want a write of 300 to register 5", sink.events[1])
+	}
+	exception, ok := sink.events[2].(*events.ModbusRead)
+	if !ok || exception.TransactionID != 3 || exception.ExceptionCode != 2 ||
+		exception.Exception != "illegal data address" || exception.Values != nil {
+		t.Errorf("event 2 is %#v, want an illegal data address exception", sink.events[2])
+	}
+	malformed, ok := sink.events[3].(*events.ModbusRequest)
+	if !ok || malformed.Function != "malformed" || malformed.Exception != "malformed frame" || malformed.TransactionID != 4 {
+		t.Errorf("event 3 is %#v, want a malformed frame", sink.events[3])
+	}
+	unanswered, ok := sink.events[4].(*events.ModbusRead)
+	if !ok || unanswered.TransactionID != 5 || unanswered.Exception != "no response" || unanswered.Values != nil {
+		t.Errorf("event 4 is %#v, want an unanswered read", sink.events[4])
+	}
+}
@@ -0,0 +1,319 @@
+package modbusServer
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Process models, the "model" of a ProcessConfig.
+const (
+	// ModelLag moves the reading toward the target with a first-order lag
+	// while the device runs and toward zero when it stops.
+	ModelLag = "lag"
+	// ModelPump is a centrifugal pump on a variable speed drive, the
+	// reading is its flow.
+	ModelPump = "pump"
+	// ModelThermal is a heated process, the reading is its temperature.
+	ModelThermal = "thermal"
+)
+
+// ProcessConfig sets the physics behind a device's reading. Times are in
+// seconds, flows in m3/h and pressures in bar.
+type ProcessConfig struct {
+	Model string `json:"model"`
+	// TimeConstant is how long the process takes to get 63% of the way to
+	// a new operating point, it is the spin up and coast down of a pump.
+	TimeConstant float64 `json:"timeConstant"`
+	// Noise is the standard deviation of the sensor noise of each
+	// measurement, by variable name: flow, pressure, level, temperature, or
+	// reading for the lag model.
+	Noise map[string]float64 `json:"noise"`
+	// FaultRate is how many faults the device trips per hour of running on
+	// average, 0 never faults on its own.
+	FaultRate float64 `json:"faultRate"`
+	// Standby makes the device a backup for its neighbors: it runs only
+	// while one of them is faulted, offline or not heard from.
+	Standby bool           `json:"standby"`
+	Pump    *PumpConfig    `json:"pump"`
+	Tank    *TankConfig    `json:"tank"`
+	Thermal *ThermalConfig `json:"thermal"`
+}
+
+// PumpConfig is the pump curve and the system curve of the pipe it feeds.
+type PumpConfig struct {
+	// RatedFlow is the flow at full speed, where the pump delivers
+	// RatedPressure.
+	RatedFlow     float64 `json:"ratedFlow"`
+	RatedPressure float64 `json:"ratedPressure"`
+	// ShutoffPressure is the pressure at full speed against a closed
+	// valve.
+	ShutoffPressure float64 `json:"shutoffPressure"`
+	// StaticPressure is the head of the system, held by the check valve
+	// when the pump stops.
+	StaticPressure float64 `json:"staticPressure"`
+	// PressureTimeConstant is how fast the discharge pressure follows the
+	// pump, and bleeds off after it stops.
+	PressureTimeConstant float64 `json:"pressureTimeConstant"`
+}
+
+// TankConfig is a tank filled by the flow of the device and its neighbors
+// and drained by demand.
+type TankConfig struct {
+	// Area is the tank's cross section in m2.
+	Area float64 `json:"area"`
+	// Height is where the tank overflows, in m.
+	Height float64 `json:"height"`
+	// Level is the starting level, in m.
+	Level float64 `json:"level"`
+	// Demand is the outflow at the nominal level, it falls with the square
+	// root of the level like a gravity drain.
+	Demand       float64 `json:"demand"`
+	NominalLevel float64 `json:"nominalLevel"`
+	// HighLevel and LowLevel are where the level switches make, in m, 0
+	// for a tank without the switch. A switch releases once the level is
+	// SwitchDeadband back past its point.
+	HighLevel      float64 `json:"highLevel"`
+	LowLevel       float64 `json:"lowLevel"`
+	SwitchDeadband float64 `json:"switchDeadband"`
+}
+
+// ThermalConfig is a heater held at the target by a proportional
+// controller against losses to ambient.
+type ThermalConfig struct {
+	Ambient float64 `json:"ambient"`
+	// HeatingRate is how fast full heater power warms the process, in
+	// degrees per second.
+	HeatingRate float64 `json:"heatingRate"`
+	// CoolingTime is the thermal time constant of the losses.
+	CoolingTime float64 `json:"coolingTime"`
+	// Gain is the heater duty per degree below the target.
+	Gain float64 `json:"gain"`
+	// HeatLoad is the heat the process makes on its own, in degrees per
+	// second, such as a motor or a reaction.
+	HeatLoad float64 `json:"heatLoad"`
+	// FlowCooling is how much each m3/h of the neighbors' flow adds to the
+	// losses, per second.
+	FlowCooling float64 `json:"flowCooling"`
+}
+
+// Process is the state of a device's process model. The true values are
+// integrated on every step and the measured ones carry sensor noise.
+type Process struct {
+	ProcessConfig
+
+	// value is the lag model's output.
+	value float64
+	// speed is the pump's speed as a fraction of full speed.
+	speed       float64
+	flow        float64
+	pressure    float64
+	level       float64
+	temperature float64
+	heaterDuty  float64
+	// the tank's level switches
+	highLevel bool
+	lowLevel  bool
+
+	measured map[string]float64
+}
+
+// defaultProcess is the model of devices whose config has none.
+func defaultProcess() *ProcessConfig {
+	return &ProcessConfig{Model: ModelLag, TimeConstant: 10, Noise: map[string]float64{"reading": 0.2}}
+}
+
+// NewProcess checks config and starts its model at rest.
+func NewProcess(config ProcessConfig) (*Process, error) {
+	if config.Model == "" {
+		config.Model = ModelLag
+	}
+	if config.Model != ModelThermal && config.TimeConstant <= 0 {
+		return nil, fmt.Errorf("process timeConstant must be positive")
+	}
+	switch config.Model {
+	case ModelLag:
+	case ModelPump:
+		pump := config.Pump
+		if pump == nil {
+			return nil, fmt.Errorf("pump model needs a pump")
+		}
+		if pump.RatedFlow <= 0 || pump.PressureTimeConstant <= 0 {
+			return nil, fmt.Errorf("pump needs a positive ratedFlow and pressureTimeConstant")
+		}
+		if !(pump.StaticPressure < pump.RatedPressure && pump.RatedPressure < pump.ShutoffPressure) {
+			return nil, fmt.Errorf("pump needs staticPressure < ratedPressure < shutoffPressure")
+		}
+	case ModelThermal:
+		thermal := config.Thermal
+		if thermal == nil {
+			return nil, fmt.Errorf("thermal model needs thermal")
+		}
+		if thermal.HeatingRate <= 0 || thermal.CoolingTime <= 0 {
+			return nil, fmt.Errorf("thermal needs a positive heatingRate and coolingTime")
+		}
+	default:
+		return nil, fmt.Errorf("unknown process model %q", config.Model)
+	}
+	process := &Process{ProcessConfig: config, measured: make(map[string]float64)}
+	if tank := config.Tank; tank != nil {
+		if tank.Area <= 0 || tank.Height <= 0 || tank.NominalLevel <= 0 {
+			return nil, fmt.Errorf("tank needs a positive area, height and nominalLevel")
+		}
+		if tank.HighLevel < 0 || tank.LowLevel < 0 || tank.SwitchDeadband < 0 {
+			return nil, fmt.Errorf("tank level switches cannot be negative")
+		}
+		process.level = tank.Level
+		process.highLevel = tank.HighLevel > 0 && tank.Level >= tank.HighLevel
+		process.lowLevel = tank.LowLevel > 0 && tank.Level <= tank.LowLevel
+	}
+	if config.Pump != nil {
+		process.pressure = config.Pump.StaticPressure
+	}
+	if config.Thermal != nil {
+		process.temperature = config.Thermal.Ambient
+	}
+	return process, nil
+}
+
+// Step advances the model by dt. running is whether the device is
+// commanded to run, target is its setpoint and inflow the flow of its
+// neighbors. It returns the new reading.
+func (p *Process) Step(dt time.Duration, running bool, target float64, inflow float64, rng *rand.Rand) float64 {
+	seconds := dt.Seconds()
+	switch p.Model {
+	case ModelPump:
+		p.stepPump(seconds, running, target)
+	case ModelThermal:
+		p.stepThermal(seconds, running, target, inflow)
+	default:
+		goal := 0.0
+		if running {
+			goal = target
+		}
+		p.value = lag(p.value, goal, seconds, p.TimeConstant)
+	}
+	if tank := p.Tank; tank != nil {
+		outflow := tank.Demand * math.Sqrt(math.Max(p.level, 0)/tank.NominalLevel)
+		// flows are per hour
+		p.level += (p.flow + inflow - outflow) / 3600 * seconds / tank.Area
+		p.level = clamp(p.level, 0, tank.Height)
+		// float switches see the true level, with a deadband so they do
+		// not chatter
+		if tank.HighLevel > 0 {
+			p.highLevel = p.level >= tank.HighLevel || p.highLevel && p.level > tank.HighLevel-tank.SwitchDeadband
+		}
+		if tank.LowLevel > 0 {
+			p.lowLevel = p.level <= tank.LowLevel || p.lowLevel && p.level < tank.LowLevel+tank.SwitchDeadband
+		}
+	}
+
+	p.measure("flow", p.flow, rng)
+	p.measure("pressure", p.pressure, rng)
+	p.measure("level", p.level, rng)
+	p.measure("temperature", p.temperature, rng)
+	switch p.Model {
+	case ModelPump:
+		return p.measured["flow"]
+	case ModelThermal:
+		return p.measured["temperature"]
+	}
+	return p.value + rng.NormFloat64()*p.Noise["reading"]
+}
+
+// stepPump runs the drive toward the speed that delivers the target flow
+// and finds where the pump curve, H = shutoff·s² − kp·Q², meets the system
+// curve, H = static + ks·Q².
+func (p *Process) stepPump(seconds float64, running bool, target float64) {
+	pump := p.Pump
+	kp := (pump.ShutoffPressure - pump.RatedPressure) / (pump.RatedFlow * pump.RatedFlow)
+	ks := (pump.RatedPressure - pump.StaticPressure) / (pump.RatedFlow * pump.RatedFlow)
+
+	command := 0.0
+	if running {
+		// the speed whose operating point is the target flow
+		flow := clamp(target, 0, pump.RatedFlow)
+		command = math.Sqrt((pump.StaticPressure + (kp+ks)*flow*flow) / pump.ShutoffPressure)
+	}
+	p.speed = lag(p.speed, clamp(command, 0, 1), seconds, p.TimeConstant)
+
+	head := pump.ShutoffPressure * p.speed * p.speed
+	flow := 0.0
+	if head > pump.StaticPressure {
+		flow = math.Sqrt((head - pump.StaticPressure) / (kp + ks))
+	}
+	p.flow = flow
+	// the discharge sits on the system curve, when the pump stops the line
+	// bleeds down to the static head held by the check valve
+	p.pressure = lag(p.pressure, pump.StaticPressure+ks*flow*flow, seconds, pump.PressureTimeConstant)
+}
+
+// stepThermal heats toward the target while running and cools toward
+// ambient otherwise. The neighbors' flow carries heat away, so losing it
+// leaves the heat load to warm the process past the target.
+func (p *Process) stepThermal(seconds float64, running bool, target float64, flow float64) {
+	thermal := p.Thermal
+	lossRate := 1/thermal.CoolingTime + thermal.FlowCooling*flow
+	losses := (p.temperature - thermal.Ambient) * lossRate
+	p.heaterDuty = 0
+	if running {
+		// feed forward what holding the target takes, correct the rest
+		hold := ((target-thermal.Ambient)*lossRate - thermal.HeatLoad) / thermal.HeatingRate
+		p.heaterDuty = clamp(hold+thermal.Gain*(target-p.temperature), 0, 1)
+	}
+	p.temperature += (p.heaterDuty*thermal.HeatingRate + thermal.HeatLoad - losses) * seconds
+}
+
+// Trips is whether the device faults during a step of dt.
+func (p *Process) Trips(dt time.Duration, rng *rand.Rand) bool {
+	if p.FaultRate <= 0 {
+		return false
+	}
+	return rng.Float64() < p.FaultRate*dt.Hours()
+}
+
+// HighLevel is whether the tank's high level switch is made, a device
+// filling its tank stops until it releases.
+func (p *Process) HighLevel() bool {
+	return p.highLevel
+}
+
+// Overflowing is whether the tank is full to the brim.
+func (p *Process) Overflowing() bool {
+	return p.Tank != nil && p.level >= p.Tank.Height
+}
+
+// measure samples a sensor of the named variable. Only temperatures read
+// below zero, the other transmitters cut off there.
+func (p *Process) measure(name string, value float64, rng *rand.Rand) {
+	value += rng.NormFloat64() * p.Noise[name]
+	if name != "temperature" {
+		value = math.Max(value, 0)
+	}
+	p.measured[name] = value
+}
+
+// lag moves value toward goal as a first-order system with time constant
+// tau, exact for any step length.
+func lag(value float64, goal float64, seconds float64, tau float64) float64 {
+	return goal + (value-goal)*math.Exp(-seconds/tau)
+}
+
+// Variable is a measured process value, speed and heaterDuty in percent
+// and the level switches 0 or 1.
+func (p *Process) Variable(name string) (float64, bool) {
+	switch name {
+	case "highLevel":
+		return boolValue(p.highLevel), true
+	case "lowLevel":
+		return boolValue(p.lowLevel), true
+	case "speed":
+		return p.speed * 100, true
+	case "heaterDuty":
+		return p.heaterDuty * 100, true
+	case "flow", "pressure", "level", "temperature":
+		return p.measured[name], true
+	}
+	return 0, false
+}
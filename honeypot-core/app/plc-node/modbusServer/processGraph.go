@@ -0,0 +1,209 @@
+package modbusServer
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/JonathanKoerber/CityUCapstoneMSCS/honeypot-core/app/events"
+)
+
+// NeighborState is what a device shares with the devices that list it in
+// their metaData.processNeighbors.
+type NeighborState struct {
+	DeviceID uint8   `json:"deviceId"`
+	Online   bool    `json:"online"`
+	Running  bool    `json:"running"`
+	Fault    bool    `json:"fault"`
+	Flow     float64 `json:"flow"`
+	Pressure float64 `json:"pressure"`
+	Level    float64 `json:"level"`
+	// Known is unset for a neighbor that has not been heard from lately.
+	Known bool      `json:"-"`
+	Time  time.Time `json:"time"`
+}
+
+// ProcessGraph holds the latest state of every device of the process, so
+// neighbors can act on each other. Devices of other plc-node containers are
+// exchanged as JSON datagrams over UDP:
+//
+//	PROCESS_LISTEN  address to receive neighbor states on, such as :5020
+//	PROCESS_PEERS   comma separated host:port of the other nodes
+//
+// Without them only the devices of this node see each other. Datagrams
+// from anyone but the peers are dropped and published as RejectedDatagram
+// events, they would let an attacker fake a neighbor. A nil *ProcessGraph
+// knows no neighbors.
+type ProcessGraph struct {
+	// StaleAfter is how long a neighbor's state counts as current.
+	StaleAfter time.Duration
+	// Events receives the rejected datagrams, may be nil.
+	Events *events.Bus
+
+	mu       sync.RWMutex
+	states   map[uint8]NeighborState
+	started  time.Time
+	conn     *net.UDPConn
+	peers    []*net.UDPAddr
+	rejected atomic.Uint64
+}
+
+func NewProcessGraph() *ProcessGraph {
+	return &ProcessGraph{
+		StaleAfter: 10 * time.Second,
+		states:     make(map[uint8]NeighborState),
+		started:    time.Now(),
+	}
+}
+
+func NewProcessGraphFromEnv(bus *events.Bus) (*ProcessGraph, error) {
+	graph := NewProcessGraph()
+	graph.Events = bus
+	for _, peer := range strings.Split(os.Getenv("PROCESS_PEERS"), ",") {
+		if peer = strings.TrimSpace(peer); peer == "" {
+			continue
+		}
+		addr, err := net.ResolveUDPAddr("udp", peer)
+		if err != nil {
+			return nil, fmt.Errorf("process peer %q: %w", peer, err)
+		}
+		graph.peers = append(graph.peers, addr)
+	}
+	listen := os.Getenv("PROCESS_LISTEN")
+	if listen == "" {
+		if len(graph.peers) > 0 {
+			return nil, fmt.Errorf("PROCESS_PEERS needs PROCESS_LISTEN")
+		}
+		return graph, nil
+	}
+	addr, err := net.ResolveUDPAddr("udp", listen)
+	if err != nil {
+		return nil, fmt.Errorf("PROCESS_LISTEN: %w", err)
+	}
+	graph.conn, err = net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("process graph listen on %s: %w", listen, err)
+	}
+	go graph.receive()
+	log.Printf("Exchanging process state on %s with %d peers", listen, len(graph.peers))
+	return graph, nil
+}
+
+func (g *ProcessGraph) receive() {
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := g.conn.ReadFromUDP(buf)
+		if err != nil {
+			log.Printf("Process graph stopped receiving: %v", err)
+			return
+		}
+		if !g.isPeer(from) {
+			g.reject(from, buf[:n])
+			continue
+		}
+		var state NeighborState
+		if err := json.Unmarshal(buf[:n], &state); err != nil {
+			log.Printf("Ignoring process state from %s: %v", from, err)
+			continue
+		}
+		// stamp arrival, the nodes' clocks need not agree
+		state.Time = time.Now()
+		g.mu.Lock()
+		g.states[state.DeviceID] = state
+		g.mu.Unlock()
+	}
+}
+
+// isPeer is whether addr is one of PROCESS_PEERS, nodes send from the
+// address they listen on.
+func (g *ProcessGraph) isPeer(addr *net.UDPAddr) bool {
+	for _, peer := range g.peers {
+		if peer.IP.Equal(addr.IP) && peer.Port == addr.Port {
+			return true
+		}
+	}
+	return false
+}
+
+// maxRejectedPayload is how much of a rejected datagram its event keeps.
+const maxRejectedPayload = 256
+
+func (g *ProcessGraph) reject(from *net.UDPAddr, datagram []byte) {
+	if g.rejected.Add(1)%100 == 1 {
+		log.Printf("Rejected process state from %s, not a peer, %d rejected so far", from, g.rejected.Load())
+	}
+	payload := datagram
+	if len(payload) > maxRejectedPayload {
+		payload = payload[:maxRejectedPayload]
+	}
+	g.Events.Publish(&events.RejectedDatagram{
+		Header:    events.Header{Protocol: events.ProtocolProcess, RemoteAddr: from.String()},
+		LocalAddr: g.conn.LocalAddr().String(),
+		Size:      len(datagram),
+		Payload:   string(payload),
+	})
+}
+
+// Publish records the state of a local device and sends it to the peers.
+func (g *ProcessGraph) Publish(state NeighborState) {
+	if g == nil {
+		return
+	}
+	state.Time = time.Now()
+	g.mu.Lock()
+	g.states[state.DeviceID] = state
+	g.mu.Unlock()
+	if g.conn == nil {
+		return
+	}
+	datagram, err := json.Marshal(state)
+	if err != nil {
+		log.Printf("Error encoding process state: %v", err)
+		return
+	}
+	for _, peer := range g.peers {
+		if _, err := g.conn.WriteToUDP(datagram, peer); err != nil {
+			log.Printf("Error sending process state to %s: %v", peer, err)
+		}
+	}
+}
+
+// Neighbors is the latest state of each of ids. A neighbor not heard from
+// within StaleAfter is returned with Known unset, a neighbor never heard
+// from gets StaleAfter from startup before it counts as lost.
+func (g *ProcessGraph) Neighbors(ids []uint8) []NeighborState {
+	if g == nil {
+		return nil
+	}
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	now := time.Now()
+	neighbors := make([]NeighborState, len(ids))
+	for i, id := range ids {
+		state, ok := g.states[id]
+		switch {
+		case ok && now.Sub(state.Time) <= g.StaleAfter:
+			state.Known = true
+		case !ok && now.Sub(g.started) <= g.StaleAfter:
+			// still starting up, assume it runs
+			state = NeighborState{DeviceID: id, Online: true, Known: true}
+		default:
+			state = NeighborState{DeviceID: id, Time: state.Time}
+		}
+		neighbors[i] = state
+	}
+	return neighbors
+}
+
+func (g *ProcessGraph) Close() error {
+	if g == nil || g.conn == nil {
+		return nil
+	}
+	return g.conn.Close()
+}
@@ -0,0 +1,81 @@
+package modbusServer
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/JonathanKoerber/CityUCapstoneMSCS/honeypot-core/app/events"
+)
+
+type recordingSink struct {
+	mu     sync.Mutex
+	events []events.Event
+}
+
+func (s *recordingSink) Write(e events.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, e)
+	return nil
+}
+
+func (s *recordingSink) Close() error { return nil }
+
+func TestProcessGraphOnlyTrustsPeers(t *testing.T) {
+	listen := func() *net.UDPConn {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	peer, intruder := listen(), listen()
+	t.Setenv("PROCESS_LISTEN", "127.0.0.1:0")
+	t.Setenv("PROCESS_PEERS", peer.LocalAddr().String())
+	sink := &recordingSink{}
+	bus := events.NewBus(0)
+	bus.Subscribe(sink)
+	graph, err := NewProcessGraphFromEnv(bus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer graph.Close()
+
+	send := func(conn *net.UDPConn, state NeighborState) {
+		datagram, _ := json.Marshal(state)
+		if _, err := conn.WriteToUDP(datagram, graph.conn.LocalAddr().(*net.UDPAddr)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the intruder reports the main pump faulted, then the real one reports
+	send(intruder, NeighborState{DeviceID: 101, Online: true, Fault: true})
+	send(peer, NeighborState{DeviceID: 101, Online: true, Running: true, Flow: 80})
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if state := graph.Neighbors([]uint8{101})[0]; state.Flow == 80 {
+			if state.Fault {
+				t.Error("the intruder's fault was taken")
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the peer's state never arrived")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	bus.Close()
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if len(sink.events) != 1 {
+		t.Fatalf("published %d events, want one rejected datagram", len(sink.events))
+	}
+	rejected, ok := sink.events[0].(*events.RejectedDatagram)
+	if !ok || rejected.RemoteAddr != intruder.LocalAddr().String() {
+		t.Errorf("got %#v, want a datagram rejected from %s", sink.events[0], intruder.LocalAddr())
+	}
+}
@@ -0,0 +1,135 @@
+package modbusServer
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func newTestDevice(t *testing.T, config DeviceConfig) *ModbusDevice {
+	t.Helper()
+	if config.DeviceID == "" {
+		config.DeviceID = "1"
+	}
+	if config.UpperBound == "" {
+		config.UpperBound = "1000"
+		config.UpperWarn = "1000"
+	}
+	device, err := NewModbusDeviceFromConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	device.Seed(1)
+	return device
+}
+
+func simulate(device *ModbusDevice, seconds int) {
+	for i := 0; i < seconds; i++ {
+		device.SimulateActivity(time.Second, nil)
+	}
+}
+
+func TestStopDecays(t *testing.T) {
+	tests := []struct {
+		name     string
+		variable string
+		target   string
+		process  ProcessConfig
+		// running is the value the variable settles at, stopped where it
+		// decays to
+		running float64
+		stopped float64
+	}{
+		{
+			name: "lag reading", variable: "reading", target: "50",
+			process: ProcessConfig{Model: ModelLag, TimeConstant: 10},
+			running: 50, stopped: 0,
+		},
+		{
+			name: "pump pressure bleeds to the static head", variable: "pressure", target: "100",
+			process: ProcessConfig{Model: ModelPump, TimeConstant: 3, Pump: &PumpConfig{
+				RatedFlow: 100, RatedPressure: 4, ShutoffPressure: 6, StaticPressure: 1, PressureTimeConstant: 2,
+			}},
+			running: 4, stopped: 1,
+		},
+		{
+			name: "heated process cools to ambient", variable: "temperature", target: "60",
+			process: ProcessConfig{Model: ModelThermal, Thermal: &ThermalConfig{
+				Ambient: 20, HeatingRate: 0.5, CoolingTime: 100, Gain: 0.2,
+			}},
+			running: 60, stopped: 20,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			process := test.process
+			device := newTestDevice(t, DeviceConfig{Target: test.target, Process: &process})
+			simulate(device, 2000)
+			value, _ := device.Variable(test.variable)
+			if math.Abs(value-test.running) > 0.01 {
+				t.Fatalf("%s settled at %.3f while running, want %v", test.variable, value, test.running)
+			}
+			if err := device.WriteCoils(CoilStop, []bool{true}); err != nil {
+				t.Fatal(err)
+			}
+			previous := value
+			for i := 0; i < 1000; i++ {
+				device.SimulateActivity(time.Second, nil)
+				value, _ = device.Variable(test.variable)
+				if value > previous+1e-9 {
+					t.Fatalf("%s rose from %.3f to %.3f %d s after the stop", test.variable, previous, value, i+1)
+				}
+				if i == 0 && value <= test.stopped {
+					t.Fatalf("%s dropped to %.3f at once, it should decay", test.variable, value)
+				}
+				previous = value
+			}
+			if math.Abs(value-test.stopped) > 0.01 {
+				t.Errorf("%s decayed to %.3f, want %v", test.variable, value, test.stopped)
+			}
+		})
+	}
+}
+
+func TestHighLevelSwitch(t *testing.T) {
+	tests := []struct {
+		level     float64
+		highLevel bool
+	}{
+		{3.0, false},
+		{3.5, true},
+		// it holds within the deadband on the way down
+		{3.4, true},
+		{3.31, true},
+		{3.29, false},
+		// and does not make again until the switch point
+		{3.4, false},
+		{3.49, false},
+		{3.5, true},
+	}
+	device := newTestDevice(t, DeviceConfig{
+		Target: "10",
+		Process: &ProcessConfig{Model: ModelLag, TimeConstant: 1, Tank: &TankConfig{
+			Area: 1, Height: 4, Level: 3, NominalLevel: 2, HighLevel: 3.5, SwitchDeadband: 0.2,
+		}},
+		Registers: &RegisterMap{DiscreteInputs: []RegisterEntry{{Address: 0, Name: "highLevel", Type: TypeBool, Bind: "highLevel"}}},
+	})
+	for i, test := range tests {
+		// the device sees the switch as it was before the step
+		wasHigh := device.process.HighLevel()
+		// the lag model fills nothing and the tank has no demand, the
+		// level stays where it is put
+		device.process.level = test.level
+		device.SimulateActivity(time.Second, nil)
+		inputs, err := device.ReadBits(TableDiscreteInputs, 0, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if inputs[0] != test.highLevel {
+			t.Errorf("step %d at %.2f m: high level input %v, want %v", i, test.level, inputs[0], test.highLevel)
+		}
+		if device.running == wasHigh {
+			t.Errorf("step %d at %.2f m: running %v with the high level switch %v", i, test.level, device.running, wasHigh)
+		}
+	}
+}
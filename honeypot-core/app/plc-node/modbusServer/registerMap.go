@@ -0,0 +1,463 @@
+package modbusServer
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/simonvetter/modbus"
+)
+
+// RegisterMap declares what a device exposes in each Modbus table. Every
+// entry is bound to one of the device's simulated variables (see
+// deviceVariables) or holds a constant, such as a model name or firmware
+// version. Addresses that are not declared answer with an illegal data
+// address exception.
+type RegisterMap struct {
+	Coils            []RegisterEntry `json:"coils"`
+	DiscreteInputs   []RegisterEntry `json:"discreteInputs"`
+	InputRegisters   []RegisterEntry `json:"inputRegisters"`
+	HoldingRegisters []RegisterEntry `json:"holdingRegisters"`
+}
+
+type RegisterEntry struct {
+	Address uint16 `json:"address"`
+	Name    string `json:"name"`
+	// Type is bool for coils and discrete inputs, and int16 (the default),
+	// uint16, int32, uint32, float32 or string for registers.
+	Type string `json:"type"`
+	// WordOrder is the order of the registers of 32-bit values, "big" puts
+	// the high word first and is the default, "little" the low word.
+	WordOrder string `json:"wordOrder"`
+	// ByteOrder is the order of the bytes within each register, "big" (the
+	// default) or "little".
+	ByteOrder string `json:"byteOrder"`
+	// Length is the number of registers of a string, two characters each.
+	Length uint16 `json:"length"`
+	// Scale multiplies the value into the register, 10 makes 21.5 read as
+	// 215. Defaults to 1.
+	Scale float64 `json:"scale"`
+	Units string  `json:"units"`
+	// Access is "r" (the default) or "rw". Input registers and discrete
+	// inputs are always read only.
+	Access string `json:"access"`
+	// Bind names the variable the entry reads and writes.
+	Bind string `json:"bind"`
+	// Value is the constant of an unbound entry, a number or a string.
+	Value any `json:"value"`
+}
+
+// Tables of a RegisterMap, as named in the JSON.
+const (
+	TableCoils            = "coils"
+	TableDiscreteInputs   = "discreteInputs"
+	TableInputRegisters   = "inputRegisters"
+	TableHoldingRegisters = "holdingRegisters"
+)
+
+// Register entry types.
+const (
+	TypeBool    = "bool"
+	TypeInt16   = "int16"
+	TypeUint16  = "uint16"
+	TypeInt32   = "int32"
+	TypeUint32  = "uint32"
+	TypeFloat32 = "float32"
+	TypeString  = "string"
+)
+
+const (
+	AccessRead      = "r"
+	AccessReadWrite = "rw"
+)
+
+const (
+	OrderBig    = "big"
+	OrderLittle = "little"
+)
+
+// registerTable is one table of a RegisterMap indexed by address. Multi
+// register entries have a slot for each of their registers.
+type registerTable struct {
+	name     string
+	bits     bool
+	writable bool
+	slots    map[uint16]registerSlot
+}
+
+type registerSlot struct {
+	entry *RegisterEntry
+	// word is the slot's register within the entry.
+	word uint16
+}
+
+// defaultRegisterMap is the layout of devices whose config has no register
+// map: the control coils, the running and emergency stop inputs and the
+// reading in holding register 100.
+func defaultRegisterMap() *RegisterMap {
+	coil := func(address uint16, name string, access string) RegisterEntry {
+		return RegisterEntry{Address: address, Name: name, Type: TypeBool, Access: access, Bind: name}
+	}
+	return &RegisterMap{
+		Coils: []RegisterEntry{
+			coil(CoilOnline, "online", AccessReadWrite),
+			coil(CoilFault, "fault", AccessRead),
+			coil(CoilInuse, "active", AccessReadWrite),
+			coil(CoilManualStop, "manualStop", AccessReadWrite),
+			coil(CoilLowerBound, "lowerBoundAlarm", AccessRead),
+			coil(CoilLowerWarn, "lowerWarnAlarm", AccessRead),
+			coil(CoilUpperWarn, "upperWarnAlarm", AccessRead),
+			coil(CoilUpperBound, "upperBoundAlarm", AccessRead),
+			coil(CoilStart, "start", AccessReadWrite),
+			coil(CoilStop, "stop", AccessReadWrite),
+			coil(CoilFaultReset, "faultReset", AccessReadWrite),
+			coil(CoilManualMode, "manualMode", AccessReadWrite),
+		},
+		DiscreteInputs: []RegisterEntry{
+			coil(0, "running", AccessRead),
+			coil(1, "emergencyStop", AccessRead),
+		},
+		HoldingRegisters: []RegisterEntry{
+			{Address: 100, Name: "reading", Type: TypeInt16, Access: AccessReadWrite, Bind: "reading"},
+		},
+	}
+}
+
+// compile checks the map and indexes its tables.
+func (m *RegisterMap) compile() (map[string]*registerTable, error) {
+	tables := map[string]*registerTable{
+		TableCoils:            {name: TableCoils, bits: true, writable: true},
+		TableDiscreteInputs:   {name: TableDiscreteInputs, bits: true},
+		TableInputRegisters:   {name: TableInputRegisters},
+		TableHoldingRegisters: {name: TableHoldingRegisters, writable: true},
+	}
+	entries := map[string][]RegisterEntry{
+		TableCoils:            m.Coils,
+		TableDiscreteInputs:   m.DiscreteInputs,
+		TableInputRegisters:   m.InputRegisters,
+		TableHoldingRegisters: m.HoldingRegisters,
+	}
+	for name, table := range tables {
+		table.slots = make(map[uint16]registerSlot)
+		for i := range entries[name] {
+			entry := &entries[name][i]
+			if err := entry.normalize(table); err != nil {
+				return nil, fmt.Errorf("%s %d: %w", name, entry.Address, err)
+			}
+			words := entry.words()
+			if int(entry.Address)+int(words) > 0x10000 {
+				return nil, fmt.Errorf("%s %d: runs past the last address", name, entry.Address)
+			}
+			for word := uint16(0); word < words; word++ {
+				address := entry.Address + word
+				if other, ok := table.slots[address]; ok {
+					return nil, fmt.Errorf("%s %d: overlaps %q", name, address, other.entry.Name)
+				}
+				table.slots[address] = registerSlot{entry: entry, word: word}
+			}
+		}
+	}
+	return tables, nil
+}
+
+// normalize fills in defaults and rejects entries table cannot hold.
+func (e *RegisterEntry) normalize(table *registerTable) error {
+	if e.Name == "" {
+		e.Name = e.Bind
+	}
+	if e.Type == "" {
+		e.Type = TypeInt16
+		if table.bits {
+			e.Type = TypeBool
+		}
+	}
+	if e.Access == "" {
+		e.Access = AccessRead
+	}
+	if e.WordOrder == "" {
+		e.WordOrder = OrderBig
+	}
+	if e.ByteOrder == "" {
+		e.ByteOrder = OrderBig
+	}
+	if e.Scale == 0 {
+		e.Scale = 1
+	}
+
+	switch e.Type {
+	case TypeBool:
+		if !table.bits {
+			return fmt.Errorf("bool entries belong in coils or discrete inputs")
+		}
+	case TypeInt16, TypeUint16, TypeInt32, TypeUint32, TypeFloat32, TypeString:
+		if table.bits {
+			return fmt.Errorf("%s entries belong in input or holding registers", e.Type)
+		}
+	default:
+		return fmt.Errorf("unknown type %q", e.Type)
+	}
+	if e.Type == TypeString && e.Length == 0 {
+		return fmt.Errorf("string entries need a length")
+	}
+	if e.WordOrder != OrderBig && e.WordOrder != OrderLittle {
+		return fmt.Errorf("unknown word order %q", e.WordOrder)
+	}
+	if e.ByteOrder != OrderBig && e.ByteOrder != OrderLittle {
+		return fmt.Errorf("unknown byte order %q", e.ByteOrder)
+	}
+
+	switch e.Access {
+	case AccessRead:
+	case AccessReadWrite:
+		if !table.writable {
+			return fmt.Errorf("%s are read only", table.name)
+		}
+		if e.Bind == "" {
+			return fmt.Errorf("writable entries must be bound to a variable")
+		}
+		if writable, ok := deviceVariables[e.Bind]; ok && !writable {
+			return fmt.Errorf("variable %s is read only", e.Bind)
+		}
+	default:
+		return fmt.Errorf("unknown access %q", e.Access)
+	}
+
+	if e.Bind != "" {
+		if _, ok := deviceVariables[e.Bind]; !ok {
+			return fmt.Errorf("unknown variable %q", e.Bind)
+		}
+		if e.Type == TypeString {
+			return fmt.Errorf("string entries hold a constant value")
+		}
+		return nil
+	}
+	switch e.Value.(type) {
+	case string:
+		if e.Type != TypeString {
+			return fmt.Errorf("a %s entry needs a number", e.Type)
+		}
+	case float64:
+		if e.Type == TypeString {
+			return fmt.Errorf("a string entry needs a string")
+		}
+	case bool:
+		if e.Type != TypeBool {
+			return fmt.Errorf("a %s entry needs a number", e.Type)
+		}
+	default:
+		return fmt.Errorf("needs a bind or a value")
+	}
+	return nil
+}
+
+// words is the number of registers the entry takes.
+func (e *RegisterEntry) words() uint16 {
+	switch e.Type {
+	case TypeInt32, TypeUint32, TypeFloat32:
+		return 2
+	case TypeString:
+		return e.Length
+	}
+	return 1
+}
+
+// encode is value in the entry's registers.
+func (e *RegisterEntry) encode(value float64) []uint16 {
+	raw := value * e.Scale
+	var words []uint16
+	switch e.Type {
+	case TypeInt16:
+		words = []uint16{uint16(int16(clamp(math.Round(raw), math.MinInt16, math.MaxInt16)))}
+	case TypeUint16:
+		words = []uint16{uint16(clamp(math.Round(raw), 0, math.MaxUint16))}
+	case TypeInt32:
+		bits := uint32(int32(clamp(math.Round(raw), math.MinInt32, math.MaxInt32)))
+		words = []uint16{uint16(bits >> 16), uint16(bits)}
+	case TypeUint32:
+		bits := uint32(clamp(math.Round(raw), 0, math.MaxUint32))
+		words = []uint16{uint16(bits >> 16), uint16(bits)}
+	case TypeFloat32:
+		bits := math.Float32bits(float32(raw))
+		words = []uint16{uint16(bits >> 16), uint16(bits)}
+	}
+	return e.order(words)
+}
+
+// decode is the value of the entry's registers.
+func (e *RegisterEntry) decode(words []uint16) float64 {
+	words = e.order(append([]uint16(nil), words...))
+	var raw float64
+	switch e.Type {
+	case TypeInt16:
+		raw = float64(int16(words[0]))
+	case TypeUint16:
+		raw = float64(words[0])
+	case TypeInt32:
+		raw = float64(int32(uint32(words[0])<<16 | uint32(words[1])))
+	case TypeUint32:
+		raw = float64(uint32(words[0])<<16 | uint32(words[1]))
+	case TypeFloat32:
+		raw = float64(math.Float32frombits(uint32(words[0])<<16 | uint32(words[1])))
+	}
+	return raw / e.Scale
+}
+
+// encodeString packs text two characters per register, padded with NULs.
+func (e *RegisterEntry) encodeString(text string) []uint16 {
+	words := make([]uint16, e.Length)
+	for i := 0; i < len(text) && i/2 < len(words); i++ {
+		if i%2 == 0 {
+			words[i/2] |= uint16(text[i]) << 8
+		} else {
+			words[i/2] |= uint16(text[i])
+		}
+	}
+	if e.ByteOrder == OrderLittle {
+		for i, word := range words {
+			words[i] = word<<8 | word>>8
+		}
+	}
+	return words
+}
+
+// order converts words between big endian and the entry's order, in place.
+// Both swaps are their own inverse.
+func (e *RegisterEntry) order(words []uint16) []uint16 {
+	if e.WordOrder == OrderLittle {
+		for i, j := 0, len(words)-1; i < j; i, j = i+1, j-1 {
+			words[i], words[j] = words[j], words[i]
+		}
+	}
+	if e.ByteOrder == OrderLittle {
+		for i, word := range words {
+			words[i] = word<<8 | word>>8
+		}
+	}
+	return words
+}
+
+func clamp(value float64, min float64, max float64) float64 {
+	return math.Max(min, math.Min(max, value))
+}
+
+// value is the entry's current value, from its variable or constant.
+func (device *ModbusDevice) value(entry *RegisterEntry) float64 {
+	if entry.Bind != "" {
+		value, _ := device.Variable(entry.Bind)
+		return value
+	}
+	switch value := entry.Value.(type) {
+	case float64:
+		return value
+	case bool:
+		if value {
+			return 1
+		}
+	}
+	return 0
+}
+
+// registers is the entry's registers as they are read.
+func (device *ModbusDevice) registers(entry *RegisterEntry) []uint16 {
+	if entry.Type == TypeString {
+		text, _ := entry.Value.(string)
+		return entry.encodeString(text)
+	}
+	return entry.encode(device.value(entry))
+}
+
+// ReadBits reads quantity coils or discrete inputs from addr.
+func (device *ModbusDevice) ReadBits(table string, addr uint16, quantity uint16) ([]bool, error) {
+	slots, err := device.slots(table, addr, quantity, false)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]bool, len(slots))
+	for i, slot := range slots {
+		res[i] = device.value(slot.entry) != 0
+	}
+	return res, nil
+}
+
+// WriteCoils writes values to the coils from addr. Nothing is written
+// unless every coil is writable.
+func (device *ModbusDevice) WriteCoils(addr uint16, values []bool) error {
+	slots, err := device.slots(TableCoils, addr, uint16(len(values)), true)
+	if err != nil {
+		return err
+	}
+	for i, slot := range slots {
+		value := 0.0
+		if values[i] {
+			value = 1
+		}
+		if err := device.SetVariable(slot.entry.Bind, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadRegisters reads quantity input or holding registers from addr.
+func (device *ModbusDevice) ReadRegisters(table string, addr uint16, quantity uint16) ([]uint16, error) {
+	slots, err := device.slots(table, addr, quantity, false)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]uint16, len(slots))
+	// multi register values are encoded once so their words agree
+	encoded := make(map[*RegisterEntry][]uint16)
+	for i, slot := range slots {
+		words, ok := encoded[slot.entry]
+		if !ok {
+			words = device.registers(slot.entry)
+			encoded[slot.entry] = words
+		}
+		res[i] = words[slot.word]
+	}
+	return res, nil
+}
+
+// WriteHoldingRegisters writes values to the holding registers from addr.
+// A write to part of a multi register value keeps the other registers as
+// they were. Nothing is written unless every register is writable.
+func (device *ModbusDevice) WriteHoldingRegisters(addr uint16, values []uint16) error {
+	slots, err := device.slots(TableHoldingRegisters, addr, uint16(len(values)), true)
+	if err != nil {
+		return err
+	}
+	written := make(map[*RegisterEntry][]uint16)
+	var order []*RegisterEntry
+	for i, slot := range slots {
+		words, ok := written[slot.entry]
+		if !ok {
+			words = device.registers(slot.entry)
+			written[slot.entry] = words
+			order = append(order, slot.entry)
+		}
+		words[slot.word] = values[i]
+	}
+	for _, entry := range order {
+		if err := device.SetVariable(entry.Bind, entry.decode(written[entry])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// slots looks up every address of a request, failing with an illegal data
+// address exception when one is not declared or, for writes, not writable.
+func (device *ModbusDevice) slots(table string, addr uint16, quantity uint16, write bool) ([]registerSlot, error) {
+	registers, ok := device.tables[table]
+	if !ok || int(addr)+int(quantity) > 0x10000 {
+		return nil, modbus.ErrIllegalDataAddress
+	}
+	slots := make([]registerSlot, quantity)
+	for i := range slots {
+		slot, ok := registers.slots[addr+uint16(i)]
+		if !ok || (write && slot.entry.Access != AccessReadWrite) {
+			return nil, modbus.ErrIllegalDataAddress
+		}
+		slots[i] = slot
+	}
+	return slots, nil
+}
@@ -0,0 +1,70 @@
+package modbusServer
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRegisterEncodeDecode(t *testing.T) {
+	tests := []struct {
+		kind      string
+		wordOrder string
+		byteOrder string
+		value     float64
+		words     []uint16
+	}{
+		{TypeInt16, OrderBig, OrderBig, -2, []uint16{0xfffe}},
+		{TypeInt16, OrderBig, OrderLittle, 0x1234, []uint16{0x3412}},
+		{TypeUint16, OrderBig, OrderBig, 0xfffe, []uint16{0xfffe}},
+		{TypeInt32, OrderBig, OrderBig, 0x12345678, []uint16{0x1234, 0x5678}},
+		{TypeInt32, OrderLittle, OrderBig, 0x12345678, []uint16{0x5678, 0x1234}},
+		{TypeInt32, OrderBig, OrderBig, -2, []uint16{0xffff, 0xfffe}},
+		{TypeUint32, OrderBig, OrderLittle, 0x12345678, []uint16{0x3412, 0x7856}},
+		{TypeUint32, OrderLittle, OrderLittle, 0x12345678, []uint16{0x7856, 0x3412}},
+		{TypeFloat32, OrderBig, OrderBig, 1.5, []uint16{0x3fc0, 0x0000}},
+		{TypeFloat32, OrderLittle, OrderBig, 1.5, []uint16{0x0000, 0x3fc0}},
+		{TypeFloat32, OrderBig, OrderLittle, 1.5, []uint16{0xc03f, 0x0000}},
+	}
+	for _, test := range tests {
+		name := fmt.Sprintf("%s %s words %s bytes %v", test.kind, test.wordOrder, test.byteOrder, test.value)
+		t.Run(name, func(t *testing.T) {
+			entry := RegisterEntry{Type: test.kind, WordOrder: test.wordOrder, ByteOrder: test.byteOrder, Scale: 1}
+			if words := entry.encode(test.value); fmt.Sprintf("%04x", words) != fmt.Sprintf("%04x", test.words) {
+				t.Errorf("encode gave %04x, want %04x", words, test.words)
+			}
+			if value := entry.decode(test.words); value != test.value {
+				t.Errorf("decode gave %v, want %v", value, test.value)
+			}
+		})
+	}
+}
+
+func TestScaledSetpointReadsBackAsWritten(t *testing.T) {
+	device, err := NewModbusDeviceFromConfig(DeviceConfig{
+		DeviceID:   "1",
+		Target:     "70",
+		UpperBound: "90",
+		Registers: &RegisterMap{
+			HoldingRegisters: []RegisterEntry{
+				{Address: 0, Name: "target", Scale: 10, Access: AccessReadWrite, Bind: "target"},
+				{Address: 1, Name: "upperBound", Scale: 10, Access: AccessReadWrite, Bind: "upperBound"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := device.WriteHoldingRegisters(0, []uint16{755, 903}); err != nil {
+		t.Fatal(err)
+	}
+	words, err := device.ReadRegisters(TableHoldingRegisters, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if words[0] != 755 || words[1] != 903 {
+		t.Errorf("wrote [755 903], read back %v", words)
+	}
+	if target, _ := device.Variable("target"); target != 75.5 {
+		t.Errorf("target is %v, want 75.5", target)
+	}
+}
@@ -0,0 +1,79 @@
+package modbusServer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// DefaultTick is how often the Scheduler steps the devices unless SIM_TICK
+// says otherwise.
+const DefaultTick = 2 * time.Second
+
+// Scheduler steps every device of a handler once per tick, in device id
+// order. Every step advances the process by exactly Tick however late the
+// ticker fires, so a seeded run replays the same way.
+type Scheduler struct {
+	Handler *ModbusHandler
+	Tick    time.Duration
+}
+
+// NewSchedulerFromEnv reads the simulation settings:
+//
+//	SIM_TICK  simulation step, such as 500ms, defaults to 2s
+//	SIM_SEED  seeds every device's random numbers, for reproducible runs
+func NewSchedulerFromEnv(handler *ModbusHandler) (*Scheduler, error) {
+	scheduler := &Scheduler{Handler: handler, Tick: DefaultTick}
+	if value := os.Getenv("SIM_TICK"); value != "" {
+		tick, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("SIM_TICK: %w", err)
+		}
+		if tick <= 0 {
+			return nil, fmt.Errorf("SIM_TICK must be positive")
+		}
+		scheduler.Tick = tick
+	}
+	if value := os.Getenv("SIM_SEED"); value != "" {
+		seed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("SIM_SEED: %w", err)
+		}
+		for _, device := range handler.Device {
+			device.Seed(seed)
+		}
+		log.Printf("Simulation seeded with %d", seed)
+	}
+	return scheduler, nil
+}
+
+// Run steps the devices until ctx is done.
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.Tick)
+	defer ticker.Stop()
+	log.Printf("Simulating %d devices every %s", len(s.Handler.Device), s.Tick)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.Step()
+		}
+	}
+}
+
+// Step advances every device by one tick.
+func (s *Scheduler) Step() {
+	ids := make([]int, 0, len(s.Handler.Device))
+	for id := range s.Handler.Device {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		s.Handler.SimulateActivity(s.Handler.Device[uint8(id)], s.Tick)
+	}
+}
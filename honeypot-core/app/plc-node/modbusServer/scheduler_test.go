@@ -0,0 +1,71 @@
+package modbusServer
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// seededRun steps a main pump, its standby and a cooled heater and traces
+// every device's reading and state.
+func seededRun(t *testing.T, seed string) string {
+	t.Helper()
+	pump := func(id string, standby bool, neighbors ...string) DeviceConfig {
+		return DeviceConfig{
+			DeviceID: id, Target: "80", UpperBound: "1000", UpperWarn: "1000",
+			MetaData: DeviceMetaData{ProcessNeighbors: neighbors},
+			Process: &ProcessConfig{
+				Model: ModelPump, TimeConstant: 4, FaultRate: 20, Standby: standby,
+				Noise: map[string]float64{"flow": 0.4, "pressure": 0.02},
+				Pump:  &PumpConfig{RatedFlow: 100, RatedPressure: 4.5, ShutoffPressure: 6.2, StaticPressure: 1.2, PressureTimeConstant: 8},
+			},
+		}
+	}
+	configs := []DeviceConfig{
+		pump("101", false),
+		pump("102", true, "101"),
+		{
+			DeviceID: "103", Target: "60", UpperBound: "1000", UpperWarn: "1000",
+			MetaData: DeviceMetaData{ProcessNeighbors: []string{"101", "102"}},
+			Process: &ProcessConfig{
+				Model: ModelThermal, Noise: map[string]float64{"temperature": 0.3},
+				Thermal: &ThermalConfig{Ambient: 20, HeatingRate: 0.5, CoolingTime: 100, Gain: 0.2, HeatLoad: 0.3, FlowCooling: 0.0005},
+			},
+		},
+	}
+	handler := &ModbusHandler{Device: make(map[uint8]*ModbusDevice), Graph: NewProcessGraph()}
+	for _, config := range configs {
+		device, err := NewModbusDeviceFromConfig(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler.Device[device.deviceID] = device
+	}
+	t.Setenv("SIM_SEED", seed)
+	scheduler, err := NewSchedulerFromEnv(handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var trace strings.Builder
+	for step := 0; step < 500; step++ {
+		scheduler.Step()
+		for _, id := range []uint8{101, 102, 103} {
+			device := handler.Device[id]
+			fmt.Fprintf(&trace, "%d %d %v %v\n", step, id, device.reading, device.State())
+		}
+	}
+	return trace.String()
+}
+
+func TestSeededRunsRepeat(t *testing.T) {
+	first := seededRun(t, "42")
+	if second := seededRun(t, "42"); second != first {
+		t.Error("two runs with SIM_SEED=42 differ")
+	}
+	if !strings.Contains(first, "fault:true") {
+		t.Error("no device faulted, the run does not exercise the fault draws")
+	}
+	if other := seededRun(t, "43"); other == first {
+		t.Error("SIM_SEED=43 replays the run of 42")
+	}
+}
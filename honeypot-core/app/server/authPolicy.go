@@ -0,0 +1,264 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuthAttempt is a single login attempt as seen by the SSH server.
+type AuthAttempt struct {
+	Time           time.Time `json:"time"`
+	RemoteAddr     string    `json:"remoteAddr"`
+	ClientVersion  string    `json:"clientVersion"`
+	SessionID      string    `json:"sessionId"`
+	User           string    `json:"user"`
+	Method         string    `json:"method"`
+	Password       string    `json:"password,omitempty"`
+	KeyType        string    `json:"keyType,omitempty"`
+	KeyFingerprint string    `json:"keyFingerprint,omitempty"`
+	Accepted       bool      `json:"accepted"`
+}
+
+// CredentialPolicy decides whether a password attempt is let in.
+type CredentialPolicy interface {
+	Allow(attempt *AuthAttempt) bool
+}
+
+// AttemptRecorder stores login attempts for later analysis.
+type AttemptRecorder interface {
+	RecordAttempt(attempt AuthAttempt)
+}
+
+// AcceptList accepts exact username/password pairs.
+type AcceptList map[string]map[string]bool
+
+func NewAcceptList(credentials []Credential) AcceptList {
+	list := AcceptList{}
+	for _, c := range credentials {
+		if list[c.User] == nil {
+			list[c.User] = map[string]bool{}
+		}
+		list[c.User][c.Password] = true
+	}
+	return list
+}
+
+func (l AcceptList) Allow(attempt *AuthAttempt) bool {
+	return l[attempt.User][attempt.Password]
+}
+
+// AnyPasswordUsers accepts every password for the listed usernames.
+type AnyPasswordUsers map[string]bool
+
+func (u AnyPasswordUsers) Allow(attempt *AuthAttempt) bool {
+	return u[attempt.User]
+}
+
+// Wordlist accepts any username whose password is in a weak password list.
+type Wordlist map[string]bool
+
+// LoadWordlist reads one password per line, skipping blank lines and
+// lines starting with '#'.
+func LoadWordlist(path string) (Wordlist, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening wordlist: %w", err)
+	}
+	defer file.Close()
+	words := Wordlist{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		word := strings.TrimRight(scanner.Text(), "\r")
+		if word == "" || strings.HasPrefix(word, "#") {
+			continue
+		}
+		words[word] = true
+	}
+	return words, scanner.Err()
+}
+
+func (w Wordlist) Allow(attempt *AuthAttempt) bool {
+	return w[attempt.Password]
+}
+
+// DefaultAcceptAfterTTL is how long AcceptAfter remembers a host that has
+// gone quiet.
+const DefaultAcceptAfterTTL = 24 * time.Hour
+
+// AcceptAfter accepts the Nth password attempt from a remote host, counted
+// across connections. The accepted pair is remembered so the attacker can log
+// back in with it, like a real account. Hosts quiet for TTL are forgotten, so
+// a scan from many sources does not grow the maps forever.
+type AcceptAfter struct {
+	Tries int
+	TTL   time.Duration
+
+	lock      sync.Mutex
+	counts    map[string]hostAttempts
+	accepted  map[string]acceptedCredential
+	lastSweep time.Time
+}
+
+type hostAttempts struct {
+	count int
+	last  time.Time
+}
+
+type acceptedCredential struct {
+	Credential
+	last time.Time
+}
+
+func NewAcceptAfter(tries int) *AcceptAfter {
+	return &AcceptAfter{
+		Tries:     tries,
+		TTL:       DefaultAcceptAfterTTL,
+		counts:    make(map[string]hostAttempts),
+		accepted:  make(map[string]acceptedCredential),
+		lastSweep: time.Now(),
+	}
+}
+
+func (a *AcceptAfter) Allow(attempt *AuthAttempt) bool {
+	host := remoteHost(attempt.RemoteAddr)
+	now := time.Now()
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.sweep(now)
+	if c, ok := a.accepted[host]; ok && now.Sub(c.last) <= a.TTL {
+		if c.User != attempt.User || c.Password != attempt.Password {
+			return false
+		}
+		c.last = now
+		a.accepted[host] = c
+		return true
+	}
+	delete(a.accepted, host)
+	counted := a.counts[host]
+	if now.Sub(counted.last) > a.TTL {
+		counted.count = 0
+	}
+	counted.count++
+	counted.last = now
+	if counted.count < a.Tries {
+		a.counts[host] = counted
+		return false
+	}
+	a.accepted[host] = acceptedCredential{
+		Credential: Credential{User: attempt.User, Password: attempt.Password},
+		last:       now,
+	}
+	delete(a.counts, host)
+	return true
+}
+
+// sweep drops the hosts quiet for TTL, at most once a minute.
+func (a *AcceptAfter) sweep(now time.Time) {
+	if now.Sub(a.lastSweep) < time.Minute {
+		return
+	}
+	a.lastSweep = now
+	for host, counted := range a.counts {
+		if now.Sub(counted.last) > a.TTL {
+			delete(a.counts, host)
+		}
+	}
+	for host, c := range a.accepted {
+		if now.Sub(c.last) > a.TTL {
+			delete(a.accepted, host)
+		}
+	}
+}
+
+// AnyPolicy accepts an attempt when one of its policies does. Policies are
+// asked in order and the first to accept wins, so a counting policy placed
+// last only counts the attempts the others rejected.
+type AnyPolicy []CredentialPolicy
+
+func (p AnyPolicy) Allow(attempt *AuthAttempt) bool {
+	for _, policy := range p {
+		if policy.Allow(attempt) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewCredentialPolicy builds the combined policy described by config.
+func NewCredentialPolicy(config AuthConfig) (CredentialPolicy, error) {
+	var policy AnyPolicy
+	if len(config.Credentials) > 0 {
+		policy = append(policy, NewAcceptList(config.Credentials))
+	}
+	if len(config.AnyPasswordUsers) > 0 {
+		users := AnyPasswordUsers{}
+		for _, user := range config.AnyPasswordUsers {
+			users[user] = true
+		}
+		policy = append(policy, users)
+	}
+	if config.Wordlist != "" {
+		words, err := LoadWordlist(config.Wordlist)
+		if err != nil {
+			return nil, err
+		}
+		policy = append(policy, words)
+	}
+	// last, it counts only what the others rejected
+	if config.AcceptAfter > 0 {
+		policy = append(policy, NewAcceptAfter(config.AcceptAfter))
+	}
+	return policy, nil
+}
+
+// AttemptLog writes attempts as JSON lines.
+type AttemptLog struct {
+	lock sync.Mutex
+	out  io.Writer
+}
+
+// NewAttemptLog appends to the file at path, or only logs when path is empty.
+func NewAttemptLog(path string) (*AttemptLog, error) {
+	if path == "" {
+		return &AttemptLog{}, nil
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("opening attempt log: %w", err)
+	}
+	return &AttemptLog{out: file}, nil
+}
+
+func (l *AttemptLog) RecordAttempt(attempt AuthAttempt) {
+	log.Printf("Auth attempt from %s user=%q method=%s accepted=%v",
+		attempt.RemoteAddr, attempt.User, attempt.Method, attempt.Accepted)
+	if l.out == nil {
+		return
+	}
+	line, err := json.Marshal(attempt)
+	if err != nil {
+		log.Printf("Failed to marshal auth attempt: %v", err)
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if _, err := l.out.Write(append(line, '\n')); err != nil {
+		log.Printf("Failed to write auth attempt: %v", err)
+	}
+}
+
+func remoteHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func attempt(addr, user, password string) *AuthAttempt {
+	return &AuthAttempt{RemoteAddr: addr, User: user, Password: password}
+}
+
+func TestStaticPolicies(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wordlist.txt")
+	if err := os.WriteFile(path, []byte("# weak passwords\n123456\r\n\nadmin\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	words, err := LoadWordlist(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acceptList := NewAcceptList([]Credential{{User: "root", Password: "toor"}, {User: "root", Password: "root"}})
+	tests := []struct {
+		name     string
+		policy   CredentialPolicy
+		user     string
+		password string
+		allowed  bool
+	}{
+		{"accept list pair", acceptList, "root", "toor", true},
+		{"accept list second password", acceptList, "root", "root", true},
+		{"accept list wrong password", acceptList, "root", "admin", false},
+		{"accept list password of another user", acceptList, "admin", "toor", false},
+		{"any password user", AnyPasswordUsers{"pi": true}, "pi", "whatever", true},
+		{"any password other user", AnyPasswordUsers{"pi": true}, "root", "whatever", false},
+		{"wordlist line with CRLF", words, "anyone", "123456", true},
+		{"wordlist last line", words, "root", "admin", true},
+		{"wordlist comment", words, "root", "# weak passwords", false},
+		{"wordlist blank", words, "root", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if allowed := test.policy.Allow(attempt("10.0.0.1:4000", test.user, test.password)); allowed != test.allowed {
+				t.Errorf("Allow(%s/%s) = %v, want %v", test.user, test.password, allowed, test.allowed)
+			}
+		})
+	}
+}
+
+func TestAcceptAfter(t *testing.T) {
+	steps := []struct {
+		addr     string
+		user     string
+		password string
+		allowed  bool
+	}{
+		{"10.0.0.1:4000", "root", "a", false},
+		{"10.0.0.1:4001", "root", "b", false},
+		// the count is per host across connections, the third is let in
+		{"10.0.0.1:4002", "admin", "c", true},
+		// and the accepted pair is the only one that works from then on
+		{"10.0.0.1:4003", "admin", "c", true},
+		{"10.0.0.1:4004", "root", "a", false},
+		{"10.0.0.1:4005", "admin", "d", false},
+		// another host counts on its own
+		{"10.0.0.2:4000", "admin", "c", false},
+	}
+	policy := NewAcceptAfter(3)
+	for i, step := range steps {
+		if allowed := policy.Allow(attempt(step.addr, step.user, step.password)); allowed != step.allowed {
+			t.Errorf("step %d from %s %s/%s: Allow = %v, want %v", i, step.addr, step.user, step.password, allowed, step.allowed)
+		}
+	}
+}
+
+// age moves every time AcceptAfter remembers back by d.
+func age(a *AcceptAfter, d time.Duration) {
+	a.lastSweep = a.lastSweep.Add(-d)
+	for host, counted := range a.counts {
+		counted.last = counted.last.Add(-d)
+		a.counts[host] = counted
+	}
+	for host, c := range a.accepted {
+		c.last = c.last.Add(-d)
+		a.accepted[host] = c
+	}
+}
+
+func TestAcceptAfterForgetsQuietHosts(t *testing.T) {
+	policy := NewAcceptAfter(2)
+	policy.TTL = time.Hour
+	// 10.0.0.1 is halfway to a login, 10.0.0.2 logged in
+	policy.Allow(attempt("10.0.0.1:4000", "root", "a"))
+	policy.Allow(attempt("10.0.0.2:4000", "root", "a"))
+	policy.Allow(attempt("10.0.0.2:4001", "root", "b"))
+
+	age(policy, 30*time.Minute)
+	if !policy.Allow(attempt("10.0.0.2:4002", "root", "b")) {
+		t.Fatal("the accepted pair was forgotten within the TTL")
+	}
+	// using the pair keeps it, the count of 10.0.0.1 goes past the TTL
+	age(policy, 45*time.Minute)
+	if !policy.Allow(attempt("10.0.0.2:4003", "root", "b")) {
+		t.Fatal("the accepted pair was forgotten although it was in use")
+	}
+	if len(policy.counts) != 0 {
+		t.Errorf("the sweep kept %d quiet hosts", len(policy.counts))
+	}
+	if policy.Allow(attempt("10.0.0.1:4001", "root", "b")) {
+		t.Error("an attempt counted before the TTL was let in")
+	}
+
+	age(policy, 2*time.Hour)
+	// the accepted pair is gone, the host has to count again
+	if policy.Allow(attempt("10.0.0.2:4004", "root", "b")) {
+		t.Error("the accepted pair outlived the TTL")
+	}
+	if !policy.Allow(attempt("10.0.0.2:4005", "admin", "x")) {
+		t.Error("the host did not count again once its pair expired")
+	}
+	if _, ok := policy.counts["10.0.0.1"]; ok {
+		t.Error("the sweep kept a host quiet for longer than the TTL")
+	}
+}
+
+type recordingPolicy struct {
+	name    string
+	allowed bool
+	asked   *[]string
+}
+
+func (p recordingPolicy) Allow(*AuthAttempt) bool {
+	*p.asked = append(*p.asked, p.name)
+	return p.allowed
+}
+
+func TestAnyPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []bool
+		asked   []string
+		want    bool
+	}{
+		{"none accepts", []bool{false, false, false}, []string{"0", "1", "2"}, false},
+		{"first accepts", []bool{true, true, false}, []string{"0"}, true},
+		{"middle accepts", []bool{false, true, true}, []string{"0", "1"}, true},
+		{"last accepts", []bool{false, false, true}, []string{"0", "1", "2"}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var asked []string
+			var policy AnyPolicy
+			for i, allowed := range test.allowed {
+				policy = append(policy, recordingPolicy{name: string(rune('0' + i)), allowed: allowed, asked: &asked})
+			}
+			if allowed := policy.Allow(attempt("10.0.0.1:4000", "root", "root")); allowed != test.want {
+				t.Errorf("Allow = %v, want %v", allowed, test.want)
+			}
+			if len(asked) != len(test.asked) {
+				t.Fatalf("asked %v, want %v", asked, test.asked)
+			}
+			for i := range asked {
+				if asked[i] != test.asked[i] {
+					t.Fatalf("asked %v, want %v", asked, test.asked)
+				}
+			}
+		})
+	}
+}
+
+func TestCredentialPolicyCountsOnlyRejectedAttempts(t *testing.T) {
+	policy, err := NewCredentialPolicy(AuthConfig{
+		Credentials: []Credential{{User: "root", Password: "toor"}},
+		AcceptAfter: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a listed pair is let in without counting towards AcceptAfter
+	for i := 0; i < 3; i++ {
+		if !policy.Allow(attempt("10.0.0.1:4000", "root", "toor")) {
+			t.Fatal("the listed pair was rejected")
+		}
+	}
+	if policy.Allow(attempt("10.0.0.1:4000", "root", "a")) {
+		t.Error("the first unlisted attempt was let in, the listed ones were counted")
+	}
+	if !policy.Allow(attempt("10.0.0.1:4000", "root", "b")) {
+		t.Error("the second unlisted attempt was rejected")
+	}
+}
@@ -0,0 +1,237 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// CastRecorder writes a terminal session as an asciinema v2 .cast file.
+// Attacker keystrokes are stored as "i" events and everything sent back as
+// "o" events, so a replay shows exactly what was typed and what was seen.
+// See https://docs.asciinema.org/manual/asciicast/v2/
+type CastRecorder struct {
+	lock   sync.Mutex
+	file   *os.File
+	start  time.Time
+	width  uint32
+	height uint32
+	term   string
+	// command is the exec command, empty for interactive shells
+	command string
+	// the header is written lazily so the size from pty-req ends up in it
+	headerWritten bool
+	// pending holds the start of a UTF-8 character split across two reads
+	// or writes, by event kind, until the rest of it arrives
+	pending map[string][]byte
+}
+
+type castHeader struct {
+	Version   int               `json:"version"`
+	Width     uint32            `json:"width"`
+	Height    uint32            `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Command   string            `json:"command,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// NewCastRecorder creates <dir>/<sessionID>.cast.
+func NewCastRecorder(dir string, sessionID string) (*CastRecorder, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating recording dir: %w", err)
+	}
+	file, err := os.Create(filepath.Join(dir, sessionID+".cast"))
+	if err != nil {
+		return nil, fmt.Errorf("creating recording: %w", err)
+	}
+	return &CastRecorder{
+		file:    file,
+		start:   time.Now(),
+		width:   80,
+		height:  24,
+		pending: make(map[string][]byte),
+	}, nil
+}
+
+// SetTerminal records the terminal type and size from a pty-req. It only has
+// an effect before the first byte of the session is recorded.
+func (r *CastRecorder) SetTerminal(term string, width, height uint32) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.headerWritten {
+		return
+	}
+	r.term = term
+	if width > 0 && height > 0 {
+		r.width, r.height = width, height
+	}
+}
+
+// SetCommand records the command of an exec request in the header.
+func (r *CastRecorder) SetCommand(command string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.command = command
+}
+
+// Resize records a window-change as an "r" event.
+func (r *CastRecorder) Resize(width, height uint32) {
+	r.event("r", fmt.Sprintf("%dx%d", width, height))
+}
+
+func (r *CastRecorder) Input(data []byte) {
+	r.stream("i", data)
+}
+
+func (r *CastRecorder) Output(data []byte) {
+	r.stream("o", data)
+}
+
+// stream records a chunk of input or output. A character cut in two by the
+// chunking is held back and recorded with the next chunk, json.Marshal would
+// turn each half into U+FFFD.
+func (r *CastRecorder) stream(kind string, data []byte) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.file == nil {
+		return
+	}
+	if pending := r.pending[kind]; len(pending) > 0 {
+		data = append(pending, data...)
+	}
+	complete := completeRunes(data)
+	r.pending[kind] = append([]byte(nil), data[complete:]...)
+	if complete > 0 {
+		r.writeEvent(kind, string(data[:complete]))
+	}
+}
+
+// completeRunes returns the length of data without a trailing incomplete
+// UTF-8 character.
+func completeRunes(data []byte) int {
+	for i := len(data) - 1; i >= 0 && i > len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if utf8.FullRune(data[i:]) {
+				return len(data)
+			}
+			return i
+		}
+	}
+	return len(data)
+}
+
+func (r *CastRecorder) event(kind string, data string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.file == nil {
+		return
+	}
+	r.writeEvent(kind, data)
+}
+
+// writeEvent must be called with the lock held.
+func (r *CastRecorder) writeEvent(kind string, data string) {
+	r.writeHeader()
+	elapsed := time.Since(r.start).Seconds()
+	r.writeLine([]interface{}{elapsed, kind, data})
+}
+
+// writeHeader must be called with the lock held.
+func (r *CastRecorder) writeHeader() {
+	if r.headerWritten {
+		return
+	}
+	r.headerWritten = true
+	header := castHeader{
+		Version:   2,
+		Width:     r.width,
+		Height:    r.height,
+		Timestamp: r.start.Unix(),
+		Command:   r.command,
+	}
+	if r.term != "" {
+		header.Env = map[string]string{"TERM": r.term}
+	}
+	r.writeLine(header)
+}
+
+func (r *CastRecorder) writeLine(v interface{}) {
+	line, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Failed to marshal cast event: %v", err)
+		return
+	}
+	if _, err := r.file.Write(append(line, '\n')); err != nil {
+		log.Printf("Failed to write cast event: %v", err)
+	}
+}
+
+func (r *CastRecorder) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	r.writeHeader()
+	// a character the session never finished is recorded as it is
+	for _, kind := range []string{"i", "o"} {
+		if pending := r.pending[kind]; len(pending) > 0 {
+			r.writeEvent(kind, string(pending))
+		}
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+// recordedChannel tees everything read from and written to an ssh.Channel
+// into a CastRecorder.
+type recordedChannel struct {
+	ssh.Channel
+	recorder *CastRecorder
+}
+
+func newRecordedChannel(channel ssh.Channel, recorder *CastRecorder) *recordedChannel {
+	return &recordedChannel{Channel: channel, recorder: recorder}
+}
+
+func (c *recordedChannel) Read(data []byte) (int, error) {
+	n, err := c.Channel.Read(data)
+	if n > 0 {
+		c.recorder.Input(data[:n])
+	}
+	return n, err
+}
+
+func (c *recordedChannel) Write(data []byte) (int, error) {
+	n, err := c.Channel.Write(data)
+	if n > 0 {
+		c.recorder.Output(data[:n])
+	}
+	return n, err
+}
+
+func (c *recordedChannel) Stderr() io.ReadWriter {
+	return &recordedStderr{ReadWriter: c.Channel.Stderr(), recorder: c.recorder}
+}
+
+type recordedStderr struct {
+	io.ReadWriter
+	recorder *CastRecorder
+}
+
+func (e *recordedStderr) Write(data []byte) (int, error) {
+	n, err := e.ReadWriter.Write(data)
+	if n > 0 {
+		e.recorder.Output(data[:n])
+	}
+	return n, err
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// castEvents reads the events of a cast file back, by kind.
+func castEvents(t *testing.T, path string) map[string][]string {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	events := map[string][]string{}
+	scanner := bufio.NewScanner(file)
+	// the first line is the header
+	scanner.Scan()
+	for scanner.Scan() {
+		var event []interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("event %s: %v", scanner.Text(), err)
+		}
+		kind := event[1].(string)
+		events[kind] = append(events[kind], event[2].(string))
+	}
+	return events
+}
+
+func TestCastRecorderJoinsSplitCharacters(t *testing.T) {
+	dir := t.TempDir()
+	recorder, err := NewCastRecorder(dir, "split")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// "é" is 0xc3 0xa9, "€" is 0xe2 0x82 0xac
+	recorder.Output([]byte("caf\xc3"))
+	recorder.Output([]byte("\xa9\n"))
+	recorder.Input([]byte("\xe2"))
+	recorder.Input([]byte("\x82"))
+	recorder.Input([]byte("\xac5\r"))
+	// a character the session never finished is flushed on Close
+	recorder.Output([]byte("ok \xc3"))
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	events := castEvents(t, filepath.Join(dir, "split.cast"))
+	want := map[string][]string{
+		"o": {"caf", "é\n", "ok ", "�"},
+		"i": {"€5\r"},
+	}
+	for kind, chunks := range want {
+		if len(events[kind]) != len(chunks) {
+			t.Fatalf("%q events %q, want %q", kind, events[kind], chunks)
+		}
+		for i := range chunks {
+			if events[kind][i] != chunks[i] {
+				t.Errorf("%q event %d is %q, want %q", kind, i, events[kind][i], chunks[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/JonathanKoerber/CityUCapstoneMSCS/honeypot-core/app/emulator"
+)
+
+// SSHConfig is the SSH side of the honeypot: the auth policy, recording and
+// backend shared by every listener, and the listeners with their ports,
+// personas and backends. It is read from the JSON file named by SSH_CONFIG;
+// when that is unset DefaultSSHConfig is used.
+type SSHConfig struct {
+	Auth AuthConfig `json:"auth"`
+	// RecordingDir is where asciinema recordings of every session are
+	// written. Recording is disabled when it is empty.
+	RecordingDir string `json:"recordingDir"`
+	// Backend picks what serves each session: the ics-host container, the
+	// LLM or a hybrid of both.
+	Backend emulator.BackendConfig `json:"backend"`
+	// Persona is the host emulated shells pretend to be, the name of a file
+	// in PersonaDir or a path to a .json file. Empty is the default persona.
+	Persona    string `json:"persona"`
+	PersonaDir string `json:"personaDir"`
+	// Listeners run one server per port, each with its own persona. When
+	// empty a single server listens on the default port with Persona.
+	Listeners []ListenerConfig `json:"listeners"`
+}
+
+// ListenerConfig is a port and the persona served on it, an empty persona
+// falls back to SSHConfig.Persona.
+type ListenerConfig struct {
+	Port    int    `json:"port"`
+	Persona string `json:"persona"`
+	// Backend serves every session of the listener, ignoring the backend
+	// rules. Set it when the persona is not the OS of the ics-host
+	// container, proxying would give the host away.
+	Backend string `json:"backend"`
+}
+
+// backendFor is the backend config of a listener.
+func (c SSHConfig) backendFor(listener ListenerConfig) emulator.BackendConfig {
+	backend := c.Backend
+	if listener.Backend != "" {
+		backend.Default = listener.Backend
+		backend.Rules = nil
+	}
+	return backend
+}
+
+// Credential is a single username/password pair.
+type Credential struct {
+	User     string `json:"user"`
+	Password string `json:"password"`
+}
+
+// AuthConfig describes which login attempts the honeypot lets through and
+// where every attempt is recorded. The policies are combined, an attempt is
+// accepted as soon as one of them accepts it.
+type AuthConfig struct {
+	// Credentials is an accept-list of exact username/password pairs.
+	Credentials []Credential `json:"credentials"`
+	// AcceptAfter accepts any password once a remote host has made this many
+	// password attempts. Zero disables the policy.
+	AcceptAfter int `json:"acceptAfter"`
+	// AnyPasswordUsers accepts every password for these usernames.
+	AnyPasswordUsers []string `json:"anyPasswordUsers"`
+	// Wordlist is the path to a file of weak passwords, one per line, that
+	// are accepted for any username.
+	Wordlist string `json:"wordlist"`
+	// AttemptLog is the path of a JSON lines file every attempt is appended
+	// to. When empty attempts are only written to the log.
+	AttemptLog string `json:"attemptLog"`
+}
+
+func DefaultSSHConfig() SSHConfig {
+	return SSHConfig{
+		Auth: AuthConfig{
+			Credentials: []Credential{{User: "admin", Password: "password"}},
+		},
+		Backend:    emulator.DefaultBackendConfig(),
+		PersonaDir: "config/personas",
+	}
+}
+
+// LoadSSHConfig reads the config file at path. An empty path returns the
+// defaults.
+func LoadSSHConfig(path string) (SSHConfig, error) {
+	config := DefaultSSHConfig()
+	if path == "" {
+		return config, nil
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return config, fmt.Errorf("reading ssh config: %w", err)
+	}
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return config, fmt.Errorf("parsing ssh config %s: %w", path, err)
+	}
+	if err := config.Backend.Validate(); err != nil {
+		return config, fmt.Errorf("ssh config %s: %w", path, err)
+	}
+	ports := make(map[int]bool)
+	for i, listener := range config.Listeners {
+		if listener.Port <= 0 || listener.Port > 65535 {
+			return config, fmt.Errorf("ssh config %s: listener %d: invalid port %d", path, i, listener.Port)
+		}
+		if ports[listener.Port] {
+			return config, fmt.Errorf("ssh config %s: listener %d: port %d is used twice", path, i, listener.Port)
+		}
+		ports[listener.Port] = true
+		if err := config.backendFor(listener).Validate(); err != nil {
+			return config, fmt.Errorf("ssh config %s: listener %d: %w", path, i, err)
+		}
+	}
+	return config, nil
+}
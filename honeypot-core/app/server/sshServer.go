@@ -6,29 +6,101 @@
 package server
 
 import (
+	"encoding/hex"
 	"fmt"
 	"golang.org/x/crypto/ssh"
 	"log"
 	"net"
 	"os"
+	"path"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/JonathanKoerber/CityUCapstoneMSCS/honeypot-core/app/emulator"
+	"github.com/JonathanKoerber/CityUCapstoneMSCS/honeypot-core/app/events"
 )
 
 type SSHServer struct {
 	Config   *ssh.ServerConfig
 	Port     int
 	Listener net.Listener
+	// Policy decides which password attempts are accepted.
+	Policy CredentialPolicy
+	// Attempts receives every password, keyboard-interactive and public key
+	// attempt.
+	Attempts AttemptRecorder
+	// RecordingDir holds a .cast file per session, empty disables recording.
+	RecordingDir string
+	// Backend selects the session backend per connection.
+	Backend emulator.BackendConfig
+	// Persona is the host this listener pretends to be, from its SSH
+	// version string to the emulated shell.
+	Persona *emulator.Persona
+	// Events receives connections, logins, commands and file transfers,
+	// may be nil.
+	Events *events.Bus
 }
 
-func NewSSHServer(port int) (*SSHServer, error) {
-	return &SSHServer{Port: port}, nil
+// NewSSHServers creates a server per listener of the config file named by
+// SSH_CONFIG, or a single server on port when it has no listeners. The
+// servers share the credential policy and attempt log.
+func NewSSHServers(port int) ([]*SSHServer, error) {
+	config, err := LoadSSHConfig(os.Getenv("SSH_CONFIG"))
+	if err != nil {
+		return nil, err
+	}
+	policy, err := NewCredentialPolicy(config.Auth)
+	if err != nil {
+		return nil, err
+	}
+	attempts, err := NewAttemptLog(config.Auth.AttemptLog)
+	if err != nil {
+		return nil, err
+	}
+	listeners := config.Listeners
+	if len(listeners) == 0 {
+		listeners = []ListenerConfig{{Port: port}}
+	}
+	var servers []*SSHServer
+	for _, listener := range listeners {
+		name := listener.Persona
+		if name == "" {
+			name = config.Persona
+		}
+		persona, err := emulator.LoadPersona(config.PersonaDir, name)
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, &SSHServer{
+			Port:         listener.Port,
+			Policy:       policy,
+			Attempts:     attempts,
+			RecordingDir: config.RecordingDir,
+			Backend:      config.backendFor(listener),
+			Persona:      persona,
+		})
+	}
+	return servers, nil
+}
+
+func newAuthAttempt(c ssh.ConnMetadata, method string) AuthAttempt {
+	return AuthAttempt{
+		Time:          time.Now().UTC(),
+		RemoteAddr:    c.RemoteAddr().String(),
+		ClientVersion: string(c.ClientVersion()),
+		SessionID:     hex.EncodeToString(c.SessionID()),
+		User:          c.User(),
+		Method:        method,
+	}
 }
 
 func (s *SSHServer) Start() {
 	// Todo: Figure how I want to auth.
-	log.Printf("Starting server on port %d", 2222)
+	if s.Persona == nil {
+		s.Persona = emulator.DefaultPersona()
+	}
+	log.Printf("Starting server on port %d as %s", s.Port, s.Persona.Name)
 	authorizedKeysBytes, err := os.ReadFile("authorized_keys")
 
 	if err != nil {
@@ -47,19 +119,33 @@ func (s *SSHServer) Start() {
 	// An SSH server is represented by a ServerConfig, which holds
 	// certificate details and handles authentication of ServerConns.
 	s.Config = &ssh.ServerConfig{
+		ServerVersion: s.Persona.SSHVersion,
 		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
-			// this  login with password
-			if c.User() == "admin" && string(pass) == "password" {
-				return nil, nil
+			return s.passwordAttempt(c, "password", string(pass))
+		},
+		// many clients and bots try keyboard-interactive before password,
+		// ask for the password the same way sshd does
+		KeyboardInteractiveCallback: func(c ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			answers, err := client("", "", []string{"Password: "}, []bool{false})
+			if err != nil {
+				return nil, err
 			}
-			return nil, fmt.Errorf("password rejected for %q", c.User())
+			if len(answers) != 1 {
+				return nil, fmt.Errorf("keyboard-interactive got %d answers", len(answers))
+			}
+			return s.passwordAttempt(c, "keyboard-interactive", answers[0])
 		},
 		// public key auth
 		PublicKeyCallback: func(c ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
-			if authorizedKeysMap[string(pubKey.Marshal())] {
+			attempt := newAuthAttempt(c, "publickey")
+			attempt.KeyType = pubKey.Type()
+			attempt.KeyFingerprint = ssh.FingerprintSHA256(pubKey)
+			attempt.Accepted = authorizedKeysMap[string(pubKey.Marshal())]
+			s.recordAttempt(attempt)
+			if attempt.Accepted {
 				return &ssh.Permissions{
 					Extensions: map[string]string{
-						"pubkey-fp": ssh.FingerprintSHA256(pubKey),
+						"pubkey-fp": attempt.KeyFingerprint,
 					},
 				}, nil
 			}
@@ -78,7 +164,7 @@ func (s *SSHServer) Start() {
 	s.Config.AddHostKey(private)
 	log.Println("Added host key")
 	// host config done host can now be configured
-	s.Listener, err = net.Listen("tcp", "0.0.0.0:2222")
+	s.Listener, err = net.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", s.Port))
 	if err != nil {
 		log.Printf("Failed to listen, err: %v", err)
 	}
@@ -87,12 +173,28 @@ func (s *SSHServer) Start() {
 func (s *SSHServer) HandleConn(nConn net.Conn, sshEmulator emulator.SSHEmulator) { // create network connection
 
 	log.Printf("Accepted incoming connection from %s", nConn.RemoteAddr())
+	opened := time.Now()
+	s.Events.Publish(&events.ConnectionOpened{
+		Header:    events.Header{Protocol: events.ProtocolSSH, RemoteAddr: nConn.RemoteAddr().String()},
+		LocalAddr: nConn.LocalAddr().String(),
+	})
+	closed := &events.ConnectionClosed{
+		Header:    events.Header{Protocol: events.ProtocolSSH, RemoteAddr: nConn.RemoteAddr().String()},
+		LocalAddr: nConn.LocalAddr().String(),
+	}
+	defer func() {
+		closed.DurationMs = float64(time.Since(opened).Microseconds()) / 1000
+		s.Events.Publish(closed)
+	}()
 
 	// before conn used
 	// handshake must be preformed on the incomming conn
 	conn, chans, reqs, err := ssh.NewServerConn(nConn, s.Config)
 	if err != nil {
 		log.Printf("Failed to handshake, err: %v", err)
+		closed.Reason = "handshake failed: " + err.Error()
+		nConn.Close()
+		return
 	}
 	if conn.Permissions != nil {
 		if fp, ok := conn.Permissions.Extensions["pubkey-fp"]; ok {
@@ -113,8 +215,19 @@ func (s *SSHServer) HandleConn(nConn net.Conn, sshEmulator emulator.SSHEmulator)
 		wg.Done()
 	}()
 
+	sessionID := hex.EncodeToString(conn.SessionID())
+	closed.SessionID = sessionID
+	backendName := s.Backend.Select(conn.RemoteAddr(), conn.User())
+	backend, err := sshEmulator.NewBackend(backendName, s.Backend, s.Persona)
+	if err != nil {
+		log.Printf("Failed to create %s backend: %v", backendName, err)
+		conn.Close()
+		return
+	}
+	log.Printf("Serving %s@%s with %s backend", conn.User(), conn.RemoteAddr(), backendName)
+	channelCount := 0
 	for newChannel := range chans {
-		log.Printf("New channel from %s", newChannel.ChannelType(), newChannel.ExtraData())
+		log.Printf("New %s channel from %s", newChannel.ChannelType(), conn.RemoteAddr())
 		// check channel type
 		if newChannel.ChannelType() != "session" {
 			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
@@ -123,29 +236,229 @@ func (s *SSHServer) HandleConn(nConn net.Conn, sshEmulator emulator.SSHEmulator)
 		channel, requests, err := newChannel.Accept()
 		if err != nil {
 			log.Printf("Failed to accept channel, err: %v", err)
+			continue
+		}
+		recorder := s.newRecorder(fmt.Sprintf("%s-%d", sessionID, channelCount))
+		channelCount++
+		if recorder != nil {
+			channel = newRecordedChannel(channel, recorder)
 		}
-		//
 		wg.Add(1)
-		go func(in <-chan *ssh.Request) {
-			for req := range in {
-				switch req.Type {
-				case "pty-req":
-					log.Println("Received PTY request")
-					req.Reply(true, nil) // Accept the PTY allocation
-				case "shell":
-					log.Println("Received shell request")
-					req.Reply(true, nil) // Accept the shell request
-				default:
-					log.Printf("Unhandled request: %s", req.Type)
+		go func() {
+			s.handleRequests(conn, channel, requests, recorder, backendName, backend)
+			wg.Done()
+		}()
+	}
+}
+
+// Channel request payloads, RFC 4254 section 6.
+type ptyRequest struct {
+	Term     string
+	Columns  uint32
+	Rows     uint32
+	WidthPx  uint32
+	HeightPx uint32
+	Modes    string
+}
+
+type windowChangeRequest struct {
+	Columns  uint32
+	Rows     uint32
+	WidthPx  uint32
+	HeightPx uint32
+}
+
+type envRequest struct {
+	Name  string
+	Value string
+}
+
+type execRequest struct {
+	Command string
+}
+
+// handleRequests collects the pty, env and window size of a session channel
+// and starts the backend once the client asks for a shell or a command.
+func (s *SSHServer) handleRequests(conn *ssh.ServerConn, channel ssh.Channel, in <-chan *ssh.Request, recorder *CastRecorder, backendName string, backend emulator.Backend) {
+	session := emulator.NewSessionRequest()
+	session.SessionID = hex.EncodeToString(conn.SessionID())
+	session.User = conn.User()
+	session.RemoteAddr = conn.RemoteAddr().String()
+	session.Backend = backendName
+	session.Events = s.Events
+	windowChanges := make(chan emulator.WindowSize, 16)
+	session.WindowChanges = windowChanges
+	defer close(windowChanges)
+	started := false
+
+	for req := range in {
+		// the session is handed to the backend once started, only window
+		// changes can follow it
+		if started && (req.Type == "pty-req" || req.Type == "env") {
+			req.Reply(false, nil)
+			continue
+		}
+		switch req.Type {
+		case "pty-req":
+			var pty ptyRequest
+			if err := ssh.Unmarshal(req.Payload, &pty); err != nil {
+				log.Printf("Failed to parse pty-req: %v", err)
+				req.Reply(false, nil)
+				continue
+			}
+			log.Printf("Received PTY request term=%s size=%dx%d", pty.Term, pty.Columns, pty.Rows)
+			session.PTY = true
+			session.Term = pty.Term
+			if pty.Columns > 0 && pty.Rows > 0 {
+				session.Width, session.Height = pty.Columns, pty.Rows
+			}
+			session.Modes = emulator.ParseTerminalModes(pty.Modes)
+			if recorder != nil {
+				recorder.SetTerminal(session.Term, session.Width, session.Height)
+			}
+			req.Reply(true, nil)
+		case "window-change":
+			var size windowChangeRequest
+			if err := ssh.Unmarshal(req.Payload, &size); err != nil {
+				log.Printf("Failed to parse window-change: %v", err)
+				continue
+			}
+			if recorder != nil {
+				recorder.Resize(size.Columns, size.Rows)
+			}
+			if !started {
+				session.Width, session.Height = size.Columns, size.Rows
+				continue
+			}
+			select {
+			case windowChanges <- emulator.WindowSize{Width: size.Columns, Height: size.Rows}:
+			default:
+				log.Printf("Dropped window change, backend is not keeping up")
+			}
+		case "env":
+			var env envRequest
+			if err := ssh.Unmarshal(req.Payload, &env); err != nil {
+				log.Printf("Failed to parse env request: %v", err)
+				req.Reply(false, nil)
+				continue
+			}
+			log.Printf("Received env %s=%q", env.Name, env.Value)
+			session.Env[env.Name] = env.Value
+			req.Reply(true, nil)
+		case "shell", "exec":
+			if started {
+				req.Reply(false, nil)
+				continue
+			}
+			if req.Type == "exec" {
+				var exec execRequest
+				if err := ssh.Unmarshal(req.Payload, &exec); err != nil {
+					log.Printf("Failed to parse exec request: %v", err)
 					req.Reply(false, nil)
+					continue
+				}
+				log.Printf("Received exec request: %q", exec.Command)
+				session.Command = exec.Command
+				if transfer := scpTransfer(exec.Command); transfer != nil {
+					transfer.User = session.User
+					session.Publish(transfer)
 				}
+				if recorder != nil {
+					recorder.SetCommand(exec.Command)
+				}
+			} else {
+				log.Println("Received shell request")
 			}
-			wg.Done()
-		}(requests)
-		// Todo: pip to system that will be attacked.
-		go sshEmulator.HandleInput(channel)
+			started = true
+			req.Reply(true, nil)
+			go func() {
+				if err := backend.HandleInput(channel, session); err != nil {
+					log.Printf("Session backend failed: %v", err)
+				}
+				if recorder != nil {
+					recorder.Close()
+				}
+			}()
+		default:
+			log.Printf("Unhandled request: %s", req.Type)
+			req.Reply(false, nil)
+		}
+	}
+	if !started && recorder != nil {
+		recorder.Close()
+	}
+}
+
+// newRecorder starts a recording for a session channel, recording failures
+// are logged and the session carries on unrecorded.
+func (s *SSHServer) newRecorder(sessionID string) *CastRecorder {
+	if s.RecordingDir == "" {
+		return nil
+	}
+	recorder, err := NewCastRecorder(s.RecordingDir, sessionID)
+	if err != nil {
+		log.Printf("Failed to start session recording: %v", err)
+		return nil
+	}
+	return recorder
+}
+
+// passwordAttempt records a password, given by method, and lets it in when
+// the policy does.
+func (s *SSHServer) passwordAttempt(c ssh.ConnMetadata, method string, password string) (*ssh.Permissions, error) {
+	attempt := newAuthAttempt(c, method)
+	attempt.Password = password
+	attempt.Accepted = s.Policy != nil && s.Policy.Allow(&attempt)
+	s.recordAttempt(attempt)
+	if attempt.Accepted {
+		return nil, nil
+	}
+	return nil, fmt.Errorf("password rejected for %q", c.User())
+}
+
+func (s *SSHServer) recordAttempt(attempt AuthAttempt) {
+	if s.Attempts != nil {
+		s.Attempts.RecordAttempt(attempt)
+	}
+	s.Events.Publish(&events.AuthAttempt{
+		Header: events.Header{
+			Time:       attempt.Time,
+			Protocol:   events.ProtocolSSH,
+			SessionID:  attempt.SessionID,
+			RemoteAddr: attempt.RemoteAddr,
+		},
+		User:           attempt.User,
+		Method:         attempt.Method,
+		Password:       attempt.Password,
+		KeyType:        attempt.KeyType,
+		KeyFingerprint: attempt.KeyFingerprint,
+		ClientVersion:  attempt.ClientVersion,
+		Accepted:       attempt.Accepted,
+	})
+}
+
+// scpTransfer recognizes the remote end of scp: "scp -t" receives files
+// onto the host and "scp -f" sends them.
+func scpTransfer(command string) *events.FileTransfer {
+	fields := strings.Fields(command)
+	if len(fields) < 2 || path.Base(fields[0]) != "scp" {
+		return nil
+	}
+	transfer := &events.FileTransfer{Tool: "scp"}
+	for _, field := range fields[1:] {
+		switch {
+		case field == "-t":
+			transfer.Direction = events.DirectionInbound
+		case field == "-f":
+			transfer.Direction = events.DirectionOutbound
+		case !strings.HasPrefix(field, "-"):
+			transfer.Path = field
+		}
+	}
+	if transfer.Direction == "" {
+		return nil
 	}
-	defer wg.Done()
+	return transfer
 }
 
 // TODO add to the SSHServer struct
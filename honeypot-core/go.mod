@@ -7,15 +7,23 @@ require (
 	github.com/ollama/ollama v0.9.0
 	github.com/qdrant/go-client v1.14.0
 	golang.org/x/crypto v0.38.0
+	golang.org/x/term v0.32.0
 )
 
+require (
+	github.com/JonathanKoerber/CityUCapstoneMSCS/honeypot-core/app/events v0.0.0
+	github.com/docker/docker v28.2.2+incompatible
+	github.com/docker/go-connections v0.5.0
+)
+
+// the events module is shared with the plc-node
+replace github.com/JonathanKoerber/CityUCapstoneMSCS/honeypot-core/app/events => ./app/events
+
 require (
 	github.com/Microsoft/go-winio v0.6.2 // indirect
 	github.com/containerd/errdefs v1.0.0 // indirect
 	github.com/containerd/errdefs/pkg v0.3.0 // indirect
 	github.com/distribution/reference v0.6.0 // indirect
-	github.com/docker/docker v28.2.2+incompatible // indirect
-	github.com/docker/go-connections v0.5.0 // indirect
 	github.com/docker/go-units v0.5.0 // indirect
 	github.com/felixge/httpsnoop v1.0.4 // indirect
 	github.com/go-logr/logr v1.4.1 // indirect
@@ -31,7 +39,6 @@ require (
 	go.opentelemetry.io/otel/trace v1.24.0 // indirect
 	golang.org/x/net v0.38.0 // indirect
 	golang.org/x/sys v0.33.0 // indirect
-	golang.org/x/term v0.32.0 // indirect
 	golang.org/x/text v0.25.0 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20240903143218-8af14fe29dc1 // indirect
 	google.golang.org/grpc v1.67.0 // indirect